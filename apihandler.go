@@ -0,0 +1,573 @@
+package dutycal
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"ancient-solutions.com/ancientauth"
+)
+
+// Path prefix under which the API is served.
+const apiEventsPath = "/api/v1/events"
+
+// APIHandler serves a JSON API for reading and modifying events. It follows
+// the same permission rules as the HTML handlers.
+//
+//	GET    /api/v1/events?from=…&to=…&owner=…&limit=…
+//	POST   /api/v1/events
+//	GET    /api/v1/events/{id}
+//	PUT    /api/v1/events/{id}
+//	DELETE /api/v1/events/{id}
+//	POST   /api/v1/events/{id}/take
+//	POST   /api/v1/events/{id}/disclaim
+//
+// Times are given in RFC 3339 format. Moving an event to a different time
+// with PUT drops its owners, who are told by mail, just like in the web
+// form. Requests other than GET must be sent with an application/json
+// content type, which browsers will not do for cross-site form submissions.
+type APIHandler struct {
+	auth     *ancientauth.Authenticator
+	store    EventStore
+	config   *DutyCalConfig
+	location *time.Location
+}
+
+// APIEvent is the JSON representation of an event.
+type APIEvent struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Owners      []string  `json:"owners,omitempty"`
+	Staffed     int       `json:"staffed"`
+	MinStaff    int32     `json:"min_staff"`
+	MaxStaff    int32     `json:"max_staff"`
+	Assigned    bool      `json:"assigned"`
+	Reference   string    `json:"reference,omitempty"`
+	Required    bool      `json:"required"`
+	Generated   bool      `json:"generated"`
+}
+
+// APIError is the JSON representation of a failed request.
+type APIError struct {
+	Code     int    `json:"code"`
+	Message  string `json:"message"`
+	LoginURL string `json:"login_url,omitempty"`
+}
+
+type apiErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+type apiEventList struct {
+	Events []*APIEvent `json:"events"`
+}
+
+// NewAPIHandler creates a new JSON API handler using the specified event
+// store "store", the authentication client parameters "auth", the
+// timestamp locale "loc" and the configuration protobuf "conf".
+func NewAPIHandler(
+	store EventStore,
+	auth *ancientauth.Authenticator,
+	loc *time.Location,
+	conf *DutyCalConfig) *APIHandler {
+	if store == nil {
+		log.Panic("store is nil")
+	}
+	if conf == nil {
+		log.Panic("conf is nil")
+	}
+	if loc == nil {
+		log.Panic("loc is nil")
+	}
+	return &APIHandler{
+		auth:     auth,
+		store:    store,
+		config:   conf,
+		location: loc,
+	}
+}
+
+// Convert an event into its JSON representation. Owners are only
+// revealed to users in the edit scope, just like on the web site; everyone
+// else only gets to see how many there are. Events count as assigned once
+// they have reached their minimum staffing.
+func newAPIEvent(ev *Event, inScope bool) *APIEvent {
+	var rv *APIEvent = &APIEvent{
+		ID:          ev.ID,
+		Title:       ev.Title,
+		Description: ev.Description,
+		Start:       ev.Start,
+		End:         ev.Start.Add(ev.Duration),
+		Staffed:     len(ev.Owners),
+		MinStaff:    ev.MinStaff,
+		MaxStaff:    ev.MaxStaff,
+		Assigned:    !ev.IsUnderstaffed(),
+		Required:    ev.Required,
+		Generated:   len(ev.GeneratorID) > 0,
+	}
+
+	if inScope {
+		rv.Owners = ev.Owners
+	}
+	if ev.Reference != nil {
+		rv.Reference = ev.Reference.String()
+	}
+
+	return rv
+}
+
+// Write "data" to the client as JSON with the status code "code".
+func (a *APIHandler) writeJSON(rw http.ResponseWriter, code int,
+	data interface{}) {
+	var err error
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(code)
+	err = json.NewEncoder(rw).Encode(data)
+	if err != nil {
+		log.Print("Error writing API response: ", err)
+	}
+}
+
+// ResponseWriter for HEAD requests, which sends the headers of a response
+// but drops its body.
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+// Discard "p", as responses to HEAD requests have no body.
+func (h headResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// Report an error to the client.
+func (a *APIHandler) writeError(rw http.ResponseWriter, code int,
+	message string) {
+	a.writeJSON(rw, code, &apiErrorResponse{
+		Error: &APIError{Code: code, Message: message},
+	})
+}
+
+// Report that the request requires authentication, and where to get it.
+func (a *APIHandler) writeAuthRequired(rw http.ResponseWriter,
+	req *http.Request) {
+	var rv *APIError = &APIError{
+		Code:    http.StatusUnauthorized,
+		Message: "Authentication required",
+	}
+	var u url.URL
+	var err error
+
+	u, err = a.auth.MakeAuthorizationURL(req)
+	if err == nil {
+		rv.LoginURL = u.String()
+	} else {
+		log.Print("Error generating login URL: ", err)
+	}
+
+	a.writeJSON(rw, http.StatusUnauthorized, &apiErrorResponse{Error: rv})
+}
+
+func (a *APIHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var path string
+	var parts []string
+	var ctype string
+	var err error
+
+	if !strings.HasPrefix(req.URL.Path, apiEventsPath) {
+		a.writeError(rw, http.StatusNotFound, "No such API endpoint")
+		return
+	}
+
+	if req.Method == http.MethodHead {
+		rw = headResponseWriter{rw}
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		ctype, _, err = mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil || ctype != "application/json" {
+			a.writeError(rw, http.StatusUnsupportedMediaType,
+				"Requests must be sent as application/json")
+			return
+		}
+	}
+
+	path = strings.Trim(strings.TrimPrefix(req.URL.Path, apiEventsPath), "/")
+	if len(path) > 0 {
+		parts = strings.Split(path, "/")
+	}
+
+	if len(parts) == 0 {
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			a.listEvents(rw, req)
+		} else if req.Method == http.MethodPost {
+			a.createEvent(rw, req)
+		} else {
+			a.writeError(rw, http.StatusMethodNotAllowed,
+				"Method not allowed")
+		}
+	} else if len(parts) == 1 {
+		a.serveEvent(rw, req, parts[0], "")
+	} else if len(parts) == 2 && req.Method == http.MethodPost {
+		a.serveEvent(rw, req, parts[0], parts[1])
+	} else {
+		a.writeError(rw, http.StatusNotFound, "No such API endpoint")
+	}
+}
+
+// Parse an optional RFC 3339 timestamp from the form field "name".
+// Missing values are returned as the zero Unix timestamp, which is what
+// FetchEventRange understands as an open end.
+func parseAPITime(req *http.Request, name string) (time.Time, error) {
+	var value string = req.FormValue(name)
+
+	if len(value) == 0 {
+		return time.Unix(0, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// List events in a given time range, optionally filtered by owner.
+func (a *APIHandler) listEvents(rw http.ResponseWriter, req *http.Request) {
+	var inScope bool = a.auth.IsAuthenticatedScope(
+		req, a.config.GetEditScope())
+	var from, to time.Time
+	var limit int64 = -1
+	var owner *string
+	var hasOwner bool
+	var events []*Event
+	var ev *Event
+	var rv apiEventList
+	var err error
+
+	err = req.ParseForm()
+	if err != nil {
+		a.writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	from, err = parseAPITime(req, "from")
+	if err != nil {
+		a.writeError(rw, http.StatusBadRequest,
+			"Error parsing from: "+err.Error())
+		return
+	}
+	if from.Unix() == 0 {
+		from = time.Now()
+	}
+
+	to, err = parseAPITime(req, "to")
+	if err != nil {
+		a.writeError(rw, http.StatusBadRequest,
+			"Error parsing to: "+err.Error())
+		return
+	}
+
+	if len(req.FormValue("limit")) > 0 {
+		limit, err = strconv.ParseInt(req.FormValue("limit"), 10, 32)
+		if err != nil {
+			a.writeError(rw, http.StatusBadRequest,
+				"Error parsing limit: "+err.Error())
+			return
+		}
+	}
+
+	_, hasOwner = req.Form["owner"]
+	if hasOwner {
+		var user string = req.FormValue("owner")
+
+		// Only members of the edit scope may find out who owns what,
+		// but anyone may ask for unassigned events or their own.
+		if len(user) > 0 && !inScope &&
+			user != a.auth.GetAuthenticatedUser(req) {
+			a.writeError(rw, http.StatusForbidden,
+				"No permission to filter by owner")
+			return
+		}
+		owner = &user
+	}
+
+	events, err = FetchEventRange(a.store, from, to, int32(limit),
+		a.location, owner, false)
+	if err != nil {
+		log.Print("Error fetching events from ", from, " to ", to, ": ", err)
+		a.writeError(rw, http.StatusInternalServerError,
+			"Error fetching events: "+err.Error())
+		return
+	}
+
+	rv.Events = make([]*APIEvent, 0, len(events))
+	for _, ev = range events {
+		rv.Events = append(rv.Events, newAPIEvent(ev, inScope))
+	}
+
+	a.writeJSON(rw, http.StatusOK, &rv)
+}
+
+// Read an event from the request body into "ev", validating it the same
+// way as the web form does.
+func (a *APIHandler) readEvent(req *http.Request, ev *Event) error {
+	var in APIEvent
+	var err error
+
+	err = json.NewDecoder(req.Body).Decode(&in)
+	if err != nil {
+		return errors.New("Error parsing request: " + err.Error())
+	}
+
+	if len(in.Title) == 0 || len(in.Description) == 0 {
+		return errors.New("Title and description are required")
+	}
+	if !in.End.After(in.Start) {
+		return errors.New("Event starts after it ends")
+	}
+	if in.End.Sub(in.Start) > time.Duration(
+		a.config.GetMaxEventDurationWeeks())*7*24*time.Hour {
+		return errors.New("Events must not last longer than " +
+			strconv.Itoa(int(a.config.GetMaxEventDurationWeeks())) +
+			" weeks")
+	}
+
+	ev.Title = in.Title
+	ev.Description = in.Description
+	ev.Start = in.Start.In(a.location)
+	ev.Duration = in.End.Sub(in.Start)
+	ev.Reference = nil
+
+	// Leave the staffing alone if the client doesn't know about it.
+	if in.MinStaff > 0 {
+		ev.MinStaff = in.MinStaff
+	}
+	if in.MaxStaff > 0 {
+		ev.MaxStaff = in.MaxStaff
+	}
+	if ev.MaxStaff < ev.MinStaff {
+		return errors.New("max_staff must not be less than min_staff")
+	}
+	if ev.MaxStaff < int32(len(ev.Owners)) {
+		return errors.New("max_staff must not be less than the number " +
+			"of current owners")
+	}
+
+	if len(in.Reference) > 0 {
+		ev.Reference, err = url.Parse(in.Reference)
+		if err != nil {
+			return errors.New("Error parsing reference: " + err.Error())
+		}
+		if !ev.Reference.IsAbs() {
+			return errors.New("URL reference is not absolute")
+		}
+	}
+
+	return nil
+}
+
+// Create a new event owned by the current user.
+func (a *APIHandler) createEvent(rw http.ResponseWriter, req *http.Request) {
+	var user string = a.auth.GetAuthenticatedUser(req)
+	var ev *Event
+	var err error
+
+	if len(user) == 0 {
+		a.writeAuthRequired(rw, req)
+		return
+	}
+
+	if !a.auth.IsAuthenticatedScope(req, a.config.GetEditScope()) {
+		a.writeError(rw, http.StatusForbidden,
+			"No permission to create events: "+user+" is not in "+
+				a.config.GetEditScope())
+		return
+	}
+
+	ev = CreateEvent(a.store, "", "", user, time.Now(), 0, a.location,
+		nil, false)
+	err = a.readEvent(req, ev)
+	if err != nil {
+		a.writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = ev.Sync()
+	if err != nil {
+		log.Print("Error writing out new event: ", err)
+		a.writeError(rw, http.StatusInternalServerError,
+			"Error writing event: "+err.Error())
+		return
+	}
+	RecordHistory(a.store, HistoryCreate, user, nil, ev)
+
+	rw.Header().Set("Location", apiEventsPath+"/"+url.PathEscape(ev.ID))
+	a.writeJSON(rw, http.StatusCreated, newAPIEvent(ev, true))
+}
+
+// Handle requests for the individual event "id", with the operation "op"
+// (or an empty string for the event itself).
+func (a *APIHandler) serveEvent(rw http.ResponseWriter, req *http.Request,
+	id, op string) {
+	var user string = a.auth.GetAuthenticatedUser(req)
+	var inScope bool = a.auth.IsAuthenticatedScope(
+		req, a.config.GetEditScope())
+	var perms EventPermissions
+	var before Event
+	var dropped []string
+	var ev *Event
+	var err error
+
+	// Read with quorum for modifications so we see the latest state.
+	ev, err = FetchEvent(a.store, id, a.location,
+		req.Method != http.MethodGet && req.Method != http.MethodHead)
+	if err == ErrEventNotFound {
+		a.writeError(rw, http.StatusNotFound, "No such event: "+id)
+		return
+	} else if err != nil {
+		log.Print("Error fetching event ", id, ": ", err)
+		a.writeError(rw, http.StatusInternalServerError,
+			"Error fetching event: "+err.Error())
+		return
+	}
+
+	if op == "" && (req.Method == http.MethodGet ||
+		req.Method == http.MethodHead) {
+		a.writeJSON(rw, http.StatusOK, newAPIEvent(ev, inScope))
+		return
+	}
+
+	if len(user) == 0 {
+		a.writeAuthRequired(rw, req)
+		return
+	}
+
+	perms = GetEventPermissions(ev, user, inScope)
+	before = *ev
+
+	if op == "take" {
+		if !inScope {
+			a.writeError(rw, http.StatusForbidden,
+				"No permission to take events: "+user+" is not in "+
+					a.config.GetEditScope())
+			return
+		}
+		if ev.HasOwner(user) {
+			a.writeJSON(rw, http.StatusOK, newAPIEvent(ev, inScope))
+			return
+		}
+		a.changeOwners(rw, HistoryTake, user, &before, ev, ev.AddOwner,
+			inScope)
+		return
+	} else if op == "disclaim" {
+		if !perms.CanDisclaim {
+			a.writeError(rw, http.StatusForbidden,
+				"Only owners can disclaim an event")
+			return
+		}
+		a.changeOwners(rw, HistoryDisclaim, user, &before, ev,
+			ev.RemoveOwner, inScope)
+		return
+	} else if op != "" {
+		a.writeError(rw, http.StatusNotFound, "No such operation: "+op)
+		return
+	} else if req.Method == http.MethodPut {
+		if !perms.CanEdit {
+			a.writeError(rw, http.StatusForbidden,
+				"No permission to edit this event")
+			return
+		}
+		err = a.readEvent(req, ev)
+		if err != nil {
+			a.writeError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// The changes are only written if the owners are still the ones
+		// they were checked against, e.g. for max_staff. The owners
+		// themselves are left alone, unless the event was moved.
+		dropped, err = ev.SyncEdit(&before)
+		if err == ErrOwnerChanged {
+			a.writeError(rw, http.StatusConflict,
+				"The owners of the event have changed in the meantime")
+			return
+		} else if err == ErrEventNotFound {
+			a.writeError(rw, http.StatusNotFound, "No such event: "+id)
+			return
+		}
+		if len(dropped) > 0 {
+			go notifyDroppedOwners(a.config, a.location, ev, dropped)
+		}
+	} else if req.Method == http.MethodDelete {
+		if !perms.CanDelete {
+			a.writeError(rw, http.StatusForbidden,
+				"Only the owner can delete events which are not required")
+			return
+		}
+		err = ev.Delete()
+		if err == ErrEventChanged {
+			a.writeError(rw, http.StatusConflict,
+				"Event has been changed in the meantime")
+			return
+		} else if err == ErrEventNotFound {
+			a.writeError(rw, http.StatusNotFound, "No such event: "+id)
+			return
+		} else if err != nil {
+			log.Print("Error deleting event ", ev.ID, ": ", err)
+			a.writeError(rw, http.StatusInternalServerError,
+				"Error deleting event: "+err.Error())
+			return
+		}
+		RecordHistory(a.store, HistoryDelete, user, &before, nil)
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	} else {
+		a.writeError(rw, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if err != nil {
+		log.Print("Error syncing event ", ev.ID, ": ", err)
+		a.writeError(rw, http.StatusInternalServerError,
+			"Error writing event: "+err.Error())
+		return
+	}
+	RecordHistory(a.store, HistoryEdit, user, &before, ev)
+
+	a.writeJSON(rw, http.StatusOK, newAPIEvent(ev, inScope))
+}
+
+// Add or remove "user" as an owner of "ev" using "change" (i.e.
+// ev.AddOwner or ev.RemoveOwner), and report the result to the client. If
+// it worked, "action" is recorded in the history, with "before" as the old
+// state.
+func (a *APIHandler) changeOwners(rw http.ResponseWriter, action,
+	user string, before, ev *Event, change func(string) error,
+	inScope bool) {
+	var err error
+
+	err = change(user)
+	if err == ErrEventFull {
+		a.writeError(rw, http.StatusConflict,
+			"Event is already fully staffed")
+		return
+	} else if err == ErrOwnerChanged {
+		a.writeError(rw, http.StatusConflict,
+			"Someone else keeps changing the owners of this event")
+		return
+	} else if err != nil {
+		log.Print("Error syncing new owner of event ", ev.ID, ": ", err)
+		a.writeError(rw, http.StatusInternalServerError,
+			"Error writing event: "+err.Error())
+		return
+	}
+	RecordHistory(a.store, action, user, before, ev)
+
+	a.writeJSON(rw, http.StatusOK, newAPIEvent(ev, inScope))
+}
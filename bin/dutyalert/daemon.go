@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/starshipfactory/dutycal"
+)
+
+// Upper limit for the delay between retries.
+const maxRetryBackoff = time.Hour
+
+// Function used to wait between retries. Replaced by tests.
+var retrySleep func(time.Duration) = time.Sleep
+
+// Run "op" until it succeeds, retrying as often as configured for the
+// notification section and waiting twice as long before every retry.
+// "what" describes the operation for the log. Returns the last error if
+// "op" never succeeded.
+func retry(notification *dutycal.UpcomingEventNotificationConfig,
+	what string, op func() error) error {
+	var delay time.Duration = time.Duration(
+		notification.GetRetryBackoffSeconds()) * time.Second
+	var attempt int32
+	var err error
+
+	for attempt = 0; ; attempt++ {
+		err = op()
+		if err == nil || attempt >= notification.GetMaxRetries() {
+			return err
+		}
+
+		log.Print("Error ", what, " for ", notification.GetName(),
+			" (attempt ", attempt+1, "), retrying in ", delay, ": ", err)
+		retrySleep(delay)
+
+		delay *= 2
+		if delay > maxRetryBackoff {
+			delay = maxRetryBackoff
+		}
+	}
+}
+
+// SendNotification sends the mails for the notification section
+// "notification" according to its mode.
+func SendNotification(
+	notification *dutycal.UpcomingEventNotificationConfig,
+	store dutycal.EventStore,
+	tmpl *MailTemplates,
+	loc *time.Location,
+	config *dutycal.DutyCalConfig,
+	state *NotificationState) error {
+	if notification.GetMode() ==
+		dutycal.UpcomingEventNotificationConfig_REMINDER {
+		return SendReminders(notification, store, tmpl, loc, config, state)
+	}
+
+	return SendNotifications(notification, store, tmpl, loc, config, state)
+}
+
+// RunScheduled sends the notification section "notification" whenever
+// "schedule" says so, until the schedule runs out. Errors are logged, and
+// the section is tried again at the next scheduled time.
+func RunScheduled(
+	notification *dutycal.UpcomingEventNotificationConfig,
+	schedule Schedule,
+	store dutycal.EventStore,
+	tmpl *MailTemplates,
+	loc *time.Location,
+	config *dutycal.DutyCalConfig,
+	state *NotificationState) {
+	var next time.Time
+	var err error
+
+	for {
+		next = schedule.Next(time.Now().In(loc))
+		if next.IsZero() {
+			log.Print("Schedule of ", notification.GetName(),
+				" has no further dates, stopping")
+			return
+		}
+
+		log.Print("Sending ", notification.GetName(), " next at ", next)
+		time.Sleep(next.Sub(time.Now()))
+
+		err = SendNotification(notification, store, tmpl, loc, config,
+			state)
+		if err != nil {
+			log.Print("Error sending ", notification.GetName(), ": ", err)
+		}
+	}
+}
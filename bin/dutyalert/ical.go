@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/starshipfactory/dutycal"
+)
+
+// Content type of iCalendar attachments with the iTIP method "method".
+func icalContentType(method string) string {
+	return "text/calendar; method=" + method + "; charset=utf-8"
+}
+
+// Create an iCalendar attachment publishing all of "events", for mails
+// to a group. "name" is used as the name of the calendar.
+func publishAttachment(name string, events []*AnnouncedEvent) (
+	*dutycal.MailAttachment, error) {
+	var sb bytes.Buffer
+	var plain []*dutycal.Event
+	var ae *AnnouncedEvent
+	var err error
+
+	for _, ae = range events {
+		plain = append(plain, ae.Event)
+	}
+
+	err = dutycal.WriteICalendar(&sb, name, "PUBLISH", plain)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dutycal.MailAttachment{
+		Filename:    "events.ics",
+		ContentType: icalContentType("PUBLISH"),
+		Data:        sb.Bytes(),
+	}, nil
+}
+
+// Create an invitation for each of "events" to "owner", to be attached to
+// the reminder mail "m". Every invitation needs its own attachment, since
+// an iTIP request may only contain a single event.
+func inviteAttachments(name string, m *dutycal.MailMessage, owner string,
+	events []*AnnouncedEvent) ([]*dutycal.MailAttachment, error) {
+	var rv []*dutycal.MailAttachment
+	var organizer string
+	var attendees []string
+	var ae *AnnouncedEvent
+	var i int
+	var err error
+
+	organizer, attendees, err = m.Envelope()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, ae = range events {
+		var sb bytes.Buffer
+
+		err = dutycal.WriteICalendarRequest(&sb, name, organizer,
+			attendees[0], owner, ae.Event)
+		if err != nil {
+			return nil, err
+		}
+
+		rv = append(rv, &dutycal.MailAttachment{
+			Filename:    "shift-" + strconv.Itoa(i+1) + ".ics",
+			ContentType: icalContentType("REQUEST"),
+			Data:        sb.Bytes(),
+		})
+	}
+
+	return rv, nil
+}
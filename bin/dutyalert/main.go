@@ -1,32 +1,39 @@
 package main
 
 import (
-	"database/cassandra"
 	"flag"
 	"io/ioutil"
 	"log"
-	"text/template"
+	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	_ "github.com/lib/pq"
 	"github.com/starshipfactory/dutycal"
 )
 
 func main() {
-	var db *cassandra.RetryCassandraClient
+	var store dutycal.EventStore
 	var notificationSection string
 	var configPath string
+	var daemon bool
 	var configdata []byte
 	var loc *time.Location
 	var config dutycal.DutyCalConfig
 	var notification, n *dutycal.UpcomingEventNotificationConfig
-	var tmpl *template.Template
+	var tmpl *MailTemplates
+	var state *NotificationState
+	var wg sync.WaitGroup
+	var scheduled int
 	var err error
 
 	flag.StringVar(&configPath, "config", "",
 		"Path to the configuration file")
 	flag.StringVar(&notificationSection, "section", "",
 		"Name of the notification section to check against")
+	flag.BoolVar(&daemon, "daemon", false,
+		"Keep running and send all notification sections with a "+
+			"schedule (or just -section) whenever they are due")
 	flag.Parse()
 
 	if len(configPath) == 0 {
@@ -44,22 +51,63 @@ func main() {
 		log.Fatal("Error reading config file: ", err)
 	}
 
-	db, err = cassandra.NewRetryCassandraClient(config.GetDbServer())
+	store, err = dutycal.OpenEventStore(&config)
 	if err != nil {
-		log.Fatal("Error connecting to Cassandra at ",
-			config.GetDbServer(), ": ", err)
+		log.Fatal("Error opening event store: ", err)
 	}
 
-	err = db.SetKeyspace(config.GetKeyspace())
+	loc, err = time.LoadLocation(config.GetDefaultTimeZone())
 	if err != nil {
-		log.Fatal("Error switching keyspace to ", config.GetKeyspace(),
+		log.Fatal("Unable to load time zone ", config.GetDefaultTimeZone(),
 			": ", err)
 	}
 
-	loc, err = time.LoadLocation(config.GetDefaultTimeZone())
+	state, err = LoadNotificationState(config.GetNotificationStatePath())
 	if err != nil {
-		log.Fatal("Unable to load time zone ", config.GetDefaultTimeZone(),
-			": ", err)
+		log.Fatal("Error reading notification state from ",
+			config.GetNotificationStatePath(), ": ", err)
+	}
+
+	if daemon {
+		for _, n = range config.GetUpcomingNotifications() {
+			var schedule Schedule
+
+			if len(notificationSection) > 0 &&
+				n.GetName() != notificationSection {
+				continue
+			}
+			if len(n.GetSchedule()) == 0 {
+				log.Print("No schedule for ", n.GetName(), ", skipping")
+				continue
+			}
+
+			schedule, err = ParseSchedule(n.GetSchedule())
+			if err != nil {
+				log.Fatal("Invalid schedule for ", n.GetName(), ": ", err)
+			}
+
+			tmpl, err = LoadMailTemplates(n)
+			if err != nil {
+				log.Fatal("Error loading templates of ", n.GetName(),
+					": ", err)
+			}
+
+			wg.Add(1)
+			go func(n *dutycal.UpcomingEventNotificationConfig,
+				schedule Schedule, tmpl *MailTemplates) {
+				RunScheduled(n, schedule, store, tmpl, loc, &config, state)
+				wg.Done()
+			}(n, schedule, tmpl)
+			scheduled++
+		}
+
+		if scheduled == 0 {
+			log.Fatal("No notification sections with a schedule in ",
+				configPath)
+		}
+
+		wg.Wait()
+		return
 	}
 
 	for _, n = range config.GetUpcomingNotifications() {
@@ -73,11 +121,14 @@ func main() {
 			" in configuration ", configPath)
 	}
 
-	tmpl, err = template.ParseFiles(notification.GetTemplatePath())
+	tmpl, err = LoadMailTemplates(notification)
 	if err != nil {
-		log.Fatal("Error loading template ", notification.GetTemplatePath(),
+		log.Fatal("Error loading templates of ", notification.GetName(),
 			": ", err)
 	}
 
-	SendNotifications(notification, db, tmpl, loc, &config)
+	err = SendNotification(notification, store, tmpl, loc, &config, state)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/starshipfactory/dutycal"
+)
+
+// Content of an m.room.message event sent to Matrix.
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+}
+
+// MatrixNotifier sends announcements to a Matrix room through the
+// client-server API.
+type MatrixNotifier struct {
+	client        *http.Client
+	homeserverURL string
+	accessToken   string
+	roomID        string
+
+	// The announcement sent last and its transaction ID, so retries of
+	// the same announcement reuse the ID and aren't posted twice.
+	lastMessage *dutycal.MailMessage
+	txnID       string
+}
+
+// Generate a transaction ID for sending a message. The homeserver uses it
+// to tell retries of the same message from new ones, so it must be unique.
+func genMatrixTxnID() string {
+	var rnd [16]byte
+
+	rand.Read(rnd[:])
+	return "dutyalert-" + hex.EncodeToString(rnd[:])
+}
+
+// Notify sends the announcement to the room, using the HTML version as
+// formatted body if there is one. Sending the same announcement again,
+// e.g. after an error, reuses its transaction ID.
+func (n *MatrixNotifier) Notify(m *dutycal.MailMessage,
+	events []*AnnouncedEvent) error {
+	var msg *matrixMessage = &matrixMessage{
+		MsgType: "m.text",
+		Body:    m.Subject + "\n\n" + m.Text,
+	}
+	var target string
+
+	if m != n.lastMessage || len(n.txnID) == 0 {
+		n.lastMessage = m
+		n.txnID = genMatrixTxnID()
+	}
+	target = strings.TrimRight(n.homeserverURL, "/") +
+		"/_matrix/client/v3/rooms/" + url.PathEscape(n.roomID) +
+		"/send/m.room.message/" + n.txnID
+
+	if len(m.HTML) > 0 {
+		msg.Format = "org.matrix.custom.html"
+		msg.FormattedBody = m.HTML
+	}
+
+	return sendJSON(n.client, http.MethodPut, target,
+		"Bearer "+n.accessToken, msg)
+}
+
+func (n *MatrixNotifier) String() string {
+	return "matrix room " + n.roomID
+}
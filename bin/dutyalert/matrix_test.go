@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/dutycal"
+)
+
+// Prefix of the paths messages to the test room are sent to.
+const matrixSendPath = "/_matrix/client/v3/rooms/%21room:example.org" +
+	"/send/m.room.message/"
+
+func TestMatrixNotify(t *testing.T) {
+	var s *notificationServer = newNotificationServer(0)
+	var n *MatrixNotifier
+	var m *dutycal.MailMessage
+	var msg matrixMessage
+	var err error
+
+	defer s.Close()
+
+	n = &MatrixNotifier{
+		client:        s.Client(),
+		homeserverURL: s.URL + "/",
+		accessToken:   "syt_secret",
+		roomID:        "!room:example.org",
+	}
+	m, _ = testAnnouncement()
+
+	err = n.Notify(m, nil)
+	if err != nil {
+		t.Fatal("Error notifying: ", err)
+	}
+
+	s.decode(t, 0, &msg)
+	if s.requests[0].method != http.MethodPut ||
+		!strings.HasPrefix(s.requests[0].path, matrixSendPath) ||
+		path.Base(s.requests[0].path) != n.txnID {
+		t.Errorf("got %s %s, want PUT %s%s", s.requests[0].method,
+			s.requests[0].path, matrixSendPath, n.txnID)
+	}
+	if s.requests[0].authorization != "Bearer syt_secret" {
+		t.Errorf("Authorization: got %q, want %q",
+			s.requests[0].authorization, "Bearer syt_secret")
+	}
+	if msg.MsgType != "m.text" ||
+		msg.Body != "Open duties\n\nOpen Factory needs you." ||
+		msg.Format != "org.matrix.custom.html" ||
+		msg.FormattedBody != m.HTML {
+		t.Errorf("got %+v", msg)
+	}
+}
+
+func TestMatrixNotifyPlainText(t *testing.T) {
+	var s *notificationServer = newNotificationServer(0)
+	var n *MatrixNotifier
+	var msg matrixMessage
+	var err error
+
+	defer s.Close()
+
+	n = &MatrixNotifier{client: s.Client(), homeserverURL: s.URL,
+		roomID: "!room:example.org"}
+	err = n.Notify(&dutycal.MailMessage{Subject: "Open duties",
+		Text: "Open Factory needs you."}, nil)
+	if err != nil {
+		t.Fatal("Error notifying: ", err)
+	}
+
+	s.decode(t, 0, &msg)
+	if msg.Format != "" || msg.FormattedBody != "" {
+		t.Errorf("got %+v, want no formatted body", msg)
+	}
+}
+
+// Retries of an announcement must be sent with the same transaction ID, so
+// the homeserver doesn't post it twice if only the response got lost.
+func TestMatrixRetryReusesTxnID(t *testing.T) {
+	var s *notificationServer = newNotificationServer(2)
+	var notification *dutycal.UpcomingEventNotificationConfig
+	var n *MatrixNotifier
+	var m *dutycal.MailMessage
+	var sleep func(time.Duration) = retrySleep
+	var r *receivedRequest
+	var err error
+
+	defer s.Close()
+	defer func() { retrySleep = sleep }()
+
+	retrySleep = func(time.Duration) {}
+	notification = &dutycal.UpcomingEventNotificationConfig{
+		Name:       proto.String("weekly"),
+		MaxRetries: proto.Int32(3),
+	}
+	n = &MatrixNotifier{client: s.Client(), homeserverURL: s.URL,
+		roomID: "!room:example.org"}
+	m, _ = testAnnouncement()
+
+	err = retry(notification, "sending", func() error {
+		return n.Notify(m, nil)
+	})
+	if err != nil {
+		t.Fatal("Error notifying: ", err)
+	}
+
+	if len(s.requests) != 3 {
+		t.Fatalf("got %d requests, want 3", len(s.requests))
+	}
+	for _, r = range s.requests {
+		if r.path != s.requests[0].path {
+			t.Errorf("retry sent to %s, want %s", r.path,
+				s.requests[0].path)
+		}
+	}
+
+	// The next announcement is a new message.
+	m, _ = testAnnouncement()
+	err = n.Notify(m, nil)
+	if err != nil {
+		t.Fatal("Error notifying: ", err)
+	}
+	if s.requests[3].path == s.requests[0].path {
+		t.Errorf("new announcement reused the transaction ID %s",
+			path.Base(s.requests[0].path))
+	}
+}
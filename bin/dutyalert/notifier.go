@@ -1,107 +1,222 @@
 package main
 
 import (
-	"bytes"
-	"database/cassandra"
-	"io"
+	"fmt"
 	"log"
-	"net"
-	"net/smtp"
-	"strconv"
-	"text/template"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/starshipfactory/dutycal"
 )
 
-// SendNotifications sends notification mails as required for all unassigned
+// Timeout for requests to webhooks and chat servers.
+const notifierTimeout = 30 * time.Second
+
+// Determine the link to the page of the event "id" on the calendar web
+// site under "baseURL". Returns an empty string if there is no base URL.
+func eventURL(baseURL, id string) string {
+	if len(baseURL) == 0 {
+		return ""
+	}
+
+	return strings.TrimRight(baseURL, "/") + "/event/" + url.PathEscape(id) +
+		"/view"
+}
+
+// Link the announced events "events" to their pages on the calendar web
+// site under "baseURL", for use in the templates.
+func linkEvents(events []*AnnouncedEvent, baseURL string) {
+	var ae *AnnouncedEvent
+
+	for _, ae = range events {
+		ae.URL = eventURL(baseURL, ae.ID)
+	}
+}
+
+// Notifier delivers announcements of unassigned events through a specific
+// channel, such as mail or a chat room.
+type Notifier interface {
+	// Notify announces "events" through the channel. "m" holds the
+	// subject and the rendered templates of the announcement.
+	Notify(m *dutycal.MailMessage, events []*AnnouncedEvent) error
+
+	// String describes the channel for log messages.
+	String() string
+}
+
+// MailNotifier sends announcements as mails through the SMTP server from
+// the configuration.
+type MailNotifier struct {
+	config *dutycal.DutyCalConfig
+}
+
+// Notify sends "m" as a mail.
+func (n *MailNotifier) Notify(m *dutycal.MailMessage,
+	events []*AnnouncedEvent) error {
+	return dutycal.SendMessage(n.config, m)
+}
+
+func (n *MailNotifier) String() string {
+	return "mail"
+}
+
+// NewNotifiers creates notifiers for all the channels configured for the
+// notification section "notification". "client" is used for all HTTP
+// requests.
+func NewNotifiers(notification *dutycal.UpcomingEventNotificationConfig,
+	config *dutycal.DutyCalConfig, client *http.Client) []Notifier {
+	var rv []Notifier
+	var webhook *dutycal.WebhookConfig
+	var slack *dutycal.SlackConfig
+	var matrix *dutycal.MatrixConfig
+
+	if len(notification.GetRecipient()) > 0 ||
+		len(notification.GetCc()) > 0 || len(notification.GetBcc()) > 0 {
+		rv = append(rv, &MailNotifier{config: config})
+	}
+	for _, webhook = range notification.GetWebhook() {
+		rv = append(rv, &WebhookNotifier{
+			client:        client,
+			url:           webhook.GetUrl(),
+			authorization: webhook.GetAuthorization(),
+			section:       notification.GetName(),
+			baseURL:       config.GetBaseUrl(),
+		})
+	}
+	for _, slack = range notification.GetSlack() {
+		rv = append(rv, &SlackNotifier{
+			client:   client,
+			url:      slack.GetWebhookUrl(),
+			channel:  slack.GetChannel(),
+			username: slack.GetUsername(),
+		})
+	}
+	for _, matrix = range notification.GetMatrix() {
+		rv = append(rv, &MatrixNotifier{
+			client:        client,
+			homeserverURL: matrix.GetHomeserverUrl(),
+			accessToken:   matrix.GetAccessToken(),
+			roomID:        matrix.GetRoomId(),
+		})
+	}
+
+	return rv
+}
+
+// SendNotifications sends notifications as required for all unassigned
 // events in the upcoming few days (as specified in the notification
-// configuration). SMTP server settings are taken from the config.
+// configuration) through all channels configured for it. Database and
+// delivery errors are retried as configured for the notification. Which of
+// the events are announced depends on what was previously announced
+// according to "state".
 func SendNotifications(
 	notification *dutycal.UpcomingEventNotificationConfig,
-	db *cassandra.RetryCassandraClient,
-	tmpl *template.Template,
+	store dutycal.EventStore,
+	tmpl *MailTemplates,
 	loc *time.Location,
-	config *dutycal.DutyCalConfig) {
+	config *dutycal.DutyCalConfig,
+	state *NotificationState) error {
+	var sent time.Time = time.Now()
 	var now time.Time = time.Now().In(loc).Truncate(
 		24 * time.Hour)
 	var end time.Time = now.AddDate(0, 0,
 		int(notification.GetWarningLookahead()))
-	var sb bytes.Buffer
+	var m *dutycal.MailMessage
 	var events []*dutycal.Event
-	var notify []*dutycal.Event
+	var open []*dutycal.Event
+	var notify []*AnnouncedEvent
+	var notifiers []Notifier
+	var notifier Notifier
 	var ev *dutycal.Event
-	var weekend time.Time
-	var auth smtp.Auth
-	var smtpHost string
 	var user string
-	var offset int
+	var failed int
 	var err error
 
-	for now.Before(end) {
-		weekend = now.AddDate(0, 0, 8).Truncate(7 * 24 * time.Hour)
-		_, offset = weekend.Zone()
-		weekend = weekend.Add(time.Duration(-offset) * time.Second)
-
-		if end.Before(weekend) {
-			weekend = end
-		}
+	notifiers = NewNotifiers(notification, config,
+		&http.Client{Timeout: notifierTimeout})
+	if len(notifiers) == 0 {
+		return fmt.Errorf("No recipient or channel configured for %s",
+			notification.GetName())
+	}
 
+	err = retry(notification, "fetching events", func() error {
 		events, err = dutycal.FetchEventRange(
-			db, config, now, weekend, -1, loc, &user, false)
-		if err != nil {
-			log.Fatal("Error fetching events from ", now, " to ",
-				weekend, ": ", err)
-		}
+			store, now, end, -1, loc, &user, false)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error fetching events from %s to %s: %s",
+			now, end, err)
+	}
 
-		for _, ev = range events {
-			if ev.Required && ev.Owner == "" {
-				notify = append(notify, ev)
-			}
+	for _, ev = range events {
+		if ev.Required && ev.IsUnderstaffed() {
+			open = append(open, ev)
 		}
+	}
 
-		now = weekend
+	notify = state.Select(notification, open, "", sent)
+	if len(notify) == 0 || state.InCooldown(notification, notify, sent) {
+		return nil
 	}
+	linkEvents(notify, config.GetBaseUrl())
 
-	if len(notify) == 0 {
-		return
+	m = &dutycal.MailMessage{
+		From:    notification.GetSender(),
+		To:      notification.GetRecipient(),
+		Cc:      notification.GetCc(),
+		Bcc:     notification.GetBcc(),
+		Subject: notification.GetSubject(),
+	}
+	err = tmpl.Render(notify, m)
+	if err != nil {
+		return fmt.Errorf("Error executing templates of %s: %s",
+			notification.GetName(), err)
 	}
 
-	// Write the mail header first.
-	io.WriteString(&sb, "Message-Id: notify-"+
-		time.Now().In(loc).Format("2006-01-02T15-04-05")+"-"+
-		strconv.FormatInt(int64(len(notify)), 10)+"msg-"+
-		notification.GetSender()+"\r\n")
-	io.WriteString(&sb, "Content-Type: text/plain; charset=utf-8\r\n")
-	io.WriteString(&sb, "From: "+notification.GetSender()+"\r\n")
-	io.WriteString(&sb, "To: "+notification.GetRecipient()+"\r\n")
-	io.WriteString(&sb, "Subject: "+notification.GetSubject()+"\r\n")
-	io.WriteString(&sb, "Date: "+time.Now().In(loc).Format(time.RFC1123Z)+
-		"\r\n\r\n")
+	if notification.GetAttachIcalendar() {
+		var a *dutycal.MailAttachment
 
-	err = tmpl.Execute(&sb, notify)
-	if err != nil {
-		log.Fatal("Error executing template ",
-			notification.GetTemplatePath(), ": ", err)
+		a, err = publishAttachment(config.GetAuth().GetAppName(), notify)
+		if err != nil {
+			return fmt.Errorf("Error creating calendar for %s: %s",
+				notification.GetName(), err)
+		}
+		m.Attachments = append(m.Attachments, a)
 	}
 
-	smtpHost, _, err = net.SplitHostPort(
-		config.GetMailConfig().GetSmtpServerAddress())
-	if err != nil {
-		log.Fatal("Error splitting host:port in SMTP server address: ",
-			err)
+	// Channels are retried on their own, so the others don't get the
+	// same announcement twice.
+	for _, notifier = range notifiers {
+		err = retry(notification, "sending to "+notifier.String(),
+			func() error {
+				return notifier.Notify(m, notify)
+			})
+		if err != nil {
+			log.Print("Error sending ", notification.GetName(), " to ",
+				notifier, ": ", err)
+			failed++
+		}
 	}
 
-	auth = smtp.PlainAuth(
-		config.GetMailConfig().GetIdentity(),
-		config.GetMailConfig().GetUsername(),
-		config.GetMailConfig().GetPassword(), smtpHost)
+	if failed == len(notifiers) {
+		return fmt.Errorf("Could not send %s through any channel",
+			notification.GetName())
+	}
 
-	err = smtp.SendMail(config.GetMailConfig().GetSmtpServerAddress(),
-		auth, notification.GetSender(),
-		[]string{notification.GetRecipient()}, sb.Bytes())
+	// The announcement is out, so failing to remember that shouldn't fail
+	// the whole run.
+	err = state.Record(notification, notify, "", sent)
 	if err != nil {
-		log.Fatal("Error sending mail to ", notification.GetRecipient(),
-			": ", err)
+		log.Print("Error saving notification state: ", err)
 	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d channels failed for %s", failed,
+			len(notifiers), notification.GetName())
+	}
+
+	return nil
 }
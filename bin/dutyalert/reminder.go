@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/starshipfactory/dutycal"
+)
+
+// ReminderData holds all the data to be presented to an owner from the
+// template of a reminder mail.
+type ReminderData struct {
+	// User name of the owner the mail is sent to.
+	Owner string
+
+	// Upcoming events of the owner, sorted by start time.
+	Events []*AnnouncedEvent
+}
+
+// SendReminders mails every owner of an event starting within the reminder
+// window of the notification configuration a reminder of their upcoming
+// events. Owner addresses are determined through the member directory or
+// the member address pattern of the mail configuration. Database and SMTP
+// errors are retried as configured for the notification; reminders which
+// still could not be sent are reported in the returned error. Every owner
+// is only reminded of the events selected for them according to "state".
+// All reminders are sent through the same connection to the SMTP server.
+func SendReminders(
+	notification *dutycal.UpcomingEventNotificationConfig,
+	store dutycal.EventStore,
+	tmpl *MailTemplates,
+	loc *time.Location,
+	config *dutycal.DutyCalConfig,
+	state *NotificationState) error {
+	var now time.Time = time.Now().In(loc)
+	var end time.Time = now.Add(
+		time.Duration(notification.GetReminderWindowHours()) * time.Hour)
+	var events []*dutycal.Event
+	var byOwner map[string][]*dutycal.Event = make(
+		map[string][]*dutycal.Event)
+	var owners []string
+	var client *dutycal.MailClient
+	var ev *dutycal.Event
+	var owner string
+	var failed int
+	var err error
+
+	err = retry(notification, "fetching events", func() error {
+		events, err = dutycal.FetchEventRange(
+			store, now, end, -1, loc, nil, false)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error fetching events from %s to %s: %s",
+			now, end, err)
+	}
+
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	// Events are sorted by start time, so the events of each owner will
+	// be as well.
+	for _, ev = range events {
+		if ev.Start.Before(now) {
+			continue
+		}
+
+		for _, owner = range ev.Owners {
+			if len(byOwner[owner]) == 0 {
+				owners = append(owners, owner)
+			}
+			byOwner[owner] = append(byOwner[owner], ev)
+		}
+	}
+
+	for _, owner = range owners {
+		var m *dutycal.MailMessage
+		var addr string = dutycal.MemberAddress(config, owner)
+		var rd *ReminderData = &ReminderData{
+			Owner: owner,
+			Events: state.Select(notification, byOwner[owner], "/"+owner,
+				now),
+		}
+
+		if len(rd.Events) == 0 {
+			continue
+		}
+		linkEvents(rd.Events, config.GetBaseUrl())
+		if len(addr) == 0 {
+			log.Print("No mail address known for ", owner,
+				", not sending reminder")
+			continue
+		}
+
+		m = &dutycal.MailMessage{
+			From:    notification.GetSender(),
+			To:      []string{addr},
+			Subject: notification.GetSubject(),
+		}
+		err = tmpl.Render(rd, m)
+		if err != nil {
+			return fmt.Errorf("Error executing templates of %s: %s",
+				notification.GetName(), err)
+		}
+
+		if notification.GetAttachIcalendar() {
+			m.Attachments, err = inviteAttachments(
+				config.GetAuth().GetAppName(), m, owner, rd.Events)
+			if err != nil {
+				log.Print("Error creating invitations for ", owner, ": ",
+					err)
+				failed++
+				continue
+			}
+		}
+
+		// Retry every reminder on its own, so nobody gets the same
+		// reminder twice because someone else's failed.
+		err = retry(notification, "sending reminder to "+addr,
+			func() error {
+				if client == nil {
+					client, err = dutycal.DialMail(config)
+					if err != nil {
+						return err
+					}
+				}
+
+				err = client.Send(m)
+				if err != nil {
+					// The connection may be broken, so start over.
+					client.Close()
+					client = nil
+				}
+				return err
+			})
+		if err != nil {
+			log.Print("Error sending reminder to ", addr, ": ", err)
+			failed++
+			continue
+		}
+
+		err = state.Record(notification, rd.Events, "/"+owner, now)
+		if err != nil {
+			log.Print("Error saving notification state: ", err)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d reminders could not be sent", failed,
+			len(owners))
+	}
+
+	return nil
+}
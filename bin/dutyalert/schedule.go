@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule determines when a notification section should be sent next.
+type Schedule interface {
+	// Next returns the first time after "t" at which the notification
+	// should be sent, or the zero time if it never should again.
+	Next(t time.Time) time.Time
+}
+
+// Schedule which fires at a fixed interval.
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+func (s *intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+// Schedule which fires on the times matching a cron expression. Every
+// field is a bit set of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day of month or day of week was "*". If both are
+	// restricted, a day matching either of them will do, just like cron.
+	domStar, dowStar bool
+}
+
+// How far to look into the future for a time matching a cron expression
+// before concluding that there is none, e.g. for "0 0 31 2 *".
+const maxCronSearchYears = 5
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	var dom bool = s.dom&(1<<uint(t.Day())) != 0
+	var dow bool = s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+// Get the wall clock time of "t" as if it were in UTC, for comparing times
+// across daylight saving time changes.
+func wallTime(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(),
+		t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// Get the time at the given wall clock time in "loc". If the wall clock
+// time occurs twice because the clocks are moved back, the first one is
+// used, which time.Date doesn't guarantee.
+func cronDate(year int, month time.Month, day, hour int,
+	loc *time.Location) time.Time {
+	var t time.Time = time.Date(year, month, day, hour, 0, 0, 0, loc)
+	var earlier time.Time
+	var offset, before int
+
+	_, offset = t.Zone()
+	_, before = t.AddDate(0, 0, -1).Zone()
+	if before > offset {
+		earlier = t.Add(-time.Duration(before-offset) * time.Second)
+		if wallTime(earlier).Equal(wallTime(t)) {
+			return earlier
+		}
+	}
+
+	return t
+}
+
+// Next returns the first time after "t" matching the cron expression. When
+// the clocks are moved back, the repeated wall clock times are skipped, so
+// the schedule doesn't fire twice for them.
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	var loc *time.Location = t.Location()
+	var limit time.Time = t.AddDate(maxCronSearchYears, 0, 0)
+	var after time.Time = wallTime(t)
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = cronDate(t.Year(), t.Month()+1, 1, 0, loc)
+		} else if !s.matchesDay(t) {
+			t = cronDate(t.Year(), t.Month(), t.Day()+1, 0, loc)
+		} else if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = cronDate(t.Year(), t.Month(), t.Day(), t.Hour()+1, loc)
+		} else if s.minute&(1<<uint(t.Minute())) == 0 ||
+			!wallTime(t).After(after) {
+			t = t.Add(time.Minute)
+		} else {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// Parse a single field of a cron expression, such as "*/15", "1-5" or
+// "0,30", into a bit set of the values between "min" and "max" it matches.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var rv uint64
+	var part string
+	var err error
+
+	for _, part = range strings.Split(field, ",") {
+		var rangeSpec string = part
+		var step int = 1
+		var from, to int
+		var pos int
+		var i int
+
+		pos = strings.Index(part, "/")
+		if pos >= 0 {
+			rangeSpec = part[:pos]
+			step, err = strconv.Atoi(part[pos+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("Invalid step in %q", part)
+			}
+		}
+
+		if rangeSpec == "*" {
+			from, to = min, max
+		} else if pos = strings.Index(rangeSpec, "-"); pos >= 0 {
+			from, err = strconv.Atoi(rangeSpec[:pos])
+			if err != nil {
+				return 0, fmt.Errorf("Invalid range %q", part)
+			}
+			to, err = strconv.Atoi(rangeSpec[pos+1:])
+			if err != nil {
+				return 0, fmt.Errorf("Invalid range %q", part)
+			}
+		} else {
+			from, err = strconv.Atoi(rangeSpec)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid value %q", part)
+			}
+			to = from
+		}
+
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for i = from; i <= to; i += step {
+			rv |= 1 << uint(i)
+		}
+	}
+
+	return rv, nil
+}
+
+// ParseSchedule parses the schedule specification "spec" of a notification
+// section. See the description of the schedule field in config.proto for
+// the supported formats.
+func ParseSchedule(spec string) (Schedule, error) {
+	var fields []string
+	var s *cronSchedule = new(cronSchedule)
+	var err error
+
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		var interval time.Duration
+
+		interval, err = time.ParseDuration(
+			strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, err
+		}
+		if interval < time.Minute {
+			return nil, errors.New("Intervals must be at least a minute")
+		}
+		return &intervalSchedule{interval: interval}, nil
+	}
+
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+
+	fields = strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Expected 5 fields in cron expression %q, "+
+			"got %d", spec, len(fields))
+	}
+
+	s.minute, err = parseCronField(fields[0], 0, 59)
+	if err == nil {
+		s.hour, err = parseCronField(fields[1], 0, 23)
+	}
+	if err == nil {
+		s.dom, err = parseCronField(fields[2], 1, 31)
+	}
+	if err == nil {
+		s.month, err = parseCronField(fields[3], 1, 12)
+	}
+	if err == nil {
+		// Both 0 and 7 are Sunday.
+		s.dow, err = parseCronField(fields[4], 0, 7)
+		if s.dow&(1<<7) != 0 {
+			s.dow |= 1
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing cron expression %q: %s",
+			spec, err)
+	}
+
+	s.domStar = fields[2] == "*"
+	s.dowStar = fields[4] == "*"
+
+	return s, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Load the time zone the tests are written for.
+func zurich(t *testing.T) *time.Location {
+	var loc *time.Location
+	var err error
+
+	loc, err = time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Fatal("Error loading time zone: ", err)
+	}
+
+	return loc
+}
+
+// Field of a cron expression, the range of values it may contain and the
+// values it must match.
+type cronFieldTest struct {
+	field    string
+	min, max int
+	want     []int
+	wantErr  bool
+}
+
+func TestParseCronField(t *testing.T) {
+	var test cronFieldTest
+	var tests = []cronFieldTest{
+		{field: "*", min: 1, max: 12,
+			want: []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}},
+		{field: "5", min: 0, max: 59, want: []int{5}},
+		{field: "0,30", min: 0, max: 59, want: []int{0, 30}},
+		{field: "1-5", min: 0, max: 7, want: []int{1, 2, 3, 4, 5}},
+		{field: "*/15", min: 0, max: 59, want: []int{0, 15, 30, 45}},
+		{field: "*/5", min: 1, max: 12, want: []int{1, 6, 11}},
+		{field: "9-17/4", min: 0, max: 23, want: []int{9, 13, 17}},
+		{field: "10-11/5", min: 0, max: 23, want: []int{10}},
+		{field: "0,12-14,20-23/2", min: 0, max: 23,
+			want: []int{0, 12, 13, 14, 20, 22}},
+		{field: "0-59", min: 0, max: 59, want: cronRange(0, 59)},
+		{field: "", min: 0, max: 59, wantErr: true},
+		{field: "a", min: 0, max: 59, wantErr: true},
+		{field: "1,", min: 0, max: 59, wantErr: true},
+		{field: "60", min: 0, max: 59, wantErr: true},
+		{field: "0", min: 1, max: 31, wantErr: true},
+		{field: "-1", min: 0, max: 59, wantErr: true},
+		{field: "5-1", min: 0, max: 59, wantErr: true},
+		{field: "1-", min: 0, max: 59, wantErr: true},
+		{field: "x-5", min: 0, max: 59, wantErr: true},
+		{field: "0-60", min: 0, max: 59, wantErr: true},
+		{field: "*/0", min: 0, max: 59, wantErr: true},
+		{field: "*/-1", min: 0, max: 59, wantErr: true},
+		{field: "*/x", min: 0, max: 59, wantErr: true},
+		{field: "*/", min: 0, max: 59, wantErr: true},
+	}
+
+	for _, test = range tests {
+		var want uint64
+		var got uint64
+		var i int
+		var err error
+
+		got, err = parseCronField(test.field, test.min, test.max)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %b, want an error", test.field, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.field, err)
+			continue
+		}
+
+		for _, i = range test.want {
+			want |= 1 << uint(i)
+		}
+		if got != want {
+			t.Errorf("%q: got %b, want %b", test.field, got, want)
+		}
+	}
+}
+
+// All values from "from" to "to".
+func cronRange(from, to int) []int {
+	var rv []int
+	var i int
+
+	for i = from; i <= to; i++ {
+		rv = append(rv, i)
+	}
+
+	return rv
+}
+
+// Schedule, the time it is asked about and when it must fire next, in UTC
+// to leave no doubt about wall clock times occurring twice.
+type scheduleTest struct {
+	name string
+	spec string
+	t    time.Time
+	want time.Time
+}
+
+// In 2027, the clocks in Zurich are moved forward from 02:00 CET to
+// 03:00 CEST on March 28 and back from 03:00 CEST to 02:00 CET on
+// October 31.
+func TestScheduleNextAcrossDST(t *testing.T) {
+	var loc *time.Location = zurich(t)
+	var test scheduleTest
+	var tests = []scheduleTest{
+		{
+			// Intervals are measured in elapsed time, 03:30 CEST.
+			name: "interval into summer time",
+			spec: "@every 1h",
+			t:    time.Date(2027, 3, 28, 0, 30, 0, 0, time.UTC),
+			want: time.Date(2027, 3, 28, 1, 30, 0, 0, time.UTC),
+		},
+		{
+			// 13:00 CEST, an hour later on the wall clock.
+			name: "daily interval into summer time",
+			spec: "@every 24h",
+			t:    time.Date(2027, 3, 27, 11, 0, 0, 0, time.UTC),
+			want: time.Date(2027, 3, 28, 11, 0, 0, 0, time.UTC),
+		},
+		{
+			// From 02:45 CEST to 02:45 CET.
+			name: "interval into winter time",
+			spec: "@every 1h",
+			t:    time.Date(2027, 10, 31, 0, 45, 0, 0, time.UTC),
+			want: time.Date(2027, 10, 31, 1, 45, 0, 0, time.UTC),
+		},
+		{
+			// From 01:30 CET to 03:00 CEST, as 02:00 doesn't exist.
+			name: "hourly into summer time",
+			spec: "@hourly",
+			t:    time.Date(2027, 3, 28, 0, 30, 0, 0, time.UTC),
+			want: time.Date(2027, 3, 28, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			// From 01:30 CEST to 02:00 CEST.
+			name: "hourly before winter time",
+			spec: "@hourly",
+			t:    time.Date(2027, 10, 30, 23, 30, 0, 0, time.UTC),
+			want: time.Date(2027, 10, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// From 02:00 CEST to 03:00 CET, skipping 02:00 CET.
+			name: "hourly into winter time",
+			spec: "@hourly",
+			t:    time.Date(2027, 10, 31, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2027, 10, 31, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			// 02:30 doesn't exist on March 28, so the next one is
+			// 02:30 CEST the day after.
+			name: "skipped time",
+			spec: "30 2 * * *",
+			t:    time.Date(2027, 3, 27, 2, 0, 0, 0, time.UTC),
+			want: time.Date(2027, 3, 29, 0, 30, 0, 0, time.UTC),
+		},
+		{
+			// 02:30 CEST on October 31.
+			name: "repeated time, first time",
+			spec: "30 2 * * *",
+			t:    time.Date(2027, 10, 30, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2027, 10, 31, 0, 30, 0, 0, time.UTC),
+		},
+		{
+			// From 02:45 CEST to 02:30 CET the day after, without firing
+			// again at 02:30 CET on October 31.
+			name: "repeated time, second time",
+			spec: "30 2 * * *",
+			t:    time.Date(2027, 10, 31, 0, 45, 0, 0, time.UTC),
+			want: time.Date(2027, 11, 1, 1, 30, 0, 0, time.UTC),
+		},
+		{
+			// From Friday 18:00 CET to Monday 09:00 CEST.
+			name: "weekdays across the weekend",
+			spec: "0 9 * * 1-5",
+			t:    time.Date(2027, 3, 26, 17, 0, 0, 0, time.UTC),
+			want: time.Date(2027, 3, 29, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "never",
+			spec: "0 0 31 2 *",
+			t:    time.Date(2027, 3, 28, 0, 30, 0, 0, time.UTC),
+		},
+	}
+
+	for _, test = range tests {
+		var s Schedule
+		var got time.Time
+		var err error
+
+		s, err = ParseSchedule(test.spec)
+		if err != nil {
+			t.Errorf("%s: error parsing %q: %s", test.name, test.spec, err)
+			continue
+		}
+
+		got = s.Next(test.t.In(loc))
+		if !got.Equal(test.want) {
+			t.Errorf("%s: got %s, want %s", test.name, got,
+				test.want.In(loc))
+		}
+		if !got.IsZero() && got.Location() != loc {
+			t.Errorf("%s: got %s, want a time in %s", test.name, got, loc)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/starshipfactory/dutycal"
+)
+
+// AnnouncedEvent is an event as presented to the notification templates.
+// All fields of the event can be used directly.
+type AnnouncedEvent struct {
+	*dutycal.Event
+
+	// Whether the event is announced through the section for the first
+	// time, as opposed to being still open since an earlier mail.
+	New bool
+
+	// When the event was first announced through the section. Zero for
+	// new events.
+	FirstAnnounced time.Time
+
+	// Link to the page of the event on the calendar web site. Empty if
+	// no base_url is configured.
+	URL string
+}
+
+// Record of an event announced through a notification section.
+type announcement struct {
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+
+	// Start of the event, to tell when the record can be forgotten.
+	Start time.Time `json:"start"`
+}
+
+// State of an individual notification section.
+type sectionState struct {
+	LastSent time.Time                `json:"last_sent"`
+	Events   map[string]*announcement `json:"events"`
+}
+
+// NotificationState keeps track of which events were announced through
+// which notification section, and when. It is kept in a JSON file so it
+// survives restarts.
+type NotificationState struct {
+	mtx      sync.Mutex
+	path     string
+	Sections map[string]*sectionState `json:"sections"`
+}
+
+// LoadNotificationState reads the notification state from the file "path".
+// If the file doesn't exist yet, the state starts out empty. If "path" is
+// empty, the state is only kept in memory.
+func LoadNotificationState(path string) (*NotificationState, error) {
+	var s *NotificationState = &NotificationState{
+		path:     path,
+		Sections: make(map[string]*sectionState),
+	}
+	var data []byte
+	var err error
+
+	if len(path) == 0 {
+		return s, nil
+	}
+
+	data, err = ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Sections == nil {
+		s.Sections = make(map[string]*sectionState)
+	}
+
+	return s, nil
+}
+
+// Get the state of the section "name", creating it if required. The
+// caller must hold the lock.
+func (s *NotificationState) section(name string) *sectionState {
+	var ss *sectionState = s.Sections[name]
+
+	if ss == nil {
+		ss = &sectionState{Events: make(map[string]*announcement)}
+		s.Sections[name] = ss
+	}
+
+	return ss
+}
+
+// Select determines which of "events" to announce through the section
+// "notification" at the time "now", according to its announce mode. "key"
+// is appended to the event IDs to tell apart announcements to different
+// people, e.g. for reminders.
+func (s *NotificationState) Select(
+	notification *dutycal.UpcomingEventNotificationConfig,
+	events []*dutycal.Event, key string, now time.Time) []*AnnouncedEvent {
+	var repeatAfter time.Duration = time.Duration(
+		notification.GetRepeatAfterDays()) * 24 * time.Hour
+	var rv []*AnnouncedEvent
+	var ss *sectionState
+	var ev *dutycal.Event
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ss = s.section(notification.GetName())
+
+	for _, ev = range events {
+		var a *announcement = ss.Events[ev.ID+key]
+		var ae *AnnouncedEvent = &AnnouncedEvent{
+			Event: ev,
+			New:   a == nil,
+		}
+
+		if a != nil {
+			ae.FirstAnnounced = a.First
+		}
+
+		switch notification.GetAnnounce() {
+		case dutycal.UpcomingEventNotificationConfig_NEW:
+			if !ae.New {
+				continue
+			}
+		case dutycal.UpcomingEventNotificationConfig_NEW_AND_OVERDUE:
+			if !ae.New && now.Sub(a.Last) < repeatAfter {
+				continue
+			}
+		}
+
+		rv = append(rv, ae)
+	}
+
+	return rv
+}
+
+// InCooldown determines whether a mail of the section "notification"
+// without any new events in "events" should be suppressed at the time
+// "now" because the previous mail was sent too recently.
+func (s *NotificationState) InCooldown(
+	notification *dutycal.UpcomingEventNotificationConfig,
+	events []*AnnouncedEvent, now time.Time) bool {
+	var cooldown time.Duration = time.Duration(
+		notification.GetCooldownHours()) * time.Hour
+	var ae *AnnouncedEvent
+
+	for _, ae = range events {
+		if ae.New {
+			return false
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return now.Sub(s.section(notification.GetName()).LastSent) < cooldown
+}
+
+// Record notes that "events" have been announced through the section
+// "notification" at the time "now", and writes the state back to its file.
+// See Select for the meaning of "key".
+func (s *NotificationState) Record(
+	notification *dutycal.UpcomingEventNotificationConfig,
+	events []*AnnouncedEvent, key string, now time.Time) error {
+	var ss *sectionState
+	var ae *AnnouncedEvent
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ss = s.section(notification.GetName())
+	ss.LastSent = now
+
+	for _, ae = range events {
+		var a *announcement = ss.Events[ae.ID+key]
+
+		if a == nil {
+			a = &announcement{First: now}
+			ss.Events[ae.ID+key] = a
+		}
+		a.Last = now
+		a.Start = ae.Start
+	}
+
+	return s.save(now)
+}
+
+// Forget about events which have already started, and write the state to
+// its file. The file is replaced atomically so it can't be left half
+// written. The caller must hold the lock.
+func (s *NotificationState) save(now time.Time) error {
+	var ss *sectionState
+	var a *announcement
+	var key string
+	var tmp *os.File
+	var data []byte
+	var err error
+
+	for _, ss = range s.Sections {
+		for key, a = range ss.Events {
+			if a.Start.Before(now) {
+				delete(ss.Events, key)
+			}
+		}
+	}
+
+	if len(s.path) == 0 {
+		return nil
+	}
+
+	data, err = json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err = ioutil.TempFile(filepath.Dir(s.path),
+		filepath.Base(s.path)+".")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"text/template"
+
+	"github.com/starshipfactory/dutycal"
+)
+
+// MailTemplates holds the templates for the plain text and, optionally,
+// the HTML version of the mails of a notification section.
+type MailTemplates struct {
+	Text *template.Template
+	HTML *htmltemplate.Template
+}
+
+// LoadMailTemplates reads the templates configured for the notification
+// section "notification".
+func LoadMailTemplates(
+	notification *dutycal.UpcomingEventNotificationConfig) (
+	*MailTemplates, error) {
+	var rv *MailTemplates = new(MailTemplates)
+	var err error
+
+	rv.Text, err = template.ParseFiles(notification.GetTemplatePath())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(notification.GetHtmlTemplatePath()) > 0 {
+		rv.HTML, err = htmltemplate.ParseFiles(
+			notification.GetHtmlTemplatePath())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rv, nil
+}
+
+// Render executes the templates with "data", setting the text and HTML
+// versions of the mail "m".
+func (t *MailTemplates) Render(data interface{},
+	m *dutycal.MailMessage) error {
+	var sb bytes.Buffer
+	var err error
+
+	err = t.Text.Execute(&sb, data)
+	if err != nil {
+		return err
+	}
+	m.Text = sb.String()
+
+	if t.HTML == nil {
+		return nil
+	}
+
+	sb.Reset()
+	err = t.HTML.Execute(&sb, data)
+	if err != nil {
+		return err
+	}
+	m.HTML = sb.String()
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/dutycal"
+)
+
+// Directory of the templates shipped with dutyalert.
+const alertTemplatePath = "../../alert-templates/"
+
+// Template shipped with dutyalert, and the HTML template used along with
+// it, if any.
+type alertTemplateTest struct {
+	text, html string
+}
+
+func TestAlertTemplatesLinkToBaseURL(t *testing.T) {
+	var test alertTemplateTest
+	var tests = []alertTemplateTest{
+		{text: "daily.txt", html: "daily.html"},
+		{text: "weekly.txt", html: "weekly.html"},
+	}
+
+	for _, test = range tests {
+		var notification *dutycal.UpcomingEventNotificationConfig
+		var tmpl *MailTemplates
+		var m *dutycal.MailMessage
+		var events []*AnnouncedEvent
+		var err error
+
+		notification = &dutycal.UpcomingEventNotificationConfig{
+			TemplatePath: proto.String(alertTemplatePath + test.text),
+			HtmlTemplatePath: proto.String(
+				alertTemplatePath + test.html),
+		}
+		tmpl, err = LoadMailTemplates(notification)
+		if err != nil {
+			t.Fatalf("%s: error loading templates: %s", test.text, err)
+		}
+
+		m, events = testAnnouncement()
+		linkEvents(events, "https://calendar.example.com/")
+		err = tmpl.Render(events, m)
+		if err != nil {
+			t.Errorf("%s: error rendering: %s", test.text, err)
+			continue
+		}
+
+		if !strings.Contains(m.Text,
+			"https://calendar.example.com/event/ev%2F1/view") {
+			t.Errorf("%s: no link to the event in %q", test.text, m.Text)
+		}
+		if !strings.Contains(m.HTML,
+			`href="https://calendar.example.com/event/ev%2F1/view"`) {
+			t.Errorf("%s: no link to the event in %q", test.html, m.HTML)
+		}
+
+		// Without a base URL, there is nothing to link to.
+		m, events = testAnnouncement()
+		err = tmpl.Render(events, m)
+		if err != nil {
+			t.Errorf("%s: error rendering: %s", test.text, err)
+			continue
+		}
+		if strings.Contains(m.Text, "/event/") ||
+			strings.Contains(m.HTML, "/event/") {
+			t.Errorf("%s: got links without base URL: %q, %q", test.text,
+				m.Text, m.HTML)
+		}
+	}
+}
+
+func TestReminderTemplateLinksToBaseURL(t *testing.T) {
+	var notification *dutycal.UpcomingEventNotificationConfig
+	var tmpl *MailTemplates
+	var m *dutycal.MailMessage
+	var rd *ReminderData = &ReminderData{Owner: "alice"}
+	var err error
+
+	notification = &dutycal.UpcomingEventNotificationConfig{
+		TemplatePath: proto.String(alertTemplatePath + "reminder.txt"),
+	}
+	tmpl, err = LoadMailTemplates(notification)
+	if err != nil {
+		t.Fatal("Error loading template: ", err)
+	}
+
+	m, rd.Events = testAnnouncement()
+	linkEvents(rd.Events, "https://calendar.example.com")
+	err = tmpl.Render(rd, m)
+	if err != nil {
+		t.Fatal("Error rendering: ", err)
+	}
+	if !strings.Contains(m.Text,
+		"https://calendar.example.com/event/ev%2F1/view") {
+		t.Errorf("no link to the event in %q", m.Text)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/starshipfactory/dutycal"
+)
+
+// Send "payload" as JSON to "target" using the HTTP method "method". If
+// "authorization" is set, it is sent as the Authorization header. Any
+// status other than 2xx is an error.
+func sendJSON(client *http.Client, method, target, authorization string,
+	payload interface{}) error {
+	var req *http.Request
+	var resp *http.Response
+	var body []byte
+	var err error
+
+	body, err = json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err = http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(authorization) > 0 {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, target, resp.Status,
+			string(body))
+	}
+
+	return nil
+}
+
+// JSON representation of an event posted to webhooks. Just like the API,
+// it doesn't contain the names of the owners.
+type webhookEvent struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Reference string    `json:"reference,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	New       bool      `json:"new"`
+	Staffed   int       `json:"staffed"`
+	MinStaff  int32     `json:"min_staff"`
+	MaxStaff  int32     `json:"max_staff"`
+}
+
+// JSON payload posted to webhooks.
+type webhookPayload struct {
+	Section string          `json:"section"`
+	Subject string          `json:"subject"`
+	Text    string          `json:"text"`
+	Events  []*webhookEvent `json:"events"`
+}
+
+// WebhookNotifier posts announcements as JSON to a generic HTTP webhook.
+type WebhookNotifier struct {
+	client        *http.Client
+	url           string
+	authorization string
+	section       string
+
+	// Base URL of the calendar web site, for links to the events.
+	baseURL string
+}
+
+// Notify posts the announcement of "events" to the webhook.
+func (n *WebhookNotifier) Notify(m *dutycal.MailMessage,
+	events []*AnnouncedEvent) error {
+	var payload *webhookPayload = &webhookPayload{
+		Section: n.section,
+		Subject: m.Subject,
+		Text:    m.Text,
+		Events:  []*webhookEvent{},
+	}
+	var ae *AnnouncedEvent
+
+	for _, ae = range events {
+		var we *webhookEvent = &webhookEvent{
+			ID:       ae.ID,
+			Title:    ae.Title,
+			Start:    ae.Start,
+			End:      ae.Start.Add(ae.Duration),
+			New:      ae.New,
+			Staffed:  len(ae.Owners),
+			MinStaff: ae.MinStaff,
+			MaxStaff: ae.MaxStaff,
+		}
+
+		if ae.Reference != nil {
+			we.Reference = ae.Reference.String()
+		}
+		we.URL = eventURL(n.baseURL, ae.ID)
+		payload.Events = append(payload.Events, we)
+	}
+
+	return sendJSON(n.client, http.MethodPost, n.url, n.authorization,
+		payload)
+}
+
+func (n *WebhookNotifier) String() string {
+	return "webhook " + n.url
+}
+
+// Message posted to Slack compatible incoming webhooks.
+type slackMessage struct {
+	Text     string `json:"text"`
+	Channel  string `json:"channel,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+// SlackNotifier posts announcements to a Slack compatible incoming webhook.
+type SlackNotifier struct {
+	client   *http.Client
+	url      string
+	channel  string
+	username string
+}
+
+// Notify posts the text of the announcement to the webhook, headed by the
+// subject.
+func (n *SlackNotifier) Notify(m *dutycal.MailMessage,
+	events []*AnnouncedEvent) error {
+	return sendJSON(n.client, http.MethodPost, n.url, "", &slackMessage{
+		Text:     "*" + m.Subject + "*\n\n" + m.Text,
+		Channel:  n.channel,
+		Username: n.username,
+	})
+}
+
+func (n *SlackNotifier) String() string {
+	// The webhook URL contains the secret, so don't log it.
+	return "slack"
+}
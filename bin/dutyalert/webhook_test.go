@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/dutycal"
+)
+
+// Request received by a notificationServer.
+type receivedRequest struct {
+	method        string
+	path          string
+	authorization string
+	contentType   string
+	body          []byte
+}
+
+// HTTP server standing in for webhooks and chat servers. It records all
+// requests and answers the first "failures" of them with 503.
+type notificationServer struct {
+	*httptest.Server
+
+	failures int
+	requests []*receivedRequest
+}
+
+// Start a notificationServer failing the first "failures" requests. The
+// caller has to close it.
+func newNotificationServer(failures int) *notificationServer {
+	var s *notificationServer = &notificationServer{failures: failures}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var body []byte
+
+			body, _ = ioutil.ReadAll(r.Body)
+			s.requests = append(s.requests, &receivedRequest{
+				method:        r.Method,
+				path:          r.URL.EscapedPath(),
+				authorization: r.Header.Get("Authorization"),
+				contentType:   r.Header.Get("Content-Type"),
+				body:          body,
+			})
+
+			if len(s.requests) <= s.failures {
+				http.Error(w, "Try again later",
+					http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("{}"))
+		}))
+
+	return s
+}
+
+// Decode the body of the request "n" into "v".
+func (s *notificationServer) decode(t *testing.T, n int,
+	v interface{}) {
+	var err error
+
+	if len(s.requests) <= n {
+		t.Fatalf("got %d requests, want at least %d", len(s.requests),
+			n+1)
+	}
+
+	err = json.Unmarshal(s.requests[n].body, v)
+	if err != nil {
+		t.Fatalf("Error decoding request %d: %s", n, err)
+	}
+}
+
+// Create an announcement of a single new event.
+func testAnnouncement() (*dutycal.MailMessage, []*AnnouncedEvent) {
+	var m *dutycal.MailMessage = &dutycal.MailMessage{
+		Subject: "Open duties",
+		Text:    "Open Factory needs you.",
+		HTML:    "<p>Open Factory needs you.</p>",
+	}
+	var ev *dutycal.Event = &dutycal.Event{
+		ID:       "ev/1",
+		Title:    "Open Factory",
+		Start:    time.Date(2027, 3, 2, 18, 0, 0, 0, time.UTC),
+		Duration: 2 * time.Hour,
+		Owners:   []string{"alice"},
+		MinStaff: 2,
+		MaxStaff: 3,
+	}
+
+	ev.Reference, _ = url.Parse("https://www.example.org/open-factory")
+
+	return m, []*AnnouncedEvent{{Event: ev, New: true}}
+}
+
+func TestWebhookNotify(t *testing.T) {
+	var s *notificationServer = newNotificationServer(0)
+	var n *WebhookNotifier
+	var m *dutycal.MailMessage
+	var events []*AnnouncedEvent
+	var payload webhookPayload
+	var we *webhookEvent
+	var err error
+
+	defer s.Close()
+
+	n = &WebhookNotifier{
+		client:        s.Client(),
+		url:           s.URL + "/hook",
+		authorization: "Token secret",
+		section:       "weekly",
+		baseURL:       "https://dutycal.example.org",
+	}
+	m, events = testAnnouncement()
+
+	err = n.Notify(m, events)
+	if err != nil {
+		t.Fatal("Error notifying: ", err)
+	}
+
+	s.decode(t, 0, &payload)
+	if s.requests[0].method != http.MethodPost ||
+		s.requests[0].path != "/hook" {
+		t.Errorf("got %s %s, want POST /hook", s.requests[0].method,
+			s.requests[0].path)
+	}
+	if s.requests[0].authorization != "Token secret" {
+		t.Errorf("Authorization: got %q, want %q",
+			s.requests[0].authorization, "Token secret")
+	}
+	if s.requests[0].contentType != "application/json" {
+		t.Errorf("Content-Type: got %q, want application/json",
+			s.requests[0].contentType)
+	}
+	if payload.Section != "weekly" || payload.Subject != m.Subject ||
+		payload.Text != m.Text || len(payload.Events) != 1 {
+		t.Fatalf("got %+v, want the announcement of one event", payload)
+	}
+
+	we = payload.Events[0]
+	if we.ID != "ev/1" || we.Title != "Open Factory" ||
+		!we.Start.Equal(events[0].Start) ||
+		!we.End.Equal(events[0].Start.Add(2*time.Hour)) || !we.New ||
+		we.Staffed != 1 || we.MinStaff != 2 || we.MaxStaff != 3 ||
+		we.Reference != "https://www.example.org/open-factory" ||
+		we.URL != "https://dutycal.example.org/event/ev%2F1/view" {
+		t.Errorf("got %+v", we)
+	}
+
+	// The owners are not published.
+	if strings.Contains(string(s.requests[0].body), "alice") {
+		t.Errorf("payload contains the owner: %s", s.requests[0].body)
+	}
+}
+
+func TestWebhookNotifyWithoutAuthorization(t *testing.T) {
+	var s *notificationServer = newNotificationServer(0)
+	var n *WebhookNotifier
+	var payload webhookPayload
+	var err error
+
+	defer s.Close()
+
+	n = &WebhookNotifier{client: s.Client(), url: s.URL}
+	err = n.Notify(testAnnouncement())
+	if err != nil {
+		t.Fatal("Error notifying: ", err)
+	}
+
+	s.decode(t, 0, &payload)
+	if s.requests[0].authorization != "" {
+		t.Errorf("Authorization: got %q, want none",
+			s.requests[0].authorization)
+	}
+	if len(payload.Events) != 1 || payload.Events[0].URL != "" {
+		t.Errorf("got %+v, want one event without URL", payload.Events)
+	}
+}
+
+func TestSlackNotify(t *testing.T) {
+	var s *notificationServer = newNotificationServer(0)
+	var n *SlackNotifier
+	var msg slackMessage
+	var err error
+
+	defer s.Close()
+
+	n = &SlackNotifier{
+		client:   s.Client(),
+		url:      s.URL + "/services/T0/B0/secret",
+		channel:  "#duties",
+		username: "dutyalert",
+	}
+	err = n.Notify(testAnnouncement())
+	if err != nil {
+		t.Fatal("Error notifying: ", err)
+	}
+
+	s.decode(t, 0, &msg)
+	if s.requests[0].method != http.MethodPost ||
+		s.requests[0].path != "/services/T0/B0/secret" {
+		t.Errorf("got %s %s, want POST /services/T0/B0/secret",
+			s.requests[0].method, s.requests[0].path)
+	}
+	if s.requests[0].authorization != "" {
+		t.Errorf("Authorization: got %q, want none",
+			s.requests[0].authorization)
+	}
+	if msg.Text != "*Open duties*\n\nOpen Factory needs you." ||
+		msg.Channel != "#duties" || msg.Username != "dutyalert" {
+		t.Errorf("got %+v", msg)
+	}
+	if strings.Contains(n.String(), "secret") {
+		t.Errorf("%q contains the webhook URL", n.String())
+	}
+}
+
+// Server errors while notifying, how often dutyalert has to try and how
+// long it waits in between.
+type retryTest struct {
+	name         string
+	failures     int
+	maxRetries   int32
+	backoff      int32
+	wantRequests int
+	wantDelays   []time.Duration
+	wantErr      bool
+}
+
+func TestNotifyRetriesServerErrors(t *testing.T) {
+	var test retryTest
+	var tests = []retryTest{
+		{
+			name:         "no errors",
+			backoff:      10,
+			failures:     0,
+			maxRetries:   3,
+			wantRequests: 1,
+		},
+		{
+			name:         "recovers",
+			backoff:      10,
+			failures:     2,
+			maxRetries:   3,
+			wantRequests: 3,
+			wantDelays:   []time.Duration{10 * time.Second, 20 * time.Second},
+		},
+		{
+			name:         "gives up",
+			backoff:      10,
+			failures:     5,
+			maxRetries:   2,
+			wantRequests: 3,
+			wantDelays:   []time.Duration{10 * time.Second, 20 * time.Second},
+			wantErr:      true,
+		},
+		{
+			name:         "backoff limited",
+			failures:     4,
+			maxRetries:   4,
+			backoff:      1200,
+			wantRequests: 5,
+			wantDelays: []time.Duration{20 * time.Minute,
+				40 * time.Minute, time.Hour, time.Hour},
+		},
+	}
+	var sleep func(time.Duration) = retrySleep
+
+	defer func() { retrySleep = sleep }()
+
+	for _, test = range tests {
+		var s *notificationServer = newNotificationServer(test.failures)
+		var notification *dutycal.UpcomingEventNotificationConfig
+		var n *WebhookNotifier = &WebhookNotifier{
+			client: s.Client(),
+			url:    s.URL,
+		}
+		var m *dutycal.MailMessage
+		var events []*AnnouncedEvent
+		var delays []time.Duration
+		var i int
+		var err error
+
+		notification = &dutycal.UpcomingEventNotificationConfig{
+			Name:                proto.String(test.name),
+			MaxRetries:          proto.Int32(test.maxRetries),
+			RetryBackoffSeconds: proto.Int32(test.backoff),
+		}
+		retrySleep = func(d time.Duration) {
+			delays = append(delays, d)
+		}
+		m, events = testAnnouncement()
+
+		err = retry(notification, "sending", func() error {
+			return n.Notify(m, events)
+		})
+		s.Close()
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", test.name, err,
+				test.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "503") {
+			t.Errorf("%s: got %v, want the server error", test.name, err)
+		}
+		if len(s.requests) != test.wantRequests {
+			t.Errorf("%s: got %d requests, want %d", test.name,
+				len(s.requests), test.wantRequests)
+		}
+		if len(delays) != len(test.wantDelays) {
+			t.Errorf("%s: got delays %v, want %v", test.name, delays,
+				test.wantDelays)
+			continue
+		}
+		for i = range delays {
+			if delays[i] != test.wantDelays[i] {
+				t.Errorf("%s: got delays %v, want %v", test.name, delays,
+					test.wantDelays)
+				break
+			}
+		}
+	}
+}
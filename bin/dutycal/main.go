@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/cassandra"
 	"flag"
 	"html/template"
 	"io/ioutil"
@@ -11,16 +10,23 @@ import (
 
 	"ancient-solutions.com/ancientauth"
 	"github.com/golang/protobuf/proto"
+	_ "github.com/lib/pq"
 	"github.com/starshipfactory/dutycal"
 )
 
+// Minimum length of the secret key tokens are derived from.
+const minSecretKeyLength = 32
+
 func main() {
 	var auth *ancientauth.Authenticator
 	var viewTemplates *template.Template
 	var viewhandler *dutycal.ViewCalHandler
 	var vieweventhandler *dutycal.ViewEventHandler
 	var neweventhandler *dutycal.NewEventHandler
-	var db *cassandra.RetryCassandraClient
+	var apihandler *dutycal.APIHandler
+	var icalhandler *dutycal.ICalHandler
+	var changeshandler *dutycal.RecentChangesHandler
+	var store dutycal.EventStore
 	var loc *time.Location
 	var config dutycal.DutyCalConfig
 	var configPath, listenAddr string
@@ -48,6 +54,14 @@ func main() {
 		log.Fatal("Error reading config file: ", err)
 	}
 
+	// Tokens for forms and calendar feeds are derived from the secret key,
+	// so every installation needs its own, and it must not be guessable.
+	if len(config.GetSecretKey()) < minSecretKeyLength {
+		log.Fatal("secret_key must be at least ", minSecretKeyLength,
+			" characters long. Set it to a long random string, e.g. ",
+			"the output of \"openssl rand -hex 32\".")
+	}
+
 	viewTemplates, err = template.ParseGlob(
 		config.GetTemplatePath() + "/*")
 	if err != nil {
@@ -64,16 +78,9 @@ func main() {
 		log.Fatal("Error creating AncientAuth client: ", err)
 	}
 
-	db, err = cassandra.NewRetryCassandraClient(config.GetDbServer())
+	store, err = dutycal.OpenEventStore(&config)
 	if err != nil {
-		log.Fatal("Error connecting to Cassandra at ",
-			config.GetDbServer(), ": ", err)
-	}
-
-	err = db.SetKeyspace(config.GetKeyspace())
-	if err != nil {
-		log.Fatal("Error switching keyspace to ", config.GetKeyspace(),
-			": ", err)
+		log.Fatal("Error opening event store: ", err)
 	}
 
 	loc, err = time.LoadLocation(config.GetDefaultTimeZone())
@@ -83,16 +90,23 @@ func main() {
 	}
 
 	viewhandler = dutycal.NewViewCalHandler(
-		db, auth, loc, viewTemplates, &config)
+		store, auth, loc, viewTemplates, &config)
 	vieweventhandler = dutycal.NewViewEventHandler(
-		db, auth, loc, viewTemplates, &config)
+		store, auth, loc, viewTemplates, &config)
 	neweventhandler = dutycal.NewNewEventHandler(
-		db, auth, loc, viewTemplates, &config)
+		store, auth, loc, viewTemplates, &config)
+	apihandler = dutycal.NewAPIHandler(store, auth, loc, &config)
+	icalhandler = dutycal.NewICalHandler(store, loc, &config)
+	changeshandler = dutycal.NewRecentChangesHandler(
+		store, auth, loc, viewTemplates, &config)
 
 	http.Handle("/", viewhandler)
 	http.Handle("/favicon.ico", http.NotFoundHandler())
 	http.Handle("/event/", vieweventhandler)
 	http.Handle("/newevent", neweventhandler)
+	http.Handle("/api/v1/", apihandler)
+	http.Handle("/ical/", icalhandler)
+	http.Handle("/changes", changeshandler)
 	http.Handle("/bootstrap/",
 		http.StripPrefix("/bootstrap/",
 			http.FileServer(http.Dir(config.GetBootstrapPath()))))
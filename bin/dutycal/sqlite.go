@@ -0,0 +1,8 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+// The SQLite driver needs cgo, so without it, only PostgreSQL can be used
+// as SQL database.
+import _ "github.com/mattn/go-sqlite3"
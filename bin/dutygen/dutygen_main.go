@@ -1,19 +1,20 @@
 package main
 
 import (
-	"database/cassandra"
 	"flag"
 	"io/ioutil"
 	"log"
+	"os"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	_ "github.com/lib/pq"
 	"github.com/starshipfactory/dutycal"
 )
 
 func main() {
-	var db *cassandra.RetryCassandraClient
-	var ire *cassandra.InvalidRequestException
+	var store dutycal.EventStore
+	var gen *Generator
 	var rev *dutycal.RecurringEvent
 	var start time.Time
 	var loc *time.Location
@@ -21,18 +22,34 @@ func main() {
 	var startDate string
 	var configPath string
 	var configData []byte
+	var outputFormat string
+	var reconcile bool
+	var dryRun bool
 	var err error
 
 	flag.StringVar(&configPath, "config", "",
 		"Path to the configuration file")
 	flag.StringVar(&startDate, "start", "",
 		"If specified, start generating from this date rather than today")
+	flag.BoolVar(&reconcile, "reconcile", false,
+		"Update, remove and report previously generated events which no "+
+			"longer match the configured recurring events")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Only print what would be done, without changing any events. "+
+			"The event store is still opened as usual, which creates or "+
+			"migrates it if necessary")
+	flag.StringVar(&outputFormat, "output", "table",
+		"Format in which to print the actions of a dry run: table or json")
 	flag.Parse()
 
 	if len(configPath) == 0 {
 		flag.Usage()
 		log.Fatal("No config file has been specified")
 	}
+	if outputFormat != "table" && outputFormat != "json" {
+		flag.Usage()
+		log.Fatal("Unknown output format ", outputFormat)
+	}
 
 	configData, err = ioutil.ReadFile(configPath)
 	if err != nil {
@@ -44,20 +61,11 @@ func main() {
 		log.Fatal("Error reading config file: ", err)
 	}
 
-	db, err = cassandra.NewRetryCassandraClient(config.GetDbServer())
-	if err != nil {
-		log.Fatal("Error connecting to Cassandra at ",
-			config.GetDbServer(), ": ", err)
-	}
-
-	err = db.SetKeyspace(config.GetKeyspace())
-	if ire != nil {
-		log.Fatal("Error switching keyspace to ", config.GetKeyspace(),
-			": ", ire.Why)
-	}
+	// Even in a dry run, opening the store may write to it: the SQL schema
+	// is migrated and the journal of a local database is created.
+	store, err = dutycal.OpenEventStore(&config)
 	if err != nil {
-		log.Fatal("Error switching keyspace to ", config.GetKeyspace(),
-			": ", err)
+		log.Fatal("Error opening event store: ", err)
 	}
 
 	loc, err = time.LoadLocation(config.GetDefaultTimeZone())
@@ -75,9 +83,36 @@ func main() {
 		start = time.Now().In(loc)
 	}
 
-	// For each recurring event, make sure we have enough scheduled for the
-	// near future.
-	for _, rev = range config.RecurringEvents {
-		ScheduleRecurringEvent(start, db, &config, loc, rev)
+	gen = &Generator{
+		Store:    store,
+		Config:   &config,
+		Location: loc,
+		DryRun:   dryRun,
+	}
+
+	if reconcile {
+		err = gen.Reconcile(start)
+		if err != nil {
+			log.Fatal("Error reconciling recurring events: ", err)
+		}
+	} else {
+		// For each recurring event, make sure we have enough scheduled for
+		// the near future.
+		for _, rev = range config.RecurringEvents {
+			gen.ScheduleRecurringEvent(start, rev)
+		}
+	}
+
+	if !dryRun {
+		return
+	}
+
+	if outputFormat == "json" {
+		err = gen.WriteActionJSON(os.Stdout)
+	} else {
+		err = gen.WriteActionTable(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal("Error writing actions: ", err)
 	}
 }
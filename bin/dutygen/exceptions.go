@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/starshipfactory/dutycal"
+)
+
+// RecurrenceExceptions describes on which days a recurring event doesn't
+// take place even though its recurrence says so.
+type RecurrenceExceptions struct {
+	validFrom  time.Time
+	validUntil time.Time
+	loc        *time.Location
+
+	// Excepted days in the format YYYY-MM-DD.
+	days map[string]bool
+}
+
+// LoadRecurrenceExceptions determines the exceptions of the recurring
+// event "rev" from its validity window, its exception dates and the
+// holiday calendars for the days from "from" up to "to".
+func LoadRecurrenceExceptions(rev *dutycal.RecurringEvent,
+	loc *time.Location, from, to time.Time) (*RecurrenceExceptions, error) {
+	var rv *RecurrenceExceptions = &RecurrenceExceptions{
+		loc:  loc,
+		days: make(map[string]bool),
+	}
+	var day time.Time
+	var date string
+	var path string
+	var err error
+
+	if len(rev.GetValidFrom()) > 0 {
+		rv.validFrom, err = time.ParseInLocation("2006-01-02",
+			rev.GetValidFrom(), loc)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing start of validity %s: %s",
+				rev.GetValidFrom(), err)
+		}
+	}
+
+	if len(rev.GetValidUntil()) > 0 {
+		rv.validUntil, err = time.ParseInLocation("2006-01-02",
+			rev.GetValidUntil(), loc)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing end of validity %s: %s",
+				rev.GetValidUntil(), err)
+		}
+	}
+
+	for _, date = range rev.GetExceptionDate() {
+		day, err = time.ParseInLocation("2006-01-02", date, loc)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing exception date %s: %s",
+				date, err)
+		}
+		rv.days[day.Format("2006-01-02")] = true
+	}
+
+	for _, path = range rev.GetHolidayCalendarPath() {
+		err = ReadHolidays(path, loc, from, to, rv.days)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading holidays from %s: %s",
+				path, err)
+		}
+	}
+
+	return rv, nil
+}
+
+// Excludes determines whether an occurrence of the recurring event at
+// "start" must not take place.
+func (x *RecurrenceExceptions) Excludes(start time.Time) bool {
+	var day time.Time = midnight(start.In(x.loc))
+
+	if !x.validFrom.IsZero() && day.Before(x.validFrom) {
+		return true
+	}
+	if !x.validUntil.IsZero() && day.After(x.validUntil) {
+		return true
+	}
+
+	return x.days[day.Format("2006-01-02")]
+}
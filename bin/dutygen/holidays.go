@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Property of an iCalendar component, e.g. "DTSTART;VALUE=DATE:20241224".
+type icalProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// Event read from a holiday calendar.
+type holidayEvent struct {
+	UID       string
+	Start     time.Time
+	End       time.Time
+	IsDate    bool
+	Rule      string
+	Cancelled bool
+
+	// Days on which a recurring event doesn't take place, in the format
+	// YYYY-MM-DD, and additional starts of it.
+	ExDates map[string]bool
+	RDates  []time.Time
+
+	// Start of the occurrence of the recurring event with the same UID
+	// which this event replaces, if any.
+	RecurrenceID time.Time
+}
+
+// Split the iCalendar data "data" into unfolded content lines.
+func unfoldICalendar(data string) []string {
+	var rv []string
+	var line string
+
+	data = strings.Replace(data, "\r\n", "\n", -1)
+	for _, line = range strings.Split(data, "\n") {
+		if len(rv) > 0 && len(line) > 0 &&
+			(line[0] == ' ' || line[0] == '\t') {
+			rv[len(rv)-1] += line[1:]
+		} else if len(line) > 0 {
+			rv = append(rv, line)
+		}
+	}
+
+	return rv
+}
+
+// Parse the content line "line" of an iCalendar file. Parameter values may
+// be quoted, e.g. ALTREP="http://example.org/", so colons and semicolons
+// only separate the parts of the line outside of quotes.
+func parseICalProperty(line string) (*icalProperty, error) {
+	var rv *icalProperty = &icalProperty{Params: make(map[string]string)}
+	var colon int = -1
+	var quoted bool
+	var params []string
+	var param string
+	var start int
+	var i int
+
+	for i = 0; i < len(line) && colon < 0; i++ {
+		if line[i] == '"' {
+			quoted = !quoted
+		} else if !quoted && line[i] == ';' {
+			params = append(params, line[start:i])
+			start = i + 1
+		} else if !quoted && line[i] == ':' {
+			params = append(params, line[start:i])
+			colon = i
+		}
+	}
+
+	if colon < 0 {
+		return nil, fmt.Errorf("Malformed line %q", line)
+	}
+
+	rv.Name = strings.ToUpper(params[0])
+	rv.Value = line[colon+1:]
+	for _, param = range params[1:] {
+		var kv []string = strings.SplitN(param, "=", 2)
+
+		if len(kv) == 2 {
+			rv.Params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], "\"")
+		}
+	}
+
+	return rv, nil
+}
+
+// Parse the date or time of the property "p". Times without a time zone
+// are taken to be in "loc".
+func parseICalTime(p *icalProperty, loc *time.Location) (
+	time.Time, bool, error) {
+	var rv time.Time
+	var tz *time.Location = loc
+	var err error
+
+	if p.Params["VALUE"] == "DATE" || len(p.Value) == 8 {
+		rv, err = time.ParseInLocation("20060102", p.Value, loc)
+		return rv, true, err
+	}
+
+	if strings.HasSuffix(p.Value, "Z") {
+		rv, err = time.Parse("20060102T150405Z", p.Value)
+		return rv.In(loc), false, err
+	}
+
+	if len(p.Params["TZID"]) > 0 {
+		tz, err = time.LoadLocation(p.Params["TZID"])
+		if err != nil {
+			return rv, false, err
+		}
+	}
+
+	rv, err = time.ParseInLocation("20060102T150405", p.Value, tz)
+	return rv.In(loc), false, err
+}
+
+// Parse the comma separated dates or times of the property "p", such as
+// EXDATE or RDATE. Periods are not supported.
+func parseICalTimes(p *icalProperty, loc *time.Location) (
+	[]time.Time, error) {
+	var rv []time.Time
+	var value string
+	var err error
+
+	if p.Params["VALUE"] == "PERIOD" {
+		return nil, errors.New("Periods are not supported")
+	}
+
+	for _, value = range strings.Split(p.Value, ",") {
+		var single icalProperty = *p
+		var t time.Time
+
+		single.Value = value
+		t, _, err = parseICalTime(&single, loc)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, t)
+	}
+
+	return rv, nil
+}
+
+// Parse a duration of full days or weeks, e.g. "P2D" or "P1W".
+func parseICalDays(value string) (int, error) {
+	var n int
+	var err error
+
+	if len(value) < 3 || value[0] != 'P' {
+		return 0, fmt.Errorf("Unsupported duration %s", value)
+	}
+
+	n, err = strconv.Atoi(value[1 : len(value)-1])
+	if err != nil {
+		return 0, fmt.Errorf("Unsupported duration %s", value)
+	}
+
+	switch value[len(value)-1] {
+	case 'D':
+		return n, nil
+	case 'W':
+		return 7 * n, nil
+	}
+
+	return 0, fmt.Errorf("Unsupported duration %s", value)
+}
+
+// Read the events of the iCalendar file at "path". Times are converted
+// to "loc". Events replacing an occurrence of a recurring event are
+// recorded as exceptions of the recurring event.
+func readHolidayEvents(path string, loc *time.Location) (
+	[]*holidayEvent, error) {
+	var rv []*holidayEvent
+	var masters map[string]*holidayEvent = make(map[string]*holidayEvent)
+	var current *holidayEvent
+	var ev *holidayEvent
+	var days int = -1
+	var nested int
+	var data []byte
+	var line string
+	var err error
+
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line = range unfoldICalendar(string(data)) {
+		var p *icalProperty
+
+		p, err = parseICalProperty(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.Name == "BEGIN" && strings.ToUpper(p.Value) == "VEVENT" {
+			current = &holidayEvent{ExDates: make(map[string]bool)}
+			days = -1
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		// Skip nested components such as alarms.
+		if p.Name == "BEGIN" {
+			nested++
+		} else if p.Name == "END" && nested > 0 {
+			nested--
+			continue
+		}
+		if nested > 0 {
+			continue
+		}
+
+		switch p.Name {
+		case "UID":
+			current.UID = p.Value
+		case "STATUS":
+			current.Cancelled = strings.ToUpper(p.Value) == "CANCELLED"
+		case "RECURRENCE-ID":
+			if len(p.Params["RANGE"]) > 0 {
+				err = fmt.Errorf("RANGE=%s is not supported",
+					p.Params["RANGE"])
+			} else {
+				current.RecurrenceID, _, err = parseICalTime(p, loc)
+			}
+		case "EXDATE":
+			var times []time.Time
+			var t time.Time
+
+			times, err = parseICalTimes(p, loc)
+			for _, t = range times {
+				current.ExDates[t.Format("2006-01-02")] = true
+			}
+		case "RDATE":
+			var times []time.Time
+
+			times, err = parseICalTimes(p, loc)
+			current.RDates = append(current.RDates, times...)
+		case "DTSTART":
+			current.Start, current.IsDate, err = parseICalTime(p, loc)
+		case "DTEND":
+			current.End, _, err = parseICalTime(p, loc)
+		case "DURATION":
+			days, err = parseICalDays(p.Value)
+		case "RRULE":
+			current.Rule = p.Value
+		case "END":
+			if current.Start.IsZero() {
+				return nil, errors.New("Event without DTSTART")
+			}
+			if current.End.IsZero() && days >= 0 {
+				current.End = current.Start.AddDate(0, 0, days)
+			} else if current.End.IsZero() && current.IsDate {
+				current.End = nextDay(current.Start)
+			} else if current.End.IsZero() {
+				current.End = current.Start
+			}
+			rv = append(rv, current)
+			current = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %s", p.Name, err)
+		}
+	}
+
+	for _, ev = range rv {
+		if ev.RecurrenceID.IsZero() && len(ev.UID) > 0 {
+			masters[ev.UID] = ev
+		}
+	}
+	for _, ev = range rv {
+		if !ev.RecurrenceID.IsZero() && masters[ev.UID] != nil {
+			masters[ev.UID].ExDates[ev.RecurrenceID.Format(
+				"2006-01-02")] = true
+		}
+	}
+
+	return rv, nil
+}
+
+// Add all days from "start" up to "end" to "days". The day of "start" is
+// always added, even if "end" isn't after it.
+func coverDays(days map[string]bool, start, end time.Time) {
+	var day time.Time
+
+	days[start.Format("2006-01-02")] = true
+	for day = nextDay(midnight(start)); day.Before(end); day = nextDay(day) {
+		days[day.Format("2006-01-02")] = true
+	}
+}
+
+// ReadHolidays adds all the days from "from" up to "to" which are covered
+// by an event in the iCalendar file at "path" to "days". Recurring events
+// are expanded using the recurrence rules dutygen supports, taking EXDATE,
+// RDATE and replaced occurrences into account. Cancelled events are
+// ignored.
+func ReadHolidays(path string, loc *time.Location, from, to time.Time,
+	days map[string]bool) error {
+	var events []*holidayEvent
+	var ev *holidayEvent
+	var err error
+
+	events, err = readHolidayEvents(path, loc)
+	if err != nil {
+		return err
+	}
+
+	for _, ev = range events {
+		var length time.Duration = ev.End.Sub(ev.Start)
+		var rule *RRule
+		var occurrences []time.Time
+		var starts []time.Time = []time.Time{ev.Start}
+		var day, start time.Time
+
+		if ev.Cancelled {
+			continue
+		}
+
+		if len(ev.Rule) > 0 {
+			rule, err = ParseRRule(ev.Rule, loc)
+			if err != nil {
+				return fmt.Errorf("Error parsing rule %q: %s", ev.Rule,
+					err)
+			}
+
+			// Include occurrences which started earlier but last into
+			// the range.
+			occurrences, err = rule.Days(ev.Start,
+				from.AddDate(0, 0, -daysBetween(ev.Start, ev.End)), to)
+			if err != nil {
+				return err
+			}
+
+			starts = nil
+			for _, day = range occurrences {
+				starts = append(starts, time.Date(day.Year(), day.Month(),
+					day.Day(), ev.Start.Hour(), ev.Start.Minute(), 0, 0,
+					loc))
+			}
+		}
+
+		for _, start = range append(starts, ev.RDates...) {
+			var end time.Time = start.Add(length)
+
+			if ev.IsDate {
+				end = start.AddDate(0, 0, daysBetween(ev.Start, ev.End))
+			}
+			if ev.ExDates[start.Format("2006-01-02")] {
+				continue
+			}
+			if start.Before(to) &&
+				(end.After(from) || !start.Before(from)) {
+				coverDays(days, start, end)
+			}
+		}
+	}
+
+	return nil
+}
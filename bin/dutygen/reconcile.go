@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/dutycal"
+)
+
+// Occurrence of a recurring event according to the current configuration.
+type expectedOccurrence struct {
+	rev       *dutycal.RecurringEvent
+	start     time.Time
+	duration  time.Duration
+	reference *url.URL
+	genid     []byte
+
+	exceptions *RecurrenceExceptions
+	excluded   bool
+
+	// The generated event which corresponds to the occurrence, if any.
+	event *dutycal.Event
+}
+
+// Event generated by an earlier run of dutygen.
+type generatedEvent struct {
+	ev      *dutycal.Event
+	key     string
+	matched bool
+}
+
+// Determine the key of the recurring event which "ev" was generated for.
+// Returns false if "ev" wasn't generated by dutygen.
+func generatedKey(ev *dutycal.Event) (string, bool) {
+	var genid GeneratorID
+
+	if len(ev.GeneratorID) == 0 {
+		return "", false
+	}
+	if proto.Unmarshal(ev.GeneratorID, &genid) != nil {
+		return "", false
+	}
+
+	return genid.GetRecurringKey(), true
+}
+
+// Get the string representation of the reference "u", or an empty string
+// if there is none.
+func referenceString(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.String()
+}
+
+// Determine whether the event of the occurrence has to be updated to
+// match the configuration.
+func (o *expectedOccurrence) isOutdated() bool {
+	return !bytes.Equal(o.event.GeneratorID, o.genid) ||
+		!o.event.Start.Equal(o.start) || o.event.Duration != o.duration ||
+		o.event.Title != o.rev.GetTitle() ||
+		o.event.Description != o.rev.GetDescription() ||
+		referenceString(o.event.Reference) != referenceString(o.reference) ||
+		o.event.Required != o.rev.GetRequired() ||
+		o.event.MinStaff != o.rev.GetMinStaff() ||
+		o.event.MaxStaff != o.rev.GetMaxStaff()
+}
+
+// Assign the generated event "g" to the occurrence.
+func (o *expectedOccurrence) match(g *generatedEvent) {
+	o.event = g.ev
+	g.matched = true
+}
+
+// Update the event of the occurrence "o" in place to match the
+// configuration. The owners are left as they are stored, so people who
+// signed up since the event was read are kept. If its time changes, the
+// owners are dropped since they signed up for a different time; they are
+// logged and told by mail.
+func (g *Generator) updateGeneratedEvent(o *expectedOccurrence) {
+	var ev *dutycal.Event = o.event
+	var before dutycal.Event = *ev
+	var moved bool = !ev.Start.Equal(o.start) || ev.Duration != o.duration
+	var note string = "changed"
+	var dropped []string
+	var err error
+
+	if moved {
+		note = "moved from " + ev.Start.In(g.Location).Format(timeFormat)
+		if len(ev.Owners) > 0 {
+			note += ", dropping owners " + strings.Join(ev.Owners, ", ")
+		}
+	}
+
+	// In a dry run, only a copy is updated for the report.
+	if g.DryRun {
+		var preview dutycal.Event = before
+		ev = &preview
+	}
+
+	ev.Title = o.rev.GetTitle()
+	ev.Description = o.rev.GetDescription()
+	ev.Reference = o.reference
+	ev.Required = o.rev.GetRequired()
+	ev.MinStaff = o.rev.GetMinStaff()
+	ev.MaxStaff = o.rev.GetMaxStaff()
+	ev.GeneratorID = o.genid
+	ev.Start = o.start
+	ev.Duration = o.duration
+
+	g.record(ActionUpdate, ev, note)
+	if g.DryRun {
+		return
+	}
+
+	// Same as when editing the event on the web: the owners are dropped
+	// if it was moved.
+	dropped, err = ev.SyncEdit(&before)
+	if err != nil {
+		log.Print("Error updating ", before.Title, " at ",
+			before.Start.Format(time.RFC1123Z), ": ", err)
+		return
+	}
+
+	if len(dropped) > 0 {
+		log.Print("Moved ", before.Title, " from ",
+			before.Start.Format(time.RFC1123Z), " to ",
+			ev.Start.Format(time.RFC1123Z), " without its owners: ",
+			strings.Join(dropped, ", "))
+
+		err = dutycal.NotifyDroppedOwners(g.Config, g.Location, ev,
+			dropped)
+		if err != nil {
+			log.Print("Error telling the dropped owners of ", ev.Title,
+				" at ", ev.Start.Format(time.RFC1123Z), ": ", err)
+		}
+	}
+
+	dutycal.RecordHistory(g.Store, dutycal.HistoryEdit, "dutygen", &before,
+		ev)
+}
+
+// Reconcile brings the events generated earlier in line
+// with the recurring events currently configured, from "start" on.
+// Generated events are matched to the configured occurrences by their
+// generator ID, then by their time, and then by the key of their recurring
+// event and their day. Matched events are updated in place, keeping their
+// owners if their time is unchanged. Generated events which no longer
+// match anything are removed if nobody signed up for them, and reported
+// otherwise. Events which already started are left alone.
+func (g *Generator) Reconcile(start time.Time) error {
+	var keys map[string]bool = make(map[string]bool)
+	var now time.Time = time.Now()
+	var expected []*expectedOccurrence
+	var inWindow []*expectedOccurrence
+	var generated []*generatedEvent
+	var occurrences *Occurrences
+	var o *expectedOccurrence
+	var ge *generatedEvent
+	var rev *dutycal.RecurringEvent
+	var evs []*dutycal.Event
+	var ev *dutycal.Event
+	var from, to time.Time
+	var nextEv time.Time
+	var orphans int
+	var err error
+
+	// Expand all recurring events first. If any of them fails, its
+	// events would look like orphans, so better don't touch anything.
+	for _, rev = range g.Config.RecurringEvents {
+		var duration time.Duration
+		var u *url.URL
+
+		if len(rev.GetKey()) > 0 && keys[rev.GetKey()] {
+			return fmt.Errorf("Duplicate recurring event key %s",
+				rev.GetKey())
+		}
+		keys[rev.GetKey()] = true
+
+		occurrences, err = RecurringEventOccurrences(start, g.Config,
+			g.Location, rev)
+		if err != nil {
+			return fmt.Errorf("Error scheduling %s: %s", rev.GetTitle(),
+				err)
+		}
+
+		// Only the window covered by all recurring events can be
+		// reconciled.
+		if from.IsZero() || occurrences.From.After(from) {
+			from = occurrences.From
+		}
+		if to.IsZero() || occurrences.To.Before(to) {
+			to = occurrences.To
+		}
+
+		u, duration = recurringEventDetails(rev)
+		for _, nextEv = range occurrences.Starts {
+			expected = append(expected, &expectedOccurrence{
+				rev:       rev,
+				start:     nextEv,
+				duration:  duration,
+				reference: u,
+				genid: genGeneratorID(nextEv, duration, rev.GetTitle(),
+					rev.GetDescription(), rev.GetKey()),
+				exceptions: occurrences.Exceptions,
+				excluded:   occurrences.Exceptions.Excludes(nextEv),
+			})
+		}
+	}
+
+	if len(expected) == 0 {
+		return nil
+	}
+	if from.Before(now) {
+		from = now
+	}
+
+	// Occurrences outside of the window are just scheduled as usual.
+	for _, o = range expected {
+		if !o.start.Before(from) && o.start.Before(to) {
+			inWindow = append(inWindow, o)
+			continue
+		}
+		err = g.scheduleOccurrence(o.rev, o.start, o.duration, o.reference,
+			o.exceptions)
+		if err != nil {
+			return fmt.Errorf("Error fetching events from %s to %s: %s",
+				o.start, o.start.Add(o.duration), err)
+		}
+	}
+	expected = inWindow
+	if !from.Before(to) {
+		return nil
+	}
+
+	evs, err = dutycal.FetchEventRange(g.Store, from, to, -1, g.Location,
+		nil, true)
+	if err != nil {
+		return fmt.Errorf("Error fetching events from %s to %s: %s", from,
+			to, err)
+	}
+
+	for _, ev = range evs {
+		var key string
+		var ok bool
+
+		if ev.Start.Before(from) || !ev.Start.Before(to) {
+			continue
+		}
+		key, ok = generatedKey(ev)
+		if ok {
+			generated = append(generated,
+				&generatedEvent{ev: ev, key: key})
+		}
+	}
+
+	// First, find the events which were generated exactly like this.
+	for _, o = range expected {
+		for _, ge = range generated {
+			if !ge.matched && bytes.Equal(ge.ev.GeneratorID, o.genid) {
+				o.match(ge)
+				break
+			}
+		}
+	}
+
+	// Then the ones at the same time, from a recurring event with the same
+	// or no key, whose contents have changed. Excluded occurrences take
+	// part as well, so their events aren't mistaken for orphans.
+	for _, o = range expected {
+		if o.event != nil {
+			continue
+		}
+		for _, ge = range generated {
+			if !ge.matched && (ge.key == o.rev.GetKey() || len(ge.key) == 0) &&
+				ge.ev.Start.Equal(o.start) && ge.ev.Duration == o.duration {
+				o.match(ge)
+				break
+			}
+		}
+	}
+
+	// Finally, the ones of the same recurring event on the same day, whose
+	// time has changed.
+	for _, o = range expected {
+		if o.event != nil || len(o.rev.GetKey()) == 0 {
+			continue
+		}
+		for _, ge = range generated {
+			if !ge.matched && ge.key == o.rev.GetKey() &&
+				midnight(ge.ev.Start.In(g.Location)).Equal(
+					midnight(o.start.In(g.Location))) {
+				o.match(ge)
+				break
+			}
+		}
+	}
+
+	for _, o = range expected {
+		if o.excluded && o.event != nil && o.rev.GetRemoveExcepted() {
+			g.removeGeneratedEvent(o.event, "excepted")
+		} else if o.excluded && o.event != nil {
+			g.record(ActionSkip, o.event, "excepted")
+		} else if o.excluded {
+			g.record(ActionSkip,
+				plannedEvent(o.rev, o.start, o.duration, o.genid), "excepted")
+		} else if o.event == nil {
+			g.createGeneratedEvent(o.rev, o.start, o.duration, o.reference,
+				o.genid)
+		} else if o.isOutdated() {
+			g.updateGeneratedEvent(o)
+		} else {
+			g.record(ActionSkip, o.event, "exists")
+		}
+	}
+
+	for _, ge = range generated {
+		if ge.matched {
+			continue
+		}
+		if len(ge.ev.Owners) > 0 {
+			g.record(ActionOrphan, ge.ev, "has owners "+
+				strings.Join(ge.ev.Owners, ", "))
+			log.Print("Orphaned event ", ge.ev.Title, " at ",
+				ge.ev.Start.In(g.Location).Format(time.RFC1123Z), " (",
+				ge.ev.ID, ") no longer matches the configuration, but has ",
+				"owners: ", strings.Join(ge.ev.Owners, ", "))
+			orphans++
+			continue
+		}
+		g.removeGeneratedEvent(ge.ev, "orphaned")
+	}
+
+	if orphans > 0 {
+		log.Print(orphans, " orphaned events with owners need to be ",
+			"resolved by hand")
+	}
+
+	return nil
+}
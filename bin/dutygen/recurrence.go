@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/starshipfactory/dutycal"
+)
+
+// Get the midnight of the day of "t" in the location of "t".
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// Get the midnight of the day after "day".
+func nextDay(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0,
+		day.Location())
+}
+
+// Count the calendar days from "from" to "to", regardless of any daylight
+// saving time changes in between.
+func daysBetween(from, to time.Time) int {
+	var a time.Time = time.Date(from.Year(), from.Month(), from.Day(),
+		0, 0, 0, 0, time.UTC)
+	var b time.Time = time.Date(to.Year(), to.Month(), to.Day(),
+		0, 0, 0, 0, time.UTC)
+
+	return int(b.Sub(a) / (24 * time.Hour))
+}
+
+// Get the Monday of the week of "day".
+func weekStart(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(),
+		day.Day()-(int(day.Weekday())+6)%7, 0, 0, 0, 0, day.Location())
+}
+
+// Get the number of days in the month "month" of "year".
+func daysInMonth(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// Determine whether "day" is the day of month "n". Negative values count
+// from the end of the month, i.e. -1 is the last day.
+func isMonthDay(day time.Time, n int) bool {
+	if n < 0 {
+		n = daysInMonth(day.Year(), day.Month()) + 1 + n
+	}
+	return day.Day() == n
+}
+
+// Determine whether "day" is the "n"-th day of week "wd" in its month.
+// Negative values count from the end of the month, i.e. -1 is the last.
+// 0 matches every day of week "wd".
+func isNthWeekday(day time.Time, n int, wd time.Weekday) bool {
+	if day.Weekday() != wd {
+		return false
+	} else if n > 0 {
+		return (day.Day()-1)/7+1 == n
+	} else if n < 0 {
+		return (daysInMonth(day.Year(), day.Month())-day.Day())/7+1 == -n
+	}
+	return true
+}
+
+// Get the time "hour":"minute" on "day" in the location "loc". If the
+// clocks are moved forward over that time, the result is as far after the
+// switch as the time was after the last full hour before it, e.g. 03:30
+// for 02:30. If the time occurs twice because the clocks are moved back,
+// the first occurrence is used.
+func wallClock(day time.Time, hour, minute int, loc *time.Location) time.Time {
+	var rv time.Time = time.Date(day.Year(), day.Month(), day.Day(),
+		hour, minute, 0, 0, loc)
+	var earlier time.Time = rv.Add(-time.Hour)
+
+	if earlier.Day() == rv.Day() && earlier.Hour() == rv.Hour() &&
+		earlier.Minute() == rv.Minute() {
+		return earlier
+	}
+
+	return rv
+}
+
+// Collect the days from "from" up to, but not including, "to" for which
+// "occurs" returns true. Days are represented by their midnight in the
+// location of "from".
+func matchingDays(from, to time.Time,
+	occurs func(day time.Time) bool) []time.Time {
+	var rv []time.Time
+	var day time.Time
+
+	for day = midnight(from); day.Before(to); day = nextDay(day) {
+		if occurs(day) {
+			rv = append(rv, day)
+		}
+	}
+
+	return rv
+}
+
+// Parse the anchor date of the recurring event "rev" in the location
+// "loc". Returns the zero time if it isn't set.
+func anchorDate(rev *dutycal.RecurringEvent, loc *time.Location) (
+	time.Time, error) {
+	var anchor time.Time
+	var err error
+
+	if len(rev.GetAnchorDate()) == 0 {
+		return anchor, nil
+	}
+
+	anchor, err = time.ParseInLocation("2006-01-02", rev.GetAnchorDate(),
+		loc)
+	if err != nil {
+		return anchor, fmt.Errorf("Error parsing anchor date %s: %s",
+			rev.GetAnchorDate(), err)
+	}
+
+	return anchor, nil
+}
+
+// Check that the day of week "wd" from the configuration is valid.
+func checkWeekday(wd int32) error {
+	if wd < 0 || wd > 6 {
+		return fmt.Errorf("Invalid day of week %d, must be 0 (Sunday) "+
+			"to 6 (Saturday)", wd)
+	}
+	return nil
+}
+
+// RecurrenceDays determines the days from "from" up to, but not
+// including, "to" on which the recurring event "rev" takes place, as their
+// midnight in the location "loc".
+func RecurrenceDays(from, to time.Time, loc *time.Location,
+	rev *dutycal.RecurringEvent) ([]time.Time, error) {
+	var selector int = int(rev.GetRecurrenceSelector())
+	var wd time.Weekday = time.Weekday(rev.GetWeekday())
+	var anchor time.Time
+	var rule *RRule
+	var err error
+
+	from = from.In(loc)
+
+	anchor, err = anchorDate(rev, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	switch rev.GetRecurrenceType() {
+	case dutycal.RecurringEvent_DAILY_INTERVAL,
+		dutycal.RecurringEvent_WEEKLY_INTERVAL:
+		if anchor.IsZero() {
+			return nil, errors.New("Intervals require an anchor date")
+		}
+		if selector < 1 {
+			return nil, fmt.Errorf("Invalid interval %d", selector)
+		}
+	case dutycal.RecurringEvent_MONTHLY_DAY:
+		if selector == 0 || selector < -31 || selector > 31 {
+			return nil, fmt.Errorf("Invalid day of month %d", selector)
+		}
+	case dutycal.RecurringEvent_MONTHLY_NTH_WEEKDAY:
+		if selector == 0 || selector < -5 || selector > 5 {
+			return nil, fmt.Errorf("Invalid week of month %d", selector)
+		}
+	}
+
+	switch rev.GetRecurrenceType() {
+	case dutycal.RecurringEvent_WEEKDAY:
+		err = checkWeekday(rev.GetRecurrenceSelector())
+		if err != nil {
+			return nil, err
+		}
+		return matchingDays(from, to, func(day time.Time) bool {
+			return day.Weekday() == time.Weekday(selector)
+		}), nil
+	case dutycal.RecurringEvent_DAILY_INTERVAL:
+		return matchingDays(from, to, func(day time.Time) bool {
+			var days int = daysBetween(anchor, day)
+			return days >= 0 && days%selector == 0
+		}), nil
+	case dutycal.RecurringEvent_WEEKLY_INTERVAL:
+		err = checkWeekday(rev.GetWeekday())
+		if err != nil {
+			return nil, err
+		}
+		return matchingDays(from, to, func(day time.Time) bool {
+			var weeks int = daysBetween(weekStart(anchor),
+				weekStart(day)) / 7
+			return day.Weekday() == wd && !day.Before(anchor) &&
+				weeks%selector == 0
+		}), nil
+	case dutycal.RecurringEvent_MONTHLY_DAY:
+		return matchingDays(from, to, func(day time.Time) bool {
+			return isMonthDay(day, selector)
+		}), nil
+	case dutycal.RecurringEvent_MONTHLY_NTH_WEEKDAY:
+		err = checkWeekday(rev.GetWeekday())
+		if err != nil {
+			return nil, err
+		}
+		return matchingDays(from, to, func(day time.Time) bool {
+			return isNthWeekday(day, selector, wd)
+		}), nil
+	case dutycal.RecurringEvent_RRULE:
+		rule, err = ParseRRule(rev.GetRrule(), loc)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing rule %q: %s",
+				rev.GetRrule(), err)
+		}
+		return rule.Days(anchor, from, to)
+	}
+
+	return nil, fmt.Errorf("Don't know how to schedule a recurrence of "+
+		"type %s", rev.GetRecurrenceType())
+}
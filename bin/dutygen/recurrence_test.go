@@ -0,0 +1,242 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/dutycal"
+)
+
+// Load the time zone the tests are written for.
+func zurich(t *testing.T) *time.Location {
+	var loc *time.Location
+	var err error
+
+	loc, err = time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Fatal("Error loading time zone: ", err)
+	}
+
+	return loc
+}
+
+// Create a weekly recurring event on the day of week "wd" starting at
+// "h":"m".
+func weeklyEvent(wd time.Weekday, h, m int32) *dutycal.RecurringEvent {
+	return &dutycal.RecurringEvent{
+		RecurrenceType:     dutycal.RecurringEvent_WEEKDAY.Enum(),
+		RecurrenceSelector: proto.Int32(int32(wd)),
+		Title:              proto.String("Open Factory"),
+		StartHour:          proto.Int32(h),
+		StartMinute:        proto.Int32(m),
+		DurationHours:      proto.Int32(2),
+	}
+}
+
+// Create a recurring event every "days" days, counted from "anchor".
+func intervalEvent(days int32, anchor string) *dutycal.RecurringEvent {
+	return &dutycal.RecurringEvent{
+		RecurrenceType:     dutycal.RecurringEvent_DAILY_INTERVAL.Enum(),
+		RecurrenceSelector: proto.Int32(days),
+		AnchorDate:         proto.String(anchor),
+		Title:              proto.String("Cleanup"),
+		StartHour:          proto.Int32(19),
+		DurationHours:      proto.Int32(1),
+	}
+}
+
+// Expected occurrences of a recurring event scheduled from "start" for
+// "ahead" days.
+type occurrencesTest struct {
+	name  string
+	start time.Time
+	rev   *dutycal.RecurringEvent
+	ahead int32
+	want  []string
+}
+
+// Expected days of a recurring event from "from" up to "to".
+type recurrenceDaysTest struct {
+	name string
+	from time.Time
+	to   time.Time
+	rev  *dutycal.RecurringEvent
+	want []string
+}
+
+// Compare the formatted times "got" to "want".
+func checkTimes(t *testing.T, name string, got, want []string) {
+	var i int
+
+	if len(got) != len(want) {
+		t.Errorf("%s: got %v, want %v", name, got, want)
+		return
+	}
+	for i = range got {
+		if got[i] != want[i] {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func TestRecurringEventOccurrences(t *testing.T) {
+	var loc *time.Location = zurich(t)
+	var test occurrencesTest
+	var tests = []occurrencesTest{
+		{
+			name:  "spring forward keeps wall clock time",
+			start: time.Date(2027, 3, 20, 12, 0, 0, 0, loc),
+			rev:   weeklyEvent(time.Sunday, 18, 0),
+			ahead: 14,
+			want: []string{
+				"2027-03-21T18:00:00+01:00",
+				"2027-03-28T18:00:00+02:00",
+			},
+		},
+		{
+			name:  "start in the spring forward gap",
+			start: time.Date(2027, 3, 27, 12, 0, 0, 0, loc),
+			rev:   weeklyEvent(time.Sunday, 2, 30),
+			ahead: 9,
+			want: []string{
+				"2027-03-28T03:30:00+02:00",
+				"2027-04-04T02:30:00+02:00",
+			},
+		},
+		{
+			name:  "fall back keeps wall clock time",
+			start: time.Date(2027, 10, 23, 12, 0, 0, 0, loc),
+			rev:   weeklyEvent(time.Sunday, 18, 0),
+			ahead: 14,
+			want: []string{
+				"2027-10-24T18:00:00+02:00",
+				"2027-10-31T18:00:00+01:00",
+			},
+		},
+		{
+			name:  "start in the repeated fall back hour",
+			start: time.Date(2027, 10, 30, 12, 0, 0, 0, loc),
+			rev:   weeklyEvent(time.Sunday, 2, 30),
+			ahead: 9,
+			want: []string{
+				"2027-10-31T02:30:00+02:00",
+				"2027-11-07T02:30:00+01:00",
+			},
+		},
+		{
+			name:  "occurrence later today",
+			start: time.Date(2026, 10, 20, 9, 0, 0, 0, loc),
+			rev:   weeklyEvent(time.Tuesday, 18, 0),
+			ahead: 14,
+			want: []string{
+				"2026-10-20T18:00:00+02:00",
+				"2026-10-27T18:00:00+01:00",
+			},
+		},
+		{
+			name:  "occurrence earlier today",
+			start: time.Date(2026, 10, 20, 19, 0, 0, 0, loc),
+			rev:   weeklyEvent(time.Tuesday, 18, 0),
+			ahead: 14,
+			want: []string{
+				"2026-10-27T18:00:00+01:00",
+			},
+		},
+		{
+			name:  "start date at midnight",
+			start: time.Date(2026, 10, 20, 0, 0, 0, 0, loc),
+			rev:   weeklyEvent(time.Tuesday, 0, 0),
+			ahead: 8,
+			want: []string{
+				"2026-10-20T00:00:00+02:00",
+				"2026-10-27T00:00:00+01:00",
+			},
+		},
+	}
+
+	for _, test = range tests {
+		var conf *dutycal.DutyCalConfig = &dutycal.DutyCalConfig{
+			RecurringEventsScheduleAhead: proto.Int32(test.ahead),
+		}
+		var occurrences *Occurrences
+		var got []string
+		var start time.Time
+		var err error
+
+		occurrences, err = RecurringEventOccurrences(test.start, conf, loc,
+			test.rev)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		for _, start = range occurrences.Starts {
+			got = append(got, start.In(loc).Format(time.RFC3339))
+		}
+
+		checkTimes(t, test.name, got, test.want)
+	}
+}
+
+func TestRecurrenceDays(t *testing.T) {
+	var loc *time.Location = zurich(t)
+	var test recurrenceDaysTest
+	var tests = []recurrenceDaysTest{
+		{
+			name: "last Sunday of March and October",
+			from: time.Date(2027, 1, 1, 0, 0, 0, 0, loc),
+			to:   time.Date(2028, 1, 1, 0, 0, 0, 0, loc),
+			rev: &dutycal.RecurringEvent{
+				RecurrenceType: dutycal.RecurringEvent_RRULE.Enum(),
+				Rrule: proto.String(
+					"FREQ=YEARLY;BYMONTH=3,10;BYDAY=-1SU"),
+			},
+			want: []string{"2027-03-28", "2027-10-31"},
+		},
+		{
+			name: "daily across the spring forward day",
+			from: time.Date(2027, 3, 27, 0, 0, 0, 0, loc),
+			to:   time.Date(2027, 3, 30, 0, 0, 0, 0, loc),
+			rev:  intervalEvent(1, "2027-01-01"),
+			want: []string{"2027-03-27", "2027-03-28", "2027-03-29"},
+		},
+		{
+			name: "daily across the fall back day",
+			from: time.Date(2027, 10, 30, 0, 0, 0, 0, loc),
+			to:   time.Date(2027, 11, 2, 0, 0, 0, 0, loc),
+			rev:  intervalEvent(2, "2027-10-30"),
+			want: []string{"2027-10-30", "2027-11-01"},
+		},
+		{
+			name: "weekday today",
+			from: time.Date(2026, 10, 20, 0, 0, 0, 0, loc),
+			to:   time.Date(2026, 10, 28, 0, 0, 0, 0, loc),
+			rev:  weeklyEvent(time.Tuesday, 18, 0),
+			want: []string{"2026-10-20", "2026-10-27"},
+		},
+	}
+
+	for _, test = range tests {
+		var days []time.Time
+		var got []string
+		var day time.Time
+		var err error
+
+		days, err = RecurrenceDays(test.from, test.to, loc, test.rev)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		for _, day = range days {
+			if day.Hour() != 0 || day.Minute() != 0 {
+				t.Errorf("%s: day %s is not at midnight", test.name, day)
+			}
+			got = append(got, day.Format("2006-01-02"))
+		}
+
+		checkTimes(t, test.name, got, test.want)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/starshipfactory/dutycal"
+)
+
+// Actions the generator takes on the occurrences of recurring events.
+const (
+	ActionCreate = "create"
+	ActionSkip   = "skip"
+	ActionUpdate = "update"
+	ActionRemove = "remove"
+
+	// Generated events which no longer match the configuration but
+	// can't be removed because they have owners.
+	ActionOrphan = "orphan"
+)
+
+// Format of times in reports.
+const timeFormat = "Mon 2006-01-02 15:04 MST"
+
+// Action describes what the generator did, or would do in a dry run, for
+// a single event.
+type Action struct {
+	Action      string    `json:"action"`
+	Title       string    `json:"title"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	EventID     string    `json:"event_id,omitempty"`
+	GeneratorID string    `json:"generator_id"`
+	Note        string    `json:"note,omitempty"`
+}
+
+// Describe an occurrence of the recurring event "rev" at "start" which has
+// no event in the store, for reporting.
+func plannedEvent(rev *dutycal.RecurringEvent, start time.Time,
+	duration time.Duration, genid []byte) *dutycal.Event {
+	return &dutycal.Event{
+		Title:       rev.GetTitle(),
+		Start:       start,
+		Duration:    duration,
+		GeneratorID: genid,
+	}
+}
+
+// Record that "action" is taken for the event "ev". "note" explains the
+// details, if any.
+func (g *Generator) record(action string, ev *dutycal.Event, note string) {
+	g.Actions = append(g.Actions, &Action{
+		Action:      action,
+		Title:       ev.Title,
+		Start:       ev.Start.In(g.Location),
+		End:         ev.Start.Add(ev.Duration).In(g.Location),
+		EventID:     ev.ID,
+		GeneratorID: hex.EncodeToString(ev.GeneratorID),
+		Note:        note,
+	})
+}
+
+// WriteActionTable writes the actions of the generator to "w" as a table
+// which is easy to read.
+func (g *Generator) WriteActionTable(w io.Writer) error {
+	var tw *tabwriter.Writer = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	var a *Action
+
+	fmt.Fprintln(tw, "ACTION\tSTART\tEND\tTITLE\tNOTE\tGENERATOR ID")
+	for _, a = range g.Actions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", a.Action,
+			a.Start.Format(timeFormat), a.End.Format(timeFormat), a.Title,
+			a.Note, a.GeneratorID)
+	}
+
+	return tw.Flush()
+}
+
+// WriteActionJSON writes the actions of the generator to "w" as a JSON
+// array.
+func (g *Generator) WriteActionJSON(w io.Writer) error {
+	var enc *json.Encoder = json.NewEncoder(w)
+	var actions []*Action = g.Actions
+
+	if actions == nil {
+		actions = []*Action{}
+	}
+
+	enc.SetIndent("", "  ")
+	return enc.Encode(actions)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Abbreviations of the days of week in recurrence rules.
+var ruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// Day of week from the BYDAY part of a recurrence rule, e.g. "-1SA" for
+// the last Saturday. N is 0 if every such day of week matches.
+type ruleWeekday struct {
+	N   int
+	Day time.Weekday
+}
+
+// RRule is the subset of an RFC 5545 recurrence rule supported by dutygen.
+// Rules only determine the days on which events take place; the time of
+// day comes from the recurring event configuration.
+type RRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time
+	ByDay      []ruleWeekday
+	ByMonthDay []int
+	ByMonth    []time.Month
+}
+
+// Parse a comma separated list of integers from "value" which must all be
+// within [-max, max] and not be 0.
+func parseRuleInts(value string, max int) ([]int, error) {
+	var rv []int
+	var part string
+	var n int
+	var err error
+
+	for _, part = range strings.Split(value, ",") {
+		n, err = strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 || n < -max || n > max {
+			return nil, fmt.Errorf("Value %d out of range", n)
+		}
+		rv = append(rv, n)
+	}
+
+	return rv, nil
+}
+
+// Parse the end date of a rule from "value" in the location "loc".
+func parseRuleUntil(value string, loc *time.Location) (time.Time, error) {
+	var rv time.Time
+	var err error
+
+	if len(value) == 8 {
+		rv, err = time.ParseInLocation("20060102", value, loc)
+	} else if strings.HasSuffix(value, "Z") {
+		rv, err = time.Parse("20060102T150405Z", value)
+	} else {
+		rv, err = time.ParseInLocation("20060102T150405", value, loc)
+	}
+	if err != nil {
+		return rv, err
+	}
+
+	return midnight(rv.In(loc)), nil
+}
+
+// ParseRRule parses the recurrence rule "rule", e.g.
+// "FREQ=MONTHLY;BYDAY=1SA". UNTIL dates without a time zone are taken to
+// be in "loc".
+func ParseRRule(rule string, loc *time.Location) (*RRule, error) {
+	var rv *RRule = &RRule{Interval: 1}
+	var wd ruleWeekday
+	var part string
+	var err error
+
+	rule = strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:")
+
+	for _, part = range strings.Split(rule, ";") {
+		var kv []string = strings.SplitN(part, "=", 2)
+		var days string
+		var ints []int
+		var n int
+
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("Malformed rule part %q", part)
+		}
+
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			rv.Freq = strings.ToUpper(kv[1])
+			if rv.Freq != "DAILY" && rv.Freq != "WEEKLY" &&
+				rv.Freq != "MONTHLY" && rv.Freq != "YEARLY" {
+				return nil, fmt.Errorf("Unsupported frequency %s", rv.Freq)
+			}
+		case "INTERVAL":
+			rv.Interval, err = strconv.Atoi(kv[1])
+			if err == nil && rv.Interval < 1 {
+				err = errors.New("Interval must be positive")
+			}
+		case "COUNT":
+			rv.Count, err = strconv.Atoi(kv[1])
+			if err == nil && rv.Count < 1 {
+				err = errors.New("Count must be positive")
+			}
+		case "UNTIL":
+			rv.Until, err = parseRuleUntil(kv[1], loc)
+		case "BYDAY":
+			for _, days = range strings.Split(strings.ToUpper(kv[1]), ",") {
+				var ok bool
+
+				if len(days) < 2 {
+					return nil, fmt.Errorf("Malformed day of week %q", days)
+				}
+				wd = ruleWeekday{}
+				wd.Day, ok = ruleWeekdays[days[len(days)-2:]]
+				if !ok {
+					return nil, fmt.Errorf("Unknown day of week %q", days)
+				}
+				if len(days) > 2 {
+					ints, err = parseRuleInts(days[:len(days)-2], 53)
+					if err != nil {
+						return nil, fmt.Errorf("Malformed day of week %q: %s",
+							days, err)
+					}
+					wd.N = ints[0]
+				}
+				rv.ByDay = append(rv.ByDay, wd)
+			}
+		case "BYMONTHDAY":
+			rv.ByMonthDay, err = parseRuleInts(kv[1], 31)
+		case "BYMONTH":
+			ints, err = parseRuleInts(kv[1], 12)
+			for _, n = range ints {
+				if n < 0 {
+					err = fmt.Errorf("Invalid month %d", n)
+				}
+				rv.ByMonth = append(rv.ByMonth, time.Month(n))
+			}
+		case "WKST":
+			// Weeks always start on Monday here, so that's the only
+			// start which makes sense.
+			if strings.ToUpper(kv[1]) != "MO" {
+				err = errors.New("Only weeks starting on MO are supported")
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported rule part %s", kv[0])
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %s", kv[0], err)
+		}
+	}
+
+	if len(rv.Freq) == 0 {
+		return nil, errors.New("No FREQ specified")
+	}
+	if rv.Count > 0 && !rv.Until.IsZero() {
+		return nil, errors.New("COUNT and UNTIL are mutually exclusive")
+	}
+	if rv.Freq != "MONTHLY" && rv.Freq != "YEARLY" {
+		for _, wd = range rv.ByDay {
+			if wd.N != 0 {
+				return nil, errors.New(
+					"Numbered days of week require FREQ=MONTHLY or YEARLY")
+			}
+		}
+	}
+	if rv.Freq == "WEEKLY" && len(rv.ByMonthDay) > 0 {
+		return nil, errors.New("BYMONTHDAY cannot be used with FREQ=WEEKLY")
+	}
+
+	return rv, nil
+}
+
+// NeedsStart determines whether the days of the rule depend on its start
+// date, i.e. whether it must be anchored to produce the same days on every
+// run.
+func (r *RRule) NeedsStart() bool {
+	if r.Interval > 1 || r.Count > 0 {
+		return true
+	}
+	if r.Freq == "DAILY" {
+		return false
+	}
+	// Without any BYDAY or BYMONTHDAY, the day comes from the start date,
+	// even if BYMONTH selects the month.
+	return len(r.ByDay) == 0 && len(r.ByMonthDay) == 0
+}
+
+// Determine whether "day" is in the "n"-th week of its year for the day
+// of week it is on. Negative values count from the end of the year.
+func isNthWeekdayOfYear(day time.Time, n int) bool {
+	var daysInYear int = time.Date(day.Year(), 12, 31, 0, 0, 0, 0,
+		time.UTC).YearDay()
+
+	if n > 0 {
+		return (day.YearDay()-1)/7+1 == n
+	}
+	return (daysInYear-day.YearDay())/7+1 == -n
+}
+
+// Determine whether "day" matches the BYDAY part of the rule.
+func (r *RRule) matchesByDay(day time.Time) bool {
+	var wd ruleWeekday
+
+	for _, wd = range r.ByDay {
+		if day.Weekday() != wd.Day {
+			continue
+		}
+		if wd.N == 0 {
+			return true
+		}
+		// In yearly rules, numbered days are counted within the year
+		// unless the months are limited.
+		if r.Freq == "YEARLY" && len(r.ByMonth) == 0 {
+			if isNthWeekdayOfYear(day, wd.N) {
+				return true
+			}
+		} else if isNthWeekday(day, wd.N, wd.Day) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Determine whether "day" is within one of the periods of the rule
+// starting at "dtstart", considering the interval.
+func (r *RRule) inPeriod(dtstart, day time.Time) bool {
+	var periods int
+
+	switch r.Freq {
+	case "DAILY":
+		periods = daysBetween(dtstart, day)
+	case "WEEKLY":
+		periods = daysBetween(weekStart(dtstart), weekStart(day)) / 7
+	case "MONTHLY":
+		periods = (day.Year()-dtstart.Year())*12 +
+			int(day.Month()) - int(dtstart.Month())
+	case "YEARLY":
+		periods = day.Year() - dtstart.Year()
+	}
+
+	return periods%r.Interval == 0
+}
+
+// Determine whether the rule starting at "dtstart" matches "day".
+func (r *RRule) matches(dtstart, day time.Time) bool {
+	var month time.Month
+	var n int
+	var found bool
+
+	if !r.inPeriod(dtstart, day) {
+		return false
+	}
+
+	if len(r.ByMonth) > 0 {
+		for _, month = range r.ByMonth {
+			found = found || day.Month() == month
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.ByMonthDay) > 0 {
+		found = false
+		for _, n = range r.ByMonthDay {
+			found = found || isMonthDay(day, n)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.ByDay) > 0 {
+		return r.matchesByDay(day)
+	}
+	if len(r.ByMonthDay) > 0 {
+		return true
+	}
+
+	// Without any BYDAY or BYMONTHDAY, the day comes from the start date.
+	switch r.Freq {
+	case "WEEKLY":
+		return day.Weekday() == dtstart.Weekday()
+	case "MONTHLY":
+		return day.Day() == dtstart.Day()
+	case "YEARLY":
+		return day.Day() == dtstart.Day() &&
+			(len(r.ByMonth) > 0 || day.Month() == dtstart.Month())
+	}
+
+	return true
+}
+
+// Days determines the days from "from" up to, but not including, "to" on
+// which the rule starting at "dtstart" matches. If "dtstart" is zero, the
+// rule starts at "from", unless it depends on the start date, in which
+// case that is an error.
+func (r *RRule) Days(dtstart, from, to time.Time) ([]time.Time, error) {
+	var rv []time.Time
+	var first time.Time = midnight(from)
+	var day time.Time
+	var count int
+
+	if dtstart.IsZero() {
+		if r.NeedsStart() {
+			return nil, errors.New("The rule requires an anchor date")
+		}
+		dtstart = first
+	}
+
+	if !r.Until.IsZero() && r.Until.Before(to) {
+		to = nextDay(r.Until)
+	}
+
+	// Occurrences have to be counted from the start, even if they are in
+	// the past.
+	day = midnight(dtstart.In(from.Location()))
+	for ; day.Before(to); day = nextDay(day) {
+		if !r.matches(dtstart, day) {
+			continue
+		}
+		count++
+		if r.Count > 0 && count > r.Count {
+			break
+		}
+		if !day.Before(first) {
+			rv = append(rv, day)
+		}
+	}
+
+	return rv, nil
+}
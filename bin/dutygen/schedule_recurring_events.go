@@ -3,17 +3,18 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
-	"database/cassandra"
 	"hash"
 	"log"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/starshipfactory/dutycal"
 )
 
-func genGeneratorID(start time.Time, duration time.Duration, title, description string) []byte {
+func genGeneratorID(start time.Time, duration time.Duration,
+	title, description, key string) []byte {
 	var h hash.Hash
 	var genid GeneratorID
 	var rv []byte
@@ -25,99 +26,267 @@ func genGeneratorID(start time.Time, duration time.Duration, title, description
 	genid.StartTimestamp = proto.Int64(start.Unix())
 	genid.Duration = proto.Int64(int64(duration.Seconds()))
 	genid.ContentHash = h.Sum([]byte{})
+	if len(key) > 0 {
+		genid.RecurringKey = proto.String(key)
+	}
 
 	rv, _ = proto.Marshal(&genid)
 	return rv
 }
 
-// ScheduleWeekdayRecurringEvent schedules a recurring event which is based
-// on weekday recurrence, i.e. weekly on the same week day.
-func ScheduleWeekdayRecurringEvent(
-	start time.Time, db *cassandra.RetryCassandraClient,
-	conf *dutycal.DutyCalConfig, loc *time.Location,
-	rev *dutycal.RecurringEvent) {
-	var duration time.Duration
-	var nextEv time.Time = start
-	var endTime time.Time
+// Determine whether the generator ID "stored" of an existing event stands
+// for the same occurrence as "genid". Events generated before their
+// recurring event was given a key have no key in their generator ID; they
+// still match if everything else is the same, so adding a key doesn't
+// schedule all events a second time.
+func sameOccurrence(stored, genid []byte) bool {
+	var a, b GeneratorID
+
+	if bytes.Equal(stored, genid) {
+		return true
+	}
+	if proto.Unmarshal(stored, &a) != nil ||
+		proto.Unmarshal(genid, &b) != nil {
+		return false
+	}
+
+	return a.RecurringKey == nil &&
+		a.GetStartTimestamp() == b.GetStartTimestamp() &&
+		a.GetDuration() == b.GetDuration() &&
+		bytes.Equal(a.GetContentHash(), b.GetContentHash())
+}
+
+// Find the event generated at "start" for the same occurrence as the
+// generator ID "genid". Returns nil if there is none.
+func findGeneratedEvent(store dutycal.EventStore, loc *time.Location,
+	start time.Time, duration time.Duration, genid []byte) (
+	*dutycal.Event, error) {
+	var evs []*dutycal.Event
+	var ev *dutycal.Event
+	var err error
+
+	evs, err = dutycal.FetchEventRange(
+		store, start, start.Add(duration), -1, loc, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ev = range evs {
+		if sameOccurrence(ev.GeneratorID, genid) {
+			// More checks may go here.
+			return ev, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Generator schedules recurring events in an event store. In a dry run,
+// it only records what it would do.
+type Generator struct {
+	Store    dutycal.EventStore
+	Config   *dutycal.DutyCalConfig
+	Location *time.Location
+	DryRun   bool
+
+	// Everything the generator did, or would have done in a dry run.
+	Actions []*Action
+}
+
+// Create an event for the recurring event "rev" at "start" with the
+// generator ID "genid".
+func (g *Generator) createGeneratedEvent(rev *dutycal.RecurringEvent,
+	start time.Time, duration time.Duration, u *url.URL, genid []byte) {
+	var ev *dutycal.Event
+	var err error
+
+	ev = dutycal.CreateEvent(g.Store, rev.GetTitle(),
+		rev.GetDescription(), "", start, duration, g.Location, u,
+		rev.GetRequired())
+	ev.GeneratorID = genid
+	ev.MinStaff = rev.GetMinStaff()
+	ev.MaxStaff = rev.GetMaxStaff()
+
+	g.record(ActionCreate, ev, "")
+	if g.DryRun {
+		return
+	}
+
+	err = ev.Sync()
+	if err != nil {
+		log.Print("Error creating event from ",
+			start.Format(time.RFC1123Z), " to ",
+			start.Add(duration).Format(time.RFC1123Z),
+			": ", err)
+	} else {
+		dutycal.RecordHistory(g.Store, dutycal.HistoryGenerate,
+			"dutygen", nil, ev)
+	}
+}
+
+// Remove the generated event "ev" which shouldn't take place, unless
+// someone already signed up for it. "reason" explains why it is removed.
+func (g *Generator) removeGeneratedEvent(ev *dutycal.Event, reason string) {
+	var before dutycal.Event = *ev
+	var err error
+
+	if len(ev.Owners) > 0 {
+		g.record(ActionSkip, ev, reason+", but has owners "+
+			strings.Join(ev.Owners, ", "))
+		log.Print("Not removing ", ev.Title, " at ",
+			ev.Start.Format(time.RFC1123Z), " as it has owners: ",
+			ev.Owners)
+		return
+	}
+
+	g.record(ActionRemove, ev, reason)
+	if g.DryRun {
+		return
+	}
+
+	err = ev.Delete()
+	if err != nil {
+		log.Print("Error removing ", ev.Title, " at ",
+			ev.Start.Format(time.RFC1123Z), ": ", err)
+		return
+	}
+
+	dutycal.RecordHistory(g.Store, dutycal.HistoryDelete, "dutygen",
+		&before, nil)
+}
+
+// Make sure the recurring event "rev" is scheduled at "start", using the
+// generator ID to recognize events scheduled by earlier runs. If the
+// occurrence is excluded by "exceptions", it is not scheduled, and removed
+// if configured so. An error is returned only if the existing events can't
+// be determined.
+func (g *Generator) scheduleOccurrence(rev *dutycal.RecurringEvent,
+	start time.Time, duration time.Duration, u *url.URL,
+	exceptions *RecurrenceExceptions) error {
+	var genid []byte = genGeneratorID(start, duration, rev.GetTitle(),
+		rev.GetDescription(), rev.GetKey())
+	var excluded bool = exceptions.Excludes(start)
+	var ev *dutycal.Event
+	var err error
+
+	if excluded && !rev.GetRemoveExcepted() {
+		g.record(ActionSkip, plannedEvent(rev, start, duration, genid),
+			"excepted")
+		return nil
+	}
+
+	// Now, let's determine if there is already a scheduled event during
+	// that time.
+	ev, err = findGeneratedEvent(g.Store, g.Location, start, duration,
+		genid)
+	if err != nil {
+		return err
+	}
+
+	if excluded {
+		if ev != nil {
+			g.removeGeneratedEvent(ev, "excepted")
+		}
+		return nil
+	}
+
+	if ev == nil {
+		g.createGeneratedEvent(rev, start, duration, u, genid)
+	} else {
+		g.record(ActionSkip, ev, "exists")
+	}
+
+	return nil
+}
+
+// Get the reference URL and the duration of the recurring event "rev".
+func recurringEventDetails(rev *dutycal.RecurringEvent) (
+	*url.URL, time.Duration) {
 	var u *url.URL
 
 	if rev.Reference != nil {
 		u, _ = url.Parse(rev.GetReference())
 	}
 
-	duration = time.Duration(rev.GetDurationHours())*time.Hour +
+	return u, time.Duration(rev.GetDurationHours())*time.Hour +
 		time.Duration(rev.GetDurationMinutes())*time.Minute
+}
 
-	// Timezone specific Truncate()
-	nextEv = nextEv.Add(-1 * time.Duration(nextEv.Hour()) * time.Hour).
-		Add(-1 * time.Duration(nextEv.Minute()) * time.Minute).
-		Add(-1 * time.Duration(nextEv.Second()) * time.Second).
-		Add(-1 * time.Duration(nextEv.Nanosecond()) * time.Nanosecond)
+// Occurrences holds the start times of the occurrences of a recurring
+// event in the window from From up to To, and the exceptions to them.
+type Occurrences struct {
+	From       time.Time
+	To         time.Time
+	Starts     []time.Time
+	Exceptions *RecurrenceExceptions
+}
 
-	endTime = nextEv.AddDate(
-		0, 0, int(conf.GetRecurringEventsScheduleAhead()))
+// RecurringEventOccurrences determines the occurrences of the recurring
+// event "rev" to be scheduled from "start" on, based on what recurrence
+// type was defined in the configuration file. The days are expanded in
+// local time, so events keep their wall clock time across daylight saving
+// time changes. Occurrences which already started before "start" are
+// left out.
+func RecurringEventOccurrences(
+	start time.Time, conf *dutycal.DutyCalConfig, loc *time.Location,
+	rev *dutycal.RecurringEvent) (*Occurrences, error) {
+	var rv *Occurrences = new(Occurrences)
+	var days []time.Time
+	var day time.Time
+	var err error
 
-	// Find the next fitting week day.
-	nextEv = nextEv.AddDate(0, 0,
-		7-int(nextEv.Weekday())+int(rev.GetRecurrenceSelector())).
-		Add(time.Duration(rev.GetStartHour()) * time.Hour).
-		Add(time.Duration(rev.GetStartMinute()) * time.Minute)
-
-	for nextEv.Before(endTime) {
-		// Now, let's determine if there is already a scheduled event during
-		// that time.
-		var genid []byte = genGeneratorID(nextEv, duration, rev.GetTitle(),
-			rev.GetDescription())
-		var evs []*dutycal.Event
-		var ev *dutycal.Event
-		var found bool = false
-		var err error
-
-		evs, err = dutycal.FetchEventRange(
-			db, conf, nextEv, nextEv.Add(duration), -1, loc, nil, true)
-		if err != nil {
-			log.Print("Error fetching events from ",
-				nextEv, " to ", nextEv.Add(duration), ": ", err)
-			return
-		}
+	rv.From = midnight(start.In(loc))
+	rv.To = rv.From.AddDate(
+		0, 0, int(conf.GetRecurringEventsScheduleAhead()))
 
-		for _, ev = range evs {
-			if bytes.Compare(ev.GeneratorID, genid) != 0 {
-				continue
-			}
+	days, err = RecurrenceDays(rv.From, rv.To, loc, rev)
+	if err != nil {
+		return nil, err
+	}
 
-			// More checks may go here.
+	rv.Exceptions, err = LoadRecurrenceExceptions(rev, loc, rv.From, rv.To)
+	if err != nil {
+		return nil, err
+	}
 
-			found = true
-		}
+	for _, day = range days {
+		var nextEv time.Time = wallClock(day, int(rev.GetStartHour()),
+			int(rev.GetStartMinute()), loc)
 
-		if !found {
-			ev = dutycal.CreateEvent(db, conf, rev.GetTitle(),
-				rev.GetDescription(), "", nextEv, duration, loc, u,
-				rev.GetRequired())
-			ev.GeneratorID = genid
-			err = ev.Sync()
-			if err != nil {
-				log.Print("Error creating event from ",
-					nextEv.Format(time.RFC1123Z), " to ",
-					nextEv.Add(duration).Format(time.RFC1123Z),
-					": ", err)
-			}
+		if !nextEv.Before(start) {
+			rv.Starts = append(rv.Starts, nextEv)
 		}
-		nextEv = nextEv.AddDate(0, 0, 7)
 	}
+
+	return rv, nil
 }
 
 // ScheduleRecurringEvent schedules a recurring event based on what recurrence
 // type was defined in the configuration file.
-func ScheduleRecurringEvent(
-	start time.Time, db *cassandra.RetryCassandraClient,
-	conf *dutycal.DutyCalConfig, loc *time.Location,
-	rev *dutycal.RecurringEvent) {
-	if rev.GetRecurrenceType() == dutycal.RecurringEvent_WEEKDAY {
-		ScheduleWeekdayRecurringEvent(start, db, conf, loc, rev)
-	} else {
-		log.Print("Don't know how to schedule a recurrence of type ",
-			rev.GetRecurrenceType())
+func (g *Generator) ScheduleRecurringEvent(
+	start time.Time, rev *dutycal.RecurringEvent) {
+	var occurrences *Occurrences
+	var duration time.Duration
+	var nextEv time.Time
+	var u *url.URL
+	var err error
+
+	u, duration = recurringEventDetails(rev)
+
+	occurrences, err = RecurringEventOccurrences(start, g.Config,
+		g.Location, rev)
+	if err != nil {
+		log.Print("Error scheduling ", rev.GetTitle(), ": ", err)
+		return
+	}
+
+	for _, nextEv = range occurrences.Starts {
+		err = g.scheduleOccurrence(rev, nextEv, duration, u,
+			occurrences.Exceptions)
+		if err != nil {
+			log.Print("Error fetching events from ",
+				nextEv, " to ", nextEv.Add(duration), ": ", err)
+			return
+		}
 	}
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/dutycal"
+)
+
+// Expected result of comparing the generator ID "stored" of an existing
+// event to that of an occurrence.
+type sameOccurrenceTest struct {
+	name   string
+	stored []byte
+	want   bool
+}
+
+func TestSameOccurrence(t *testing.T) {
+	var start time.Time = time.Date(2026, 10, 20, 18, 0, 0, 0, time.UTC)
+	var genid []byte = genGeneratorID(start, 2*time.Hour, "Open Factory",
+		"Come in", "tuesday")
+	var test sameOccurrenceTest
+	var tests = []sameOccurrenceTest{
+		{
+			name:   "same key",
+			stored: genid,
+			want:   true,
+		},
+		{
+			name: "generated before the key was added",
+			stored: genGeneratorID(start, 2*time.Hour, "Open Factory",
+				"Come in", ""),
+			want: true,
+		},
+		{
+			name: "different key",
+			stored: genGeneratorID(start, 2*time.Hour, "Open Factory",
+				"Come in", "friday"),
+			want: false,
+		},
+		{
+			name: "different start",
+			stored: genGeneratorID(start.Add(time.Hour), 2*time.Hour,
+				"Open Factory", "Come in", ""),
+			want: false,
+		},
+		{
+			name: "different duration",
+			stored: genGeneratorID(start, time.Hour, "Open Factory",
+				"Come in", ""),
+			want: false,
+		},
+		{
+			name: "different description",
+			stored: genGeneratorID(start, 2*time.Hour, "Open Factory",
+				"Closed", ""),
+			want: false,
+		},
+		{
+			name:   "not generated",
+			stored: nil,
+			want:   false,
+		},
+	}
+
+	for _, test = range tests {
+		if sameOccurrence(test.stored, genid) != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, !test.want,
+				test.want)
+		}
+	}
+}
+
+// Adding a key to a recurring event must not schedule its events again.
+func TestScheduleAfterAddingKey(t *testing.T) {
+	var loc *time.Location = zurich(t)
+	var store *dutycal.MemoryEventStore = dutycal.NewMemoryEventStore()
+	var start time.Time = time.Date(2026, 10, 19, 12, 0, 0, 0, loc)
+	var rev *dutycal.RecurringEvent = weeklyEvent(time.Tuesday, 18, 0)
+	var conf *dutycal.DutyCalConfig = &dutycal.DutyCalConfig{
+		RecurringEventsScheduleAhead: proto.Int32(14),
+	}
+	var g *Generator = &Generator{
+		Store:    store,
+		Config:   conf,
+		Location: loc,
+	}
+	var evs []*dutycal.Event
+	var action *Action
+	var err error
+
+	g.ScheduleRecurringEvent(start, rev)
+	g.Actions = nil
+
+	rev.Key = proto.String("open-factory-tuesday")
+	g.ScheduleRecurringEvent(start, rev)
+
+	for _, action = range g.Actions {
+		if action.Action != ActionSkip {
+			t.Errorf("%s at %s: got %s, want %s", action.Title,
+				action.Start, action.Action, ActionSkip)
+		}
+	}
+
+	evs, err = dutycal.FetchEventRange(store, start,
+		start.AddDate(0, 0, 14), -1, loc, nil, true)
+	if err != nil {
+		t.Fatal("Error fetching events: ", err)
+	}
+	if len(evs) != 2 {
+		t.Errorf("got %d events, want 2", len(evs))
+	}
+}
@@ -0,0 +1,660 @@
+package dutycal
+
+import (
+	"bytes"
+	"database/cassandra"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+var eventAllColumns [][]byte = [][]byte{
+	[]byte("title"), []byte("description"), []byte("owner"),
+	[]byte("start"), []byte("end"), []byte("required"), []byte("week"),
+	[]byte("reference"), []byte("generatorID"), []byte("minStaff"),
+	[]byte("maxStaff"),
+}
+
+// CassandraEventStore is an EventStore keeping events in a Cassandra
+// column family, accessed through the Thrift API.
+type CassandraEventStore struct {
+	db   *cassandra.RetryCassandraClient
+	conf *DutyCalConfig
+}
+
+// NewCassandraEventStore creates a new event store using the Cassandra
+// connection "db". The column family to use is taken from "conf".
+func NewCassandraEventStore(db *cassandra.RetryCassandraClient,
+	conf *DutyCalConfig) *CassandraEventStore {
+	return &CassandraEventStore{
+		db:   db,
+		conf: conf,
+	}
+}
+
+// OpenCassandraEventStore connects to the Cassandra server configured in
+// "conf" and switches to the configured keyspace.
+func OpenCassandraEventStore(conf *DutyCalConfig) (
+	*CassandraEventStore, error) {
+	var db *cassandra.RetryCassandraClient
+	var err error
+
+	db, err = cassandra.NewRetryCassandraClient(conf.GetDbServer())
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to Cassandra at %s: %s",
+			conf.GetDbServer(), err)
+	}
+
+	err = db.SetKeyspace(conf.GetKeyspace())
+	if err != nil {
+		return nil, fmt.Errorf("Error switching keyspace to %s: %s",
+			conf.GetKeyspace(), err)
+	}
+
+	return NewCassandraEventStore(db, conf), nil
+}
+
+// FetchEvent recreates in-memory event objects from the database. The record
+// "id" is read from the column family specified in the configuration. If
+// "quorum" is specified, a quorum read from the database will be performed
+// rather than just reading from a single replica.
+func (s *CassandraEventStore) FetchEvent(id string, loc *time.Location,
+	quorum bool) (rv *Event, err error) {
+	var cp *cassandra.ColumnParent = cassandra.NewColumnParent()
+	var pred *cassandra.SlicePredicate = cassandra.NewSlicePredicate()
+	var cl cassandra.ConsistencyLevel
+	var r []*cassandra.ColumnOrSuperColumn
+
+	cp.ColumnFamily = s.conf.GetEventsColumnFamily()
+	pred.ColumnNames = eventAllColumns
+
+	if quorum {
+		cl = cassandra.ConsistencyLevel_QUORUM
+	} else {
+		cl = cassandra.ConsistencyLevel_ONE
+	}
+
+	r, err = s.db.GetSlice([]byte(id), cp, pred, cl)
+	if err != nil {
+		return
+	}
+	if len(r) == 0 {
+		err = ErrEventNotFound
+		return
+	}
+
+	rv = &Event{
+		store: s,
+		ID:    id,
+	}
+	err = rv.extractFromColumns(r, loc)
+	return
+}
+
+// Determine the range of week buckets which may contain events overlapping
+// with the time range from "from" to "to". Events are filed under the week
+// of their start, so "lookback" weeks before "from" are included as well to
+// catch events of up to that many weeks which started there and are still
+// ongoing. Open ends of the range (a zero Unix timestamp) are limited to
+// "horizon" weeks.
+func eventWeekRange(from, to time.Time, loc *time.Location,
+	horizon, lookback int64) (first, last int64) {
+	if to.Unix() != 0 {
+		last = getWeekFromTimestamp(to.In(loc))
+	}
+	if from.Unix() != 0 {
+		first = getWeekFromTimestamp(from.In(loc)) - lookback
+	}
+
+	if to.Unix() == 0 && from.Unix() == 0 {
+		first = getWeekFromTimestamp(time.Now().In(loc)) - lookback
+		last = first + lookback + horizon
+	} else if to.Unix() == 0 {
+		last = first + lookback + horizon
+	} else if from.Unix() == 0 {
+		first = last - horizon
+	}
+
+	if first < 0 {
+		first = 0
+	}
+
+	return
+}
+
+// Collect the events filed under the week buckets "first" to "last", which
+// are read one by one through "fetch". Only events matching the "user"
+// filter are kept. The result is sorted by start time and, if a limit is
+// given, cut off after that many events.
+func fetchWeeks(first, last int64, limit int32, user *string,
+	fetch func(week int64) ([]*Event, error)) ([]*Event, error) {
+	var week int64
+	var rv []*Event
+	var err error
+
+	for week = first; week <= last; week++ {
+		var events []*Event
+		var e *Event
+
+		events, err = fetch(week)
+		if err != nil {
+			return rv, err
+		}
+
+		for _, e = range events {
+			if e.matchesUser(user) {
+				rv = append(rv, e)
+			}
+		}
+
+		// Buckets are ordered by start time, so once we have enough
+		// events, later buckets can only contain later events.
+		if limit > 0 && int32(len(rv)) >= limit {
+			break
+		}
+	}
+
+	sort.Sort(eventsByStart(rv))
+	if limit > 0 && int32(len(rv)) > limit {
+		rv = rv[:limit]
+	}
+
+	return rv, nil
+}
+
+// FetchEventRange retrieves a list of all events between the two specified
+// dates, sorted by start time. If a limit is given, only up to that many
+// records will be returned. If "user" is not nil, the specified user must be
+// one of the owners, or if it is empty, the event must need more owners.
+//
+// Since the secondary indexes can only be queried for equality on the
+// week, every week bucket touched by the range is queried separately. If
+// either end of the range is open (a zero Unix timestamp), the search is
+// limited to open_range_lookahead_weeks weeks; if a limit is given, it
+// stops early once enough events have been found.
+func (s *CassandraEventStore) FetchEventRange(from, to time.Time,
+	limit int32, loc *time.Location, user *string, quorum bool) (
+	[]*Event, error) {
+	var cl cassandra.ConsistencyLevel
+	var first, last int64
+
+	if quorum {
+		cl = cassandra.ConsistencyLevel_QUORUM
+	} else {
+		cl = cassandra.ConsistencyLevel_ONE
+	}
+
+	first, last = eventWeekRange(from, to, loc,
+		int64(s.conf.GetOpenRangeLookaheadWeeks()),
+		int64(s.conf.GetMaxEventDurationWeeks()))
+
+	return fetchWeeks(first, last, limit, user,
+		func(week int64) ([]*Event, error) {
+			return s.fetchWeek(week, from, to, loc, cl)
+		})
+}
+
+// Fetch all events overlapping the time range from "from" to "to" which are
+// filed under the week bucket "week". The bucket is read in pages of
+// max_events_per_day events per day, so busy weeks aren't cut off.
+func (s *CassandraEventStore) fetchWeek(week int64, from, to time.Time,
+	loc *time.Location, cl cassandra.ConsistencyLevel) (
+	[]*Event, error) {
+	var parent *cassandra.ColumnParent
+	var clause *cassandra.IndexClause
+	var predicate *cassandra.SlicePredicate
+	var expr *cassandra.IndexExpression
+
+	var res []*cassandra.KeySlice
+	var err error
+
+	var ks *cassandra.KeySlice
+	var rv []*Event
+
+	parent = cassandra.NewColumnParent()
+	parent.ColumnFamily = s.conf.GetEventsColumnFamily()
+	clause = cassandra.NewIndexClause()
+	clause.StartKey = make([]byte, 0)
+	// Results come back in token order rather than by time, so we cannot
+	// apply the caller's limit here without losing early events.
+	clause.Count = s.conf.GetMaxEventsPerDay() * 7
+	if clause.Count < 2 {
+		// Every page after the first starts with the last key of the
+		// previous one, so a single key per page would never advance.
+		clause.Count = 2
+	}
+	predicate = cassandra.NewSlicePredicate()
+	predicate.ColumnNames = eventAllColumns
+
+	expr = cassandra.NewIndexExpression()
+	expr.ColumnName = []byte("week")
+	expr.Op = cassandra.IndexOperator_EQ
+	expr.Value = make([]byte, 8)
+	binary.BigEndian.PutUint64(expr.Value, uint64(week))
+	clause.Expressions = append(clause.Expressions, expr)
+
+	if to.Unix() != 0 {
+		expr = cassandra.NewIndexExpression()
+		expr.ColumnName = []byte("start")
+		expr.Op = cassandra.IndexOperator_LTE
+		expr.Value = make([]byte, 8)
+		binary.BigEndian.PutUint64(expr.Value, uint64(to.Unix()*1000))
+		clause.Expressions = append(clause.Expressions, expr)
+	}
+
+	if from.Unix() != 0 {
+		expr = cassandra.NewIndexExpression()
+		expr.ColumnName = []byte("end")
+		expr.Op = cassandra.IndexOperator_GTE
+		expr.Value = make([]byte, 8)
+		binary.BigEndian.PutUint64(expr.Value, uint64(from.Unix()*1000))
+		clause.Expressions = append(clause.Expressions, expr)
+	}
+
+	for {
+		res, err = s.db.GetIndexedSlices(
+			parent, clause, predicate, cl)
+		if err != nil {
+			return []*Event{}, err
+		}
+
+		for _, ks = range res {
+			var e *Event = &Event{
+				store: s,
+				ID:    string(ks.Key),
+			}
+
+			// The start key is included in the results, but was
+			// already read as part of the previous page.
+			if len(clause.StartKey) > 0 &&
+				bytes.Equal(ks.Key, clause.StartKey) {
+				continue
+			}
+
+			err = e.extractFromColumns(ks.Columns, loc)
+			if err != nil {
+				return rv, err
+			}
+
+			rv = append(rv, e)
+		}
+
+		if int32(len(res)) < clause.Count {
+			return rv, nil
+		}
+		clause.StartKey = res[len(res)-1].Key
+	}
+}
+
+// Extract event data from a number of columns.
+func (e *Event) extractFromColumns(r []*cassandra.ColumnOrSuperColumn,
+	loc *time.Location) error {
+	var cos *cassandra.ColumnOrSuperColumn
+	var end time.Time
+
+	for _, cos = range r {
+		var col *cassandra.Column = cos.Column
+		var cname string
+
+		if col == nil {
+			continue
+		}
+
+		cname = string(col.Name)
+		// The owners can be changed on their own, so use the most recent
+		// write to make sure deleting the event removes all columns.
+		if col.IsSetTimestamp() && col.GetTimestamp() > e.updateTS {
+			e.updateTS = col.GetTimestamp()
+		}
+
+		if cname == "title" {
+			e.Title = string(col.Value)
+		} else if cname == "description" {
+			e.Description = string(col.Value)
+		} else if cname == "owner" {
+			e.setOwnerColumn(string(col.Value))
+		} else if cname == "start" {
+			var start int64
+
+			start = int64(binary.BigEndian.Uint64(col.Value))
+			e.Start = time.Unix(start/1000, (start%1000)*1000).In(loc)
+		} else if cname == "end" {
+			var endTS int64
+
+			endTS = int64(binary.BigEndian.Uint64(col.Value))
+			end = time.Unix(endTS/1000, (endTS%1000)*1000).In(loc)
+		} else if cname == "reference" {
+			e.Reference, _ = url.Parse(string(col.Value))
+		} else if cname == "required" {
+			e.Required = (len(col.Value) > 0 && col.Value[0] > 0)
+		} else if cname == "generatorID" {
+			e.GeneratorID = col.Value
+		} else if cname == "minStaff" {
+			e.MinStaff = int32(binary.BigEndian.Uint64(col.Value))
+		} else if cname == "maxStaff" {
+			e.MaxStaff = int32(binary.BigEndian.Uint64(col.Value))
+		}
+	}
+	e.normalizeStaff()
+
+	if e.Start.After(end) {
+		e.Duration = e.Start.Sub(end)
+		e.Start = end
+	} else {
+		e.Duration = end.Sub(e.Start)
+	}
+	e.location = loc
+
+	return nil
+}
+
+// SyncEvent writes the modified event object back to the database.
+func (s *CassandraEventStore) SyncEvent(e *Event) error {
+	var mmap map[string]map[string][]*cassandra.Mutation
+	var mutations []*cassandra.Mutation
+	var col *cassandra.Column
+	var ts int64
+	var err error
+
+	// Timestamps should be in microseconds.
+	ts = time.Now().UnixNano() / 1000
+
+	for _, col = range eventColumns(e, true, ts) {
+		var mutation *cassandra.Mutation = cassandra.NewMutation()
+
+		mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
+		mutation.ColumnOrSupercolumn.Column = col
+		mutations = append(mutations, mutation)
+	}
+
+	mmap = make(map[string]map[string][]*cassandra.Mutation)
+	mmap[e.ID] = make(map[string][]*cassandra.Mutation)
+	mmap[e.ID][s.conf.GetEventsColumnFamily()] = mutations
+
+	err = s.db.AtomicBatchMutate(mmap, cassandra.ConsistencyLevel_QUORUM)
+	if err != nil {
+		return err
+	}
+
+	// Update the update timestamp in case we want to delete the event again.
+	e.updateTS = ts
+
+	return nil
+}
+
+// SyncDetails writes the modified event object back to the database,
+// except for the owner column, using a compare-and-set operation on the
+// owners of "expected".
+func (s *CassandraEventStore) SyncDetails(e *Event, expected *Event) error {
+	var res *cassandra.CASResult_
+	var expect *cassandra.Column
+	var ts int64
+	var err error
+
+	// Timestamps should be in microseconds.
+	ts = time.Now().UnixNano() / 1000
+
+	expect = cassandra.NewColumn()
+	expect.Name = []byte("owner")
+	expect.Value = []byte(expected.ownerColumn())
+
+	res, err = s.db.Cas([]byte(e.ID), s.conf.GetEventsColumnFamily(),
+		[]*cassandra.Column{expect}, eventColumns(e, false, ts),
+		cassandra.ConsistencyLevel_SERIAL, cassandra.ConsistencyLevel_QUORUM)
+	if err != nil {
+		return err
+	}
+	if !res.Success && len(res.CurrentValues) == 0 {
+		return ErrEventNotFound
+	} else if !res.Success {
+		return ErrOwnerChanged
+	}
+
+	e.updateTS = ts
+	return nil
+}
+
+// Make a column with the name "name", the value "value" and the timestamp
+// "ts".
+func newEventColumn(name string, value []byte, ts int64) *cassandra.Column {
+	var col *cassandra.Column = cassandra.NewColumn()
+
+	col.Name = []byte(name)
+	col.Value = value
+	col.Timestamp = &ts
+
+	return col
+}
+
+// Encode "v" as a column value.
+func int64Value(v int64) []byte {
+	var rv []byte = make([]byte, 8)
+
+	binary.BigEndian.PutUint64(rv, uint64(v))
+	return rv
+}
+
+// Determine the columns representing the event "e", written with the
+// timestamp "ts". The owner column is only included if "owners" is set.
+func eventColumns(e *Event, owners bool, ts int64) []*cassandra.Column {
+	var required []byte = []byte{0}
+	var rv []*cassandra.Column
+
+	if e.Required {
+		required = []byte{1}
+	}
+
+	rv = append(rv,
+		newEventColumn("title", []byte(e.Title), ts),
+		newEventColumn("description", []byte(e.Description), ts))
+	if owners {
+		rv = append(rv, newEventColumn("owner", []byte(e.ownerColumn()), ts))
+	}
+	rv = append(rv,
+		newEventColumn("start", int64Value(e.Start.Unix()*1000), ts),
+		newEventColumn("end",
+			int64Value(e.Start.Add(e.Duration).Unix()*1000), ts),
+		newEventColumn("required", required, ts),
+		newEventColumn("minStaff", int64Value(int64(e.MinStaff)), ts),
+		newEventColumn("maxStaff", int64Value(int64(e.MaxStaff)), ts),
+		newEventColumn("week", int64Value(getWeekFromTimestamp(e.Start)),
+			ts))
+
+	if e.Reference != nil {
+		rv = append(rv,
+			newEventColumn("reference", []byte(e.Reference.String()), ts))
+	}
+	if len(e.GeneratorID) > 0 {
+		rv = append(rv, newEventColumn("generatorID", e.GeneratorID, ts))
+	}
+
+	return rv
+}
+
+// DeleteEvent deletes the database representation of the event.
+func (s *CassandraEventStore) DeleteEvent(e *Event) error {
+	var sp *cassandra.SlicePredicate
+	var mmap map[string]map[string][]*cassandra.Mutation
+	var mutations []*cassandra.Mutation
+	var mutation *cassandra.Mutation
+	var err error
+
+	if e.updateTS == 0 {
+		return errors.New("Object not synced to database yet")
+	}
+
+	sp = cassandra.NewSlicePredicate()
+	sp.ColumnNames = eventAllColumns
+
+	mutation = cassandra.NewMutation()
+	mutation.Deletion = cassandra.NewDeletion()
+	mutation.Deletion.Timestamp = &e.updateTS
+	mutation.Deletion.Predicate = sp
+	mutations = append(mutations, mutation)
+
+	mmap = make(map[string]map[string][]*cassandra.Mutation)
+	mmap[e.ID] = make(map[string][]*cassandra.Mutation)
+	mmap[e.ID][s.conf.GetEventsColumnFamily()] = mutations
+
+	err = s.db.AtomicBatchMutate(mmap, cassandra.ConsistencyLevel_QUORUM)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SyncOwners changes the owners and handover offers of the stored event to
+// those of "e" if they are still those of "expected", using a
+// compare-and-set operation.
+func (s *CassandraEventStore) SyncOwners(e *Event,
+	expected *Event) error {
+	var res *cassandra.CASResult_
+	var expect, update *cassandra.Column
+	var ts int64
+	var err error
+
+	// Timestamps should be in microseconds.
+	ts = time.Now().UnixNano() / 1000
+
+	expect = cassandra.NewColumn()
+	expect.Name = []byte("owner")
+	expect.Value = []byte(expected.ownerColumn())
+
+	update = cassandra.NewColumn()
+	update.Name = []byte("owner")
+	update.Value = []byte(e.ownerColumn())
+	update.Timestamp = &ts
+
+	res, err = s.db.Cas([]byte(e.ID), s.conf.GetEventsColumnFamily(),
+		[]*cassandra.Column{expect}, []*cassandra.Column{update},
+		cassandra.ConsistencyLevel_SERIAL, cassandra.ConsistencyLevel_QUORUM)
+	if err != nil {
+		return err
+	}
+	if !res.Success {
+		return ErrOwnerChanged
+	}
+
+	e.updateTS = ts
+	return nil
+}
+
+// AppendHistory adds the entry "h" to the history column family, both to
+// the row of the event and to the row of the current day.
+func (s *CassandraEventStore) AppendHistory(h *HistoryEntry) error {
+	var r *historyRecord = newHistoryRecord(h)
+	var mmap map[string]map[string][]*cassandra.Mutation
+	var mutation *cassandra.Mutation
+	var col *cassandra.Column
+	var key string
+	var err error
+
+	col = cassandra.NewColumn()
+	col.Name = historyColumnName(r)
+	col.Value, err = json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	col.Timestamp = &r.Time
+
+	mutation = cassandra.NewMutation()
+	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
+	mutation.ColumnOrSupercolumn.Column = col
+
+	mmap = make(map[string]map[string][]*cassandra.Mutation)
+	for _, key = range []string{
+		historyEventKey(r.EventID), historyDayKey(historyDay(h.Time))} {
+		mmap[key] = make(map[string][]*cassandra.Mutation)
+		mmap[key][s.conf.GetHistoryColumnFamily()] =
+			[]*cassandra.Mutation{mutation}
+	}
+
+	return s.db.AtomicBatchMutate(mmap, cassandra.ConsistencyLevel_QUORUM)
+}
+
+// Read up to "count" history entries from the row "key", most recent
+// first.
+func (s *CassandraEventStore) fetchHistoryRow(key string, count int32,
+	loc *time.Location) ([]*HistoryEntry, error) {
+	var cp *cassandra.ColumnParent = cassandra.NewColumnParent()
+	var pred *cassandra.SlicePredicate = cassandra.NewSlicePredicate()
+	var r []*cassandra.ColumnOrSuperColumn
+	var cos *cassandra.ColumnOrSuperColumn
+	var rv []*HistoryEntry
+	var err error
+
+	cp.ColumnFamily = s.conf.GetHistoryColumnFamily()
+	pred.SliceRange = cassandra.NewSliceRange()
+	pred.SliceRange.Start = []byte{}
+	pred.SliceRange.Finish = []byte{}
+	pred.SliceRange.Reversed = true
+	pred.SliceRange.Count = count
+
+	r, err = s.db.GetSlice([]byte(key), cp, pred,
+		cassandra.ConsistencyLevel_ONE)
+	if err != nil {
+		return rv, err
+	}
+
+	for _, cos = range r {
+		var rec historyRecord
+
+		if cos.Column == nil {
+			continue
+		}
+
+		err = json.Unmarshal(cos.Column.Value, &rec)
+		if err != nil {
+			return rv, err
+		}
+
+		rv = append(rv, rec.toEntry(loc))
+	}
+
+	return rv, nil
+}
+
+// FetchHistory retrieves all history entries for the event "id", most
+// recent first.
+func (s *CassandraEventStore) FetchHistory(id string, loc *time.Location) (
+	[]*HistoryEntry, error) {
+	return s.fetchHistoryRow(historyEventKey(id), maxHistoryRowEntries, loc)
+}
+
+// FetchRecentHistory retrieves up to "limit" history entries recorded
+// after "since", most recent first. The rows of all days since then are
+// read one by one, starting from today.
+func (s *CassandraEventStore) FetchRecentHistory(since time.Time,
+	limit int32, loc *time.Location) ([]*HistoryEntry, error) {
+	var day int64
+	var rv []*HistoryEntry
+	var err error
+
+	for day = historyDay(time.Now()); day >= historyDay(since); day-- {
+		var entries []*HistoryEntry
+		var h *HistoryEntry
+
+		entries, err = s.fetchHistoryRow(historyDayKey(day),
+			maxHistoryRowEntries, loc)
+		if err != nil {
+			return rv, err
+		}
+
+		for _, h = range entries {
+			if h.Time.Before(since) {
+				return rv, nil
+			}
+			if limit > 0 && int32(len(rv)) >= limit {
+				return rv, nil
+			}
+			rv = append(rv, h)
+		}
+	}
+
+	return rv, nil
+}
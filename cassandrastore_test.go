@@ -0,0 +1,315 @@
+package dutycal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Pair of times and whether they must be filed under the same week bucket.
+type weekBucketTest struct {
+	name     string
+	a, b     time.Time
+	sameWeek bool
+}
+
+// Time range to query, and the start of an event overlapping it whose
+// week bucket must be searched.
+type weekRangeTest struct {
+	name     string
+	from, to time.Time
+	lookback int64
+	start    time.Time
+}
+
+// Query of fake week buckets, and the titles of the events and the weeks
+// which must have been read for it.
+type fetchWeeksTest struct {
+	name        string
+	first, last int64
+	limit       int32
+	user        *string
+	want        []string
+	wantWeeks   []int64
+}
+
+// Load the time zone the tests are written for.
+func zurich(t *testing.T) *time.Location {
+	var loc *time.Location
+	var err error
+
+	loc, err = time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Fatal("Error loading time zone: ", err)
+	}
+
+	return loc
+}
+
+func TestGetWeekFromTimestamp(t *testing.T) {
+	var loc *time.Location = zurich(t)
+	var test weekBucketTest
+	var tests = []weekBucketTest{
+		{
+			name:     "week boundary after falling back",
+			a:        time.Date(2026, 10, 25, 23, 59, 0, 0, loc),
+			b:        time.Date(2026, 10, 26, 0, 0, 0, 0, loc),
+			sameWeek: false,
+		},
+		{
+			name:     "week with spring forward",
+			a:        time.Date(2027, 3, 22, 0, 0, 0, 0, loc),
+			b:        time.Date(2027, 3, 28, 23, 59, 0, 0, loc),
+			sameWeek: true,
+		},
+		{
+			name:     "week boundary after springing forward",
+			a:        time.Date(2027, 3, 28, 23, 59, 0, 0, loc),
+			b:        time.Date(2027, 3, 29, 0, 0, 0, 0, loc),
+			sameWeek: false,
+		},
+		{
+			name:     "year boundary within a week",
+			a:        time.Date(2026, 12, 31, 12, 0, 0, 0, loc),
+			b:        time.Date(2027, 1, 1, 12, 0, 0, 0, loc),
+			sameWeek: true,
+		},
+		{
+			name:     "first week boundary of the year",
+			a:        time.Date(2027, 1, 3, 23, 59, 0, 0, loc),
+			b:        time.Date(2027, 1, 4, 0, 0, 0, 0, loc),
+			sameWeek: false,
+		},
+	}
+
+	for _, test = range tests {
+		var a int64 = getWeekFromTimestamp(test.a)
+		var b int64 = getWeekFromTimestamp(test.b)
+
+		if (a == b) != test.sameWeek {
+			t.Errorf("%s: %s is in week %d, %s in week %d", test.name,
+				test.a, a, test.b, b)
+		}
+	}
+}
+
+func TestEventWeekRange(t *testing.T) {
+	var loc *time.Location = zurich(t)
+	var test weekRangeTest
+	var tests = []weekRangeTest{
+		{
+			name:     "event from the previous week",
+			from:     time.Date(2026, 10, 26, 0, 30, 0, 0, loc),
+			to:       time.Date(2026, 10, 26, 10, 0, 0, 0, loc),
+			lookback: 1,
+			start:    time.Date(2026, 10, 25, 22, 0, 0, 0, loc),
+		},
+		{
+			name:     "range across the week boundary",
+			from:     time.Date(2026, 10, 25, 20, 0, 0, 0, loc),
+			to:       time.Date(2026, 10, 26, 10, 0, 0, 0, loc),
+			lookback: 1,
+			start:    time.Date(2026, 10, 26, 9, 0, 0, 0, loc),
+		},
+		{
+			name:     "range across the year boundary",
+			from:     time.Date(2026, 12, 31, 0, 0, 0, 0, loc),
+			to:       time.Date(2027, 1, 5, 0, 0, 0, 0, loc),
+			lookback: 1,
+			start:    time.Date(2027, 1, 4, 18, 0, 0, 0, loc),
+		},
+		{
+			name:     "event started in the previous year",
+			from:     time.Date(2027, 1, 4, 0, 0, 0, 0, loc),
+			to:       time.Date(2027, 1, 5, 0, 0, 0, 0, loc),
+			lookback: 1,
+			start:    time.Date(2026, 12, 29, 18, 0, 0, 0, loc),
+		},
+		{
+			name:     "event ongoing at spring forward",
+			from:     time.Date(2027, 3, 29, 0, 0, 0, 0, loc),
+			to:       time.Date(2027, 3, 29, 1, 0, 0, 0, loc),
+			lookback: 1,
+			start:    time.Date(2027, 3, 28, 23, 0, 0, 0, loc),
+		},
+		{
+			name:     "event lasting longer than a week",
+			from:     time.Date(2027, 3, 29, 0, 0, 0, 0, loc),
+			to:       time.Date(2027, 3, 30, 0, 0, 0, 0, loc),
+			lookback: 2,
+			start:    time.Date(2027, 3, 16, 12, 0, 0, 0, loc),
+		},
+		{
+			name:     "open end",
+			from:     time.Date(2027, 3, 29, 0, 0, 0, 0, loc),
+			to:       time.Unix(0, 0),
+			lookback: 1,
+			start:    time.Date(2027, 9, 20, 12, 0, 0, 0, loc),
+		},
+		{
+			name:     "open start",
+			from:     time.Unix(0, 0),
+			to:       time.Date(2027, 3, 29, 0, 0, 0, 0, loc),
+			lookback: 1,
+			start:    time.Date(2026, 10, 5, 12, 0, 0, 0, loc),
+		},
+	}
+
+	for _, test = range tests {
+		var week int64 = getWeekFromTimestamp(test.start)
+		var first, last int64
+
+		first, last = eventWeekRange(test.from, test.to, loc, 26,
+			test.lookback)
+		if week < first || week > last {
+			t.Errorf("%s: week %d of %s is not in %d to %d", test.name,
+				week, test.start, first, last)
+		}
+	}
+}
+
+// Create an event for the fake week buckets of TestFetchWeeks, starting
+// "days" days into the test weeks.
+func bucketEvent(title string, days int, minStaff int32,
+	owners ...string) *Event {
+	return &Event{
+		Title: title,
+		Start: time.Date(2027, 3, 1, 18, 0, 0, 0, time.UTC).AddDate(0, 0,
+			days),
+		Duration: 2 * time.Hour,
+		Owners:   owners,
+		MinStaff: minStaff,
+		MaxStaff: 2,
+	}
+}
+
+func TestFetchWeeks(t *testing.T) {
+	var alice string = "alice"
+	var none string
+	// Buckets come back in token order rather than by start time.
+	var buckets = map[int64][]*Event{
+		10: {
+			bucketEvent("tue", 1, 1),
+			bucketEvent("mon", 0, 1, "alice"),
+			bucketEvent("sun", 6, 2, "alice", "bob"),
+		},
+		11: {
+			bucketEvent("thu2", 10, 2, "alice"),
+			bucketEvent("mon2", 7, 1, "bob"),
+		},
+		13: {
+			bucketEvent("mon4", 21, 1),
+		},
+	}
+	var test fetchWeeksTest
+	var tests = []fetchWeeksTest{
+		{
+			name:      "merged and sorted across buckets",
+			first:     9,
+			last:      13,
+			want:      []string{"mon", "tue", "sun", "mon2", "thu2", "mon4"},
+			wantWeeks: []int64{9, 10, 11, 12, 13},
+		},
+		{
+			name:      "range of buckets",
+			first:     11,
+			last:      12,
+			want:      []string{"mon2", "thu2"},
+			wantWeeks: []int64{11, 12},
+		},
+		{
+			name:      "limit within the first bucket",
+			first:     10,
+			last:      13,
+			limit:     2,
+			want:      []string{"mon", "tue"},
+			wantWeeks: []int64{10},
+		},
+		{
+			name:      "limit across buckets",
+			first:     10,
+			last:      13,
+			limit:     4,
+			want:      []string{"mon", "tue", "sun", "mon2"},
+			wantWeeks: []int64{10, 11},
+		},
+		{
+			name:      "limit larger than the result",
+			first:     10,
+			last:      13,
+			limit:     10,
+			want:      []string{"mon", "tue", "sun", "mon2", "thu2", "mon4"},
+			wantWeeks: []int64{10, 11, 12, 13},
+		},
+		{
+			name:      "owned by alice",
+			first:     10,
+			last:      13,
+			user:      &alice,
+			want:      []string{"mon", "sun", "thu2"},
+			wantWeeks: []int64{10, 11, 12, 13},
+		},
+		{
+			name:      "owner filter applied before the limit",
+			first:     10,
+			last:      13,
+			limit:     3,
+			user:      &alice,
+			want:      []string{"mon", "sun", "thu2"},
+			wantWeeks: []int64{10, 11},
+		},
+		{
+			name:      "understaffed",
+			first:     10,
+			last:      13,
+			limit:     3,
+			user:      &none,
+			want:      []string{"tue", "thu2", "mon4"},
+			wantWeeks: []int64{10, 11, 12, 13},
+		},
+	}
+
+	for _, test = range tests {
+		var weeks []int64
+		var evs []*Event
+		var err error
+
+		evs, err = fetchWeeks(test.first, test.last, test.limit, test.user,
+			func(week int64) ([]*Event, error) {
+				weeks = append(weeks, week)
+				return buckets[week], nil
+			})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if strings.Join(eventTitles(evs), ",") !=
+			strings.Join(test.want, ",") {
+			t.Errorf("%s: got %v, want %v", test.name, eventTitles(evs),
+				test.want)
+		}
+		if fmt.Sprint(weeks) != fmt.Sprint(test.wantWeeks) {
+			t.Errorf("%s: read weeks %v, want %v", test.name, weeks,
+				test.wantWeeks)
+		}
+	}
+}
+
+func TestFetchWeeksError(t *testing.T) {
+	var failure error = errors.New("Timed out")
+	var err error
+
+	_, err = fetchWeeks(10, 13, 0, nil,
+		func(week int64) ([]*Event, error) {
+			if week == 11 {
+				return nil, failure
+			}
+			return []*Event{bucketEvent("mon", 0, 1)}, nil
+		})
+	if err != failure {
+		t.Errorf("got %v, want %v", err, failure)
+	}
+}
@@ -0,0 +1,465 @@
+package dutycal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Columns to read for reconstructing events, in the order expected by
+// scanEvent. The owner column contains the list of owners, separated by
+// commas. Since the owners can be changed on their own, the owner column
+// may have been written after all other columns.
+const cqlEventColumns = "key, title, description, owner, start, \"end\", " +
+	"required, reference, generatorid, minstaff, maxstaff, " +
+	"WRITETIME(title), WRITETIME(owner)"
+
+// CQLEventStore is an EventStore keeping events in a Cassandra or ScyllaDB
+// table as laid out in schema.cql, accessed through the native CQL protocol.
+type CQLEventStore struct {
+	session *gocql.Session
+	conf    *DutyCalConfig
+
+	readConsistency  gocql.Consistency
+	writeConsistency gocql.Consistency
+}
+
+// NewCQLEventStore creates a new event store on the CQL session "session".
+// The table name and consistency levels are taken from "conf".
+func NewCQLEventStore(session *gocql.Session, conf *DutyCalConfig) (
+	*CQLEventStore, error) {
+	var s *CQLEventStore = &CQLEventStore{
+		session: session,
+		conf:    conf,
+	}
+	var err error
+
+	s.readConsistency, err = gocql.ParseConsistencyWrapper(
+		conf.GetCql().GetReadConsistency())
+	if err != nil {
+		return nil, err
+	}
+
+	s.writeConsistency, err = gocql.ParseConsistencyWrapper(
+		conf.GetCql().GetWriteConsistency())
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// OpenCQLEventStore connects to the CQL servers configured in "conf". The
+// keyspace and credentials are shared with the Thrift configuration.
+func OpenCQLEventStore(conf *DutyCalConfig) (*CQLEventStore, error) {
+	var cluster *gocql.ClusterConfig
+	var auth gocql.PasswordAuthenticator
+	var cred *CassandraCredentials
+	var session *gocql.Session
+	var s *CQLEventStore
+	var err error
+
+	cluster = gocql.NewCluster(conf.GetCql().GetServer()...)
+	cluster.Keyspace = conf.GetKeyspace()
+	cluster.Timeout = time.Duration(conf.GetCql().GetTimeoutMs()) *
+		time.Millisecond
+	cluster.ProtoVersion = int(conf.GetCql().GetProtocolVersion())
+
+	for _, cred = range conf.GetDbCredentials() {
+		if cred.GetKey() == "username" {
+			auth.Username = cred.GetValue()
+		} else if cred.GetKey() == "password" {
+			auth.Password = cred.GetValue()
+		}
+	}
+	if len(auth.Username) > 0 {
+		cluster.Authenticator = auth
+	}
+
+	if conf.GetCql().GetTls() {
+		cluster.SslOpts = &gocql.SslOptions{
+			CertPath:               conf.GetCql().GetTlsCertFile(),
+			KeyPath:                conf.GetCql().GetTlsKeyFile(),
+			CaPath:                 conf.GetCql().GetTlsCaCertificate(),
+			EnableHostVerification: conf.GetCql().GetTlsVerifyHostname(),
+		}
+	}
+
+	session, err = cluster.CreateSession()
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to %s: %s",
+			strings.Join(conf.GetCql().GetServer(), ", "), err)
+	}
+
+	s, err = NewCQLEventStore(session, conf)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Pick the consistency level for reads.
+func (s *CQLEventStore) consistency(quorum bool) gocql.Consistency {
+	if quorum {
+		return s.writeConsistency
+	}
+	return s.readConsistency
+}
+
+// Reconstruct an event from a row containing cqlEventColumns, using the
+// "scan" function of either a query or an iterator.
+func (s *CQLEventStore) scanEvent(scan func(...interface{}) error,
+	loc *time.Location) (*Event, error) {
+	var e *Event = &Event{
+		store:    s,
+		location: loc,
+	}
+	var end time.Time
+	var owner, reference string
+	var ownerTS int64
+	var err error
+
+	err = scan(&e.ID, &e.Title, &e.Description, &owner, &e.Start,
+		&end, &e.Required, &reference, &e.GeneratorID, &e.MinStaff,
+		&e.MaxStaff, &e.updateTS, &ownerTS)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deleting the event must also remove owners who signed up later.
+	if ownerTS > e.updateTS {
+		e.updateTS = ownerTS
+	}
+
+	e.setOwnerColumn(owner)
+	e.normalizeStaff()
+	e.Start = e.Start.In(loc)
+	e.Duration = end.Sub(e.Start)
+	if len(reference) > 0 {
+		e.Reference, _ = url.Parse(reference)
+	}
+
+	return e, nil
+}
+
+// FetchEvent recreates the in-memory event object for the record "id". If
+// "quorum" is specified, the configured write consistency level will be
+// used for reading, otherwise the read consistency level.
+func (s *CQLEventStore) FetchEvent(id string, loc *time.Location,
+	quorum bool) (*Event, error) {
+	var e *Event
+	var err error
+
+	e, err = s.scanEvent(s.session.Query(
+		"SELECT "+cqlEventColumns+" FROM "+
+			s.conf.GetEventsColumnFamily()+" WHERE key = ?", id).
+		Consistency(s.consistency(quorum)).Scan, loc)
+	if err == gocql.ErrNotFound {
+		return nil, ErrEventNotFound
+	}
+
+	return e, err
+}
+
+// FetchEventRange retrieves a list of all events between the two specified
+// dates, sorted by start time. If a limit is given, only up to that many
+// records will be returned. If "user" is not nil, the specified user must be
+// one of the owners, or if it is empty, the event must need more owners.
+//
+// Just like with the Thrift API, every week bucket touched by the range is
+// queried separately, and open ranges are limited to
+// open_range_lookahead_weeks weeks.
+func (s *CQLEventStore) FetchEventRange(from, to time.Time, limit int32,
+	loc *time.Location, user *string, quorum bool) ([]*Event, error) {
+	var first, last int64
+
+	first, last = eventWeekRange(from, to, loc,
+		int64(s.conf.GetOpenRangeLookaheadWeeks()),
+		int64(s.conf.GetMaxEventDurationWeeks()))
+
+	return fetchWeeks(first, last, limit, user,
+		func(week int64) ([]*Event, error) {
+			return s.fetchWeek(week, from, to, loc, quorum)
+		})
+}
+
+// Fetch all events overlapping the time range from "from" to "to" which are
+// filed under the week bucket "week".
+func (s *CQLEventStore) fetchWeek(week int64, from, to time.Time,
+	loc *time.Location, quorum bool) ([]*Event, error) {
+	var conditions []string = []string{"week = ?"}
+	var args []interface{} = []interface{}{week}
+	var scanner gocql.Scanner
+	var iter *gocql.Iter
+	var rv []*Event
+	var err error
+
+	if to.Unix() != 0 {
+		conditions = append(conditions, "start <= ?")
+		args = append(args, to)
+	}
+	if from.Unix() != 0 {
+		conditions = append(conditions, "\"end\" >= ?")
+		args = append(args, from)
+	}
+
+	// The driver fetches further pages as the results are read, so busy
+	// weeks aren't cut off.
+	iter = s.session.Query(fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s ALLOW FILTERING",
+		cqlEventColumns, s.conf.GetEventsColumnFamily(),
+		strings.Join(conditions, " AND ")), args...).
+		PageSize(int(s.conf.GetMaxEventsPerDay() * 7)).
+		Consistency(s.consistency(quorum)).Iter()
+
+	scanner = iter.Scanner()
+	for scanner.Next() {
+		var e *Event
+
+		e, err = s.scanEvent(scanner.Scan, loc)
+		if err != nil {
+			iter.Close()
+			return rv, err
+		}
+
+		rv = append(rv, e)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return rv, err
+	}
+
+	return rv, nil
+}
+
+// SyncEvent writes the modified event object back to the database.
+func (s *CQLEventStore) SyncEvent(e *Event) error {
+	return s.writeEvent(e)
+}
+
+// SyncDetails writes the modified event object back to the database,
+// except for the owner column, using a lightweight transaction on the
+// owners of "expected".
+func (s *CQLEventStore) SyncDetails(e *Event, expected *Event) error {
+	var current map[string]interface{} = make(map[string]interface{})
+	var reference interface{}
+	var applied bool
+	var err error
+
+	// A missing reference or generator ID clears the stored one.
+	if e.Reference != nil {
+		reference = e.Reference.String()
+	}
+
+	applied, err = s.session.Query(fmt.Sprintf(
+		"UPDATE %s SET title = ?, description = ?, start = ?, \"end\" = ?, "+
+			"required = ?, week = ?, minstaff = ?, maxstaff = ?, "+
+			"reference = ?, generatorid = ? WHERE key = ? IF owner = ?",
+		s.conf.GetEventsColumnFamily()),
+		e.Title, e.Description, e.Start, e.Start.Add(e.Duration),
+		e.Required, getWeekFromTimestamp(e.Start), e.MinStaff, e.MaxStaff,
+		reference, e.GeneratorID, e.ID, expected.ownerColumn()).
+		Consistency(s.writeConsistency).MapScanCAS(current)
+	if err != nil {
+		return err
+	}
+	if !applied && len(current) == 0 {
+		return ErrEventNotFound
+	} else if !applied {
+		return ErrOwnerChanged
+	}
+
+	// See SyncOwners for why the timestamp has to be read back.
+	return s.session.Query(fmt.Sprintf(
+		"SELECT WRITETIME(title) FROM %s WHERE key = ?",
+		s.conf.GetEventsColumnFamily()), e.ID).
+		Consistency(gocql.Consistency(gocql.Serial)).Scan(&e.updateTS)
+}
+
+// Write all columns of the event "e" to the database.
+func (s *CQLEventStore) writeEvent(e *Event) error {
+	var columns []string = []string{
+		"key", "title", "description", "owner", "start", "\"end\"",
+		"required", "week", "minstaff", "maxstaff",
+	}
+	var args []interface{} = []interface{}{
+		e.ID, e.Title, e.Description, e.ownerColumn(), e.Start,
+		e.Start.Add(e.Duration), e.Required, getWeekFromTimestamp(e.Start),
+		e.MinStaff, e.MaxStaff,
+	}
+	var ts int64
+	var err error
+
+	// Timestamps should be in microseconds.
+	ts = time.Now().UnixNano() / 1000
+
+	if e.Reference != nil {
+		columns = append(columns, "reference")
+		args = append(args, e.Reference.String())
+	}
+	if len(e.GeneratorID) > 0 {
+		columns = append(columns, "generatorid")
+		args = append(args, e.GeneratorID)
+	}
+
+	err = s.session.Query(fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (?%s) USING TIMESTAMP %d",
+		s.conf.GetEventsColumnFamily(), strings.Join(columns, ", "),
+		strings.Repeat(", ?", len(columns)-1), ts), args...).
+		Consistency(s.writeConsistency).Exec()
+	if err != nil {
+		return err
+	}
+
+	// Update the update timestamp in case we want to delete the event again.
+	e.updateTS = ts
+
+	return nil
+}
+
+// DeleteEvent deletes the database representation of the event.
+func (s *CQLEventStore) DeleteEvent(e *Event) error {
+	if e.updateTS == 0 {
+		return errors.New("Object not synced to database yet")
+	}
+
+	return s.session.Query(fmt.Sprintf(
+		"DELETE FROM %s USING TIMESTAMP %d WHERE key = ?",
+		s.conf.GetEventsColumnFamily(), e.updateTS), e.ID).
+		Consistency(s.writeConsistency).Exec()
+}
+
+// SyncOwners changes the owners and handover offers of the stored event to
+// those of "e" if they are still those of "expected", using a lightweight
+// transaction.
+func (s *CQLEventStore) SyncOwners(e *Event, expected *Event) error {
+	var current string
+	var applied bool
+	var err error
+
+	applied, err = s.session.Query(fmt.Sprintf(
+		"UPDATE %s SET owner = ? WHERE key = ? IF owner = ?",
+		s.conf.GetEventsColumnFamily()), e.ownerColumn(), e.ID,
+		expected.ownerColumn()).
+		Consistency(s.writeConsistency).ScanCAS(&current)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return ErrOwnerChanged
+	}
+
+	// Lightweight transactions pick their own timestamp, which we need
+	// to know in case the event is deleted later. A serial read sees the
+	// result of the transaction; gocql only has a separate type for the
+	// serial consistency levels, but they are sent the same way.
+	return s.session.Query(fmt.Sprintf(
+		"SELECT WRITETIME(owner) FROM %s WHERE key = ?",
+		s.conf.GetEventsColumnFamily()), e.ID).
+		Consistency(gocql.Consistency(gocql.Serial)).Scan(&e.updateTS)
+}
+
+// AppendHistory adds the entry "h" to the history table, both to the
+// partition of the event and to the partition of the current day. The
+// layout is the same as the one used through Thrift.
+func (s *CQLEventStore) AppendHistory(h *HistoryEntry) error {
+	var r *historyRecord = newHistoryRecord(h)
+	var batch *gocql.Batch
+	var name, value []byte
+	var key string
+	var err error
+
+	value, err = json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	name = historyColumnName(r)
+
+	batch = s.session.NewBatch(gocql.LoggedBatch)
+	batch.Cons = s.writeConsistency
+	for _, key = range []string{
+		historyEventKey(r.EventID), historyDayKey(historyDay(h.Time))} {
+		batch.Query(fmt.Sprintf(
+			"INSERT INTO %s (key, column1, value) VALUES (?, ?, ?)",
+			s.conf.GetHistoryColumnFamily()), key, name, string(value))
+	}
+
+	return s.session.ExecuteBatch(batch)
+}
+
+// Read up to "count" history entries from the partition "key", most recent
+// first.
+func (s *CQLEventStore) fetchHistoryRow(key string, count int32,
+	loc *time.Location) ([]*HistoryEntry, error) {
+	var iter *gocql.Iter
+	var value string
+	var rv []*HistoryEntry
+	var err error
+
+	iter = s.session.Query(fmt.Sprintf(
+		"SELECT value FROM %s WHERE key = ? ORDER BY column1 DESC LIMIT %d",
+		s.conf.GetHistoryColumnFamily(), count), key).
+		Consistency(s.readConsistency).Iter()
+
+	for iter.Scan(&value) {
+		var rec historyRecord
+
+		err = json.Unmarshal([]byte(value), &rec)
+		if err != nil {
+			iter.Close()
+			return rv, err
+		}
+
+		rv = append(rv, rec.toEntry(loc))
+	}
+
+	return rv, iter.Close()
+}
+
+// FetchHistory retrieves all history entries for the event "id", most
+// recent first.
+func (s *CQLEventStore) FetchHistory(id string, loc *time.Location) (
+	[]*HistoryEntry, error) {
+	return s.fetchHistoryRow(historyEventKey(id), maxHistoryRowEntries, loc)
+}
+
+// FetchRecentHistory retrieves up to "limit" history entries recorded
+// after "since", most recent first. The partitions of all days since then
+// are read one by one, starting from today.
+func (s *CQLEventStore) FetchRecentHistory(since time.Time, limit int32,
+	loc *time.Location) ([]*HistoryEntry, error) {
+	var day int64
+	var rv []*HistoryEntry
+	var err error
+
+	for day = historyDay(time.Now()); day >= historyDay(since); day-- {
+		var entries []*HistoryEntry
+		var h *HistoryEntry
+
+		entries, err = s.fetchHistoryRow(historyDayKey(day),
+			maxHistoryRowEntries, loc)
+		if err != nil {
+			return rv, err
+		}
+
+		for _, h = range entries {
+			if h.Time.Before(since) {
+				return rv, nil
+			}
+			if limit > 0 && int32(len(rv)) >= limit {
+				return rv, nil
+			}
+			rv = append(rv, h)
+		}
+	}
+
+	return rv, nil
+}
@@ -2,37 +2,35 @@ package dutycal
 
 import (
 	"crypto/sha256"
-	"database/cassandra"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/url"
+	"strings"
 	"time"
 )
 
-var eventAllColumns [][]byte = [][]byte{
-	[]byte("title"), []byte("description"), []byte("owner"),
-	[]byte("start"), []byte("end"), []byte("required"), []byte("week"),
-	[]byte("reference"), []byte("generatorID"),
-}
-
 // Event is an object representing individual event calendar entries.
-// They can be loaded from database or written to it.
+// They can be loaded from an EventStore or written to it.
 type Event struct {
-	db   *cassandra.RetryCassandraClient
-	conf *DutyCalConfig
+	store EventStore
 
 	ID          string
 	Title       string
 	Description string
 	Start       time.Time
 	Duration    time.Duration
-	Owner       string
+	Owners      []string
+	Handovers   []Handover
 	Reference   *url.URL
 	Required    bool
 	GeneratorID []byte
 
+	// Number of owners the event needs to be staffed, and the number of
+	// owners it can take at most.
+	MinStaff int32
+	MaxStaff int32
+
 	location *time.Location
 	updateTS int64
 }
@@ -44,14 +42,14 @@ func getWeekFromTimestamp(ts time.Time) int64 {
 	return ts.Add(time.Duration(offset)*time.Second).Add(3*24*time.Hour).Unix() / (7 * 24 * 60 * 60)
 }
 
-// CreateEvent creates a new event with the speicfied details.
-func CreateEvent(db *cassandra.RetryCassandraClient, conf *DutyCalConfig,
+// CreateEvent creates a new event with the speicfied details. It will be
+// written to "store" once Sync() is called.
+func CreateEvent(store EventStore,
 	title, description, owner string,
 	start time.Time, duration time.Duration, location *time.Location,
 	reference *url.URL, required bool) *Event {
-	return &Event{
-		db:   db,
-		conf: conf,
+	var e *Event = &Event{
+		store: store,
 
 		location: location,
 
@@ -59,203 +57,194 @@ func CreateEvent(db *cassandra.RetryCassandraClient, conf *DutyCalConfig,
 		Description: description,
 		Start:       start.In(location),
 		Duration:    duration,
-		Owner:       owner,
 		Reference:   reference,
 		Required:    required,
+		MinStaff:    1,
+		MaxStaff:    1,
 	}
-}
 
-// FetchEvent recreates in-memory event objects from the database. The record
-// "id" is read from the database designated as "db" as specified in the
-// configuration "conf". If "quorum" is specified, a quorum read from the
-// database will be performed rather than just reading from a single replica.
-func FetchEvent(db *cassandra.RetryCassandraClient, conf *DutyCalConfig,
-	id string, loc *time.Location, quorum bool) (
-	rv *Event, err error) {
-	var cp *cassandra.ColumnParent = cassandra.NewColumnParent()
-	var pred *cassandra.SlicePredicate = cassandra.NewSlicePredicate()
-	var cl cassandra.ConsistencyLevel
-	var r []*cassandra.ColumnOrSuperColumn
-
-	cp.ColumnFamily = conf.GetEventsColumnFamily()
-	pred.ColumnNames = eventAllColumns
-
-	if quorum {
-		cl = cassandra.ConsistencyLevel_QUORUM
-	} else {
-		cl = cassandra.ConsistencyLevel_ONE
+	if len(owner) > 0 {
+		e.Owners = []string{owner}
 	}
 
-	r, err = db.GetSlice([]byte(id), cp, pred, cl)
-	if err != nil {
-		return
-	}
+	return e
+}
 
-	rv = &Event{
-		db:   db,
-		conf: conf,
-		ID:   id,
-	}
-	err = rv.extractFromColumns(r, loc)
-	return
+// Handover is an offer by one of the owners of an event to hand their
+// place over to another member. The offering owner stays an owner until
+// someone accepts, so the slot is never left unowned.
+type Handover struct {
+	// The owner offering their place.
+	From string
+
+	// The member the place is offered to. Empty if anyone may accept.
+	To string
 }
 
-// FetchEventRange retrieves a list of all events between the two specified
-// dates. If a limit is given, only up to that many records will be returned.
-// If "user" is not nil, the user must match the specified user (e.g. an empty
-// string for unassigned slots).
-func FetchEventRange(db *cassandra.RetryCassandraClient, conf *DutyCalConfig,
-	from, to time.Time, limit int32, loc *time.Location, user *string,
-	quorum bool) ([]*Event, error) {
-	var parent *cassandra.ColumnParent
-	var clause *cassandra.IndexClause
-	var predicate *cassandra.SlicePredicate
-	var expr *cassandra.IndexExpression
-	var cl cassandra.ConsistencyLevel
-
-	var res []*cassandra.KeySlice
-	var err error
+// Separator between owners when the list is stored in a single column.
+const ownerSeparator = ","
 
-	var ks *cassandra.KeySlice
-	var rv []*Event
-	var duration time.Duration
+// Separator between an owner and the member they offered their place to,
+// for owners who have offered a handover.
+const handoverSeparator = ">"
 
-	if to.Unix() != 0 && from.After(to) {
-		duration = from.Sub(to)
-	} else {
-		duration = to.Sub(from)
+// Check whether "user" can be stored in the owner column at all.
+func checkOwnerName(user string) error {
+	if strings.ContainsAny(user, ownerSeparator+handoverSeparator) {
+		return fmt.Errorf("User name %q cannot be stored as an owner", user)
 	}
+	return nil
+}
 
-	parent = cassandra.NewColumnParent()
-	parent.ColumnFamily = conf.GetEventsColumnFamily()
-	clause = cassandra.NewIndexClause()
-	// TODO(caoimhe): this could start from the start timestamp…
-	clause.StartKey = make([]byte, 0)
-	if limit > 0 {
-		clause.Count = limit
-	} else {
-		clause.Count = int32(
-			(conf.GetMaxEventsPerDay()*int32(duration.Hours()))/24) + 1
-	}
-	predicate = cassandra.NewSlicePredicate()
-	predicate.ColumnNames = eventAllColumns
-
-	expr = cassandra.NewIndexExpression()
-	expr.ColumnName = []byte("week")
-	expr.Op = cassandra.IndexOperator_EQ
-	expr.Value = make([]byte, 8)
-	binary.BigEndian.PutUint64(expr.Value, uint64(getWeekFromTimestamp(from)))
-	clause.Expressions = append(clause.Expressions, expr)
-
-	if user != nil {
-		expr = cassandra.NewIndexExpression()
-		expr.ColumnName = []byte("owner")
-		expr.Op = cassandra.IndexOperator_EQ
-		expr.Value = []byte(*user)
-		clause.Expressions = append(clause.Expressions, expr)
-	}
+// Join the list of owners and their handover offers for storing them in a
+// single column. Owners who offered their place are written as
+// "owner>recipient", with an empty recipient if anyone may accept.
+func (e *Event) ownerColumn() string {
+	var owners []string
+	var owner string
 
-	if to.Unix() != 0 {
-		expr = cassandra.NewIndexExpression()
-		expr.ColumnName = []byte("start")
-		expr.Op = cassandra.IndexOperator_LTE
-		expr.Value = make([]byte, 8)
-		binary.BigEndian.PutUint64(expr.Value, uint64(to.Unix()*1000))
-		clause.Expressions = append(clause.Expressions, expr)
+	for _, owner = range e.Owners {
+		var h *Handover = e.HandoverFrom(owner)
+
+		if h != nil {
+			owner += handoverSeparator + h.To
+		}
+		owners = append(owners, owner)
 	}
 
-	if from.Unix() != 0 {
-		expr = cassandra.NewIndexExpression()
-		expr.ColumnName = []byte("end")
-		expr.Op = cassandra.IndexOperator_GTE
-		expr.Value = make([]byte, 8)
-		binary.BigEndian.PutUint64(expr.Value, uint64(from.Unix()*1000))
-		clause.Expressions = append(clause.Expressions, expr)
+	return strings.Join(owners, ownerSeparator)
+}
+
+// Split the owners and handover offers stored in a single column. Records
+// from before there could be multiple owners just contain the owner name.
+func (e *Event) setOwnerColumn(column string) {
+	var owner string
+
+	e.Owners = nil
+	e.Handovers = nil
+	if len(column) == 0 {
+		return
 	}
 
-	if quorum {
-		cl = cassandra.ConsistencyLevel_QUORUM
-	} else {
-		cl = cassandra.ConsistencyLevel_ONE
+	for _, owner = range strings.Split(column, ownerSeparator) {
+		var parts []string = strings.SplitN(owner, handoverSeparator, 2)
+
+		e.Owners = append(e.Owners, parts[0])
+		if len(parts) > 1 {
+			e.Handovers = append(e.Handovers, Handover{
+				From: parts[0],
+				To:   parts[1],
+			})
+		}
 	}
+}
 
-	res, err = db.GetIndexedSlices(
-		parent, clause, predicate, cl)
-	if err != nil {
-		return []*Event{}, err
+// Fill in the staffing limits for records which were written before they
+// existed: these had exactly one owner.
+func (e *Event) normalizeStaff() {
+	if e.MinStaff < 1 {
+		e.MinStaff = 1
 	}
+	if e.MaxStaff < e.MinStaff {
+		e.MaxStaff = e.MinStaff
+	}
+}
 
-	for _, ks = range res {
-		var e *Event = &Event{
-			db:   db,
-			conf: conf,
-			ID:   string(ks.Key),
-		}
+// HasOwner determines whether "user" is one of the owners of the event.
+func (e *Event) HasOwner(user string) bool {
+	var owner string
 
-		err = e.extractFromColumns(ks.Columns, loc)
-		if err != nil {
-			return rv, err
+	for _, owner = range e.Owners {
+		if owner == user {
+			return true
 		}
-
-		rv = append(rv, e)
 	}
 
-	return rv, nil
+	return false
 }
 
-// Extract event data from a number of columns.
-func (e *Event) extractFromColumns(r []*cassandra.ColumnOrSuperColumn,
-	loc *time.Location) error {
-	var cos *cassandra.ColumnOrSuperColumn
-	var end time.Time
-
-	for _, cos = range r {
-		var col *cassandra.Column = cos.Column
-		var cname string
+// HandoverFrom returns the pending handover offer of the owner "user", or
+// nil if they haven't offered their place.
+func (e *Event) HandoverFrom(user string) *Handover {
+	var i int
 
-		if col == nil {
-			continue
+	for i = range e.Handovers {
+		if e.Handovers[i].From == user {
+			return &e.Handovers[i]
 		}
+	}
 
-		cname = string(col.Name)
-		if col.IsSetTimestamp() {
-			e.updateTS = col.GetTimestamp()
-		}
+	return nil
+}
+
+// HandoversFor lists the pending handover offers which "user" could accept,
+// i.e. those made to them or to anyone. Owners can't accept a second place.
+func (e *Event) HandoversFor(user string) []Handover {
+	var rv []Handover
+	var h Handover
+
+	if len(user) == 0 || e.HasOwner(user) {
+		return nil
+	}
 
-		if cname == "title" {
-			e.Title = string(col.Value)
-		} else if cname == "description" {
-			e.Description = string(col.Value)
-		} else if cname == "owner" {
-			e.Owner = string(col.Value)
-		} else if cname == "start" {
-			var start int64
-
-			start = int64(binary.BigEndian.Uint64(col.Value))
-			e.Start = time.Unix(start/1000, (start%1000)*1000).In(loc)
-		} else if cname == "end" {
-			var endTS int64
-
-			endTS = int64(binary.BigEndian.Uint64(col.Value))
-			end = time.Unix(endTS/1000, (endTS%1000)*1000).In(loc)
-		} else if cname == "reference" {
-			e.Reference, _ = url.Parse(string(col.Value))
-		} else if cname == "required" {
-			e.Required = (len(col.Value) > 0 && col.Value[0] > 0)
-		} else if cname == "generatorID" {
-			e.GeneratorID = col.Value
+	for _, h = range e.Handovers {
+		if len(h.To) == 0 || h.To == user {
+			rv = append(rv, h)
 		}
 	}
 
-	if e.Start.After(end) {
-		e.Duration = e.Start.Sub(end)
-		e.Start = end
-	} else {
-		e.Duration = end.Sub(e.Start)
+	return rv
+}
+
+// IsUnderstaffed determines whether the event still needs more owners to
+// reach its minimum staffing. Such events count as unassigned.
+func (e *Event) IsUnderstaffed() bool {
+	return int32(len(e.Owners)) < e.MinStaff
+}
+
+// IsFull determines whether the event has as many owners as it can take.
+func (e *Event) IsFull() bool {
+	return int32(len(e.Owners)) >= e.MaxStaff
+}
+
+// Check whether the event matches the "user" filter of FetchEventRange:
+// nil matches everything, an empty string matches understaffed events, and
+// anything else matches the events owned by that user.
+func (e *Event) matchesUser(user *string) bool {
+	if user == nil {
+		return true
+	} else if len(*user) == 0 {
+		return e.IsUnderstaffed()
 	}
-	e.location = loc
 
-	return nil
+	return e.HasOwner(*user)
+}
+
+// FetchEvent recreates in-memory event objects from the database. The record
+// "id" is read from the event store "store". If "quorum" is specified, a
+// quorum read from the database will be performed rather than just reading
+// from a single replica.
+func FetchEvent(store EventStore, id string, loc *time.Location,
+	quorum bool) (*Event, error) {
+	return store.FetchEvent(id, loc, quorum)
+}
+
+// FetchEventRange retrieves a list of all events between the two specified
+// dates. If a limit is given, only up to that many records will be returned.
+// If "user" is not nil, the specified user must be one of the owners, or if
+// it is an empty string, the event must still need more owners.
+func FetchEventRange(store EventStore, from, to time.Time, limit int32,
+	loc *time.Location, user *string, quorum bool) ([]*Event, error) {
+	return store.FetchEventRange(from, to, limit, loc, user, quorum)
+}
+
+// eventsByStart sorts events by their start time.
+type eventsByStart []*Event
+
+func (e eventsByStart) Len() int      { return len(e) }
+func (e eventsByStart) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e eventsByStart) Less(i, j int) bool {
+	return e[i].Start.Before(e[j].Start)
 }
 
 // Generate an event ID (but don't overwrite it).
@@ -271,168 +260,253 @@ func (e *Event) genEventID() string {
 
 // Sync writes the modified event object back to the database.
 func (e *Event) Sync() error {
-	var mmap map[string]map[string][]*cassandra.Mutation
-	var mutations []*cassandra.Mutation
-	var mutation *cassandra.Mutation
-	var col *cassandra.Column
-	var ts int64
-	var err error
+	if e.store == nil {
+		return errors.New("Event is not associated with an event store")
+	}
 
 	if len(e.ID) == 0 {
 		e.ID = e.genEventID()
 	}
 
-	// Timestamps should be in microseconds.
-	ts = time.Now().UnixNano() / 1000
-
-	col = cassandra.NewColumn()
-	col.Name = []byte("title")
-	col.Value = []byte(e.Title)
-	col.Timestamp = &ts
-
-	mutation = cassandra.NewMutation()
-	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mutation.ColumnOrSupercolumn.Column = col
-	mutations = append(mutations, mutation)
-
-	col = cassandra.NewColumn()
-	col.Name = []byte("description")
-	col.Value = []byte(e.Description)
-	col.Timestamp = &ts
-
-	mutation = cassandra.NewMutation()
-	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mutation.ColumnOrSupercolumn.Column = col
-	mutations = append(mutations, mutation)
-
-	col = cassandra.NewColumn()
-	col.Name = []byte("owner")
-	col.Value = []byte(e.Owner)
-	col.Timestamp = &ts
-
-	mutation = cassandra.NewMutation()
-	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mutation.ColumnOrSupercolumn.Column = col
-	mutations = append(mutations, mutation)
-
-	col = cassandra.NewColumn()
-	col.Name = []byte("start")
-	col.Value = make([]byte, 8)
-	binary.BigEndian.PutUint64(
-		col.Value, uint64(e.Start.Unix()*1000))
-	col.Timestamp = &ts
-
-	mutation = cassandra.NewMutation()
-	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mutation.ColumnOrSupercolumn.Column = col
-	mutations = append(mutations, mutation)
-
-	col = cassandra.NewColumn()
-	col.Name = []byte("end")
-	col.Value = make([]byte, 8)
-	binary.BigEndian.PutUint64(
-		col.Value, uint64(e.Start.Add(e.Duration).Unix()*1000))
-	col.Timestamp = &ts
-
-	mutation = cassandra.NewMutation()
-	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mutation.ColumnOrSupercolumn.Column = col
-	mutations = append(mutations, mutation)
-
-	col = cassandra.NewColumn()
-	col.Name = []byte("required")
-	if e.Required {
-		col.Value = []byte{1}
-	} else {
-		col.Value = []byte{0}
+	return e.store.SyncEvent(e)
+}
+
+// SyncDetails writes the modified event object back to the database, but
+// leaves the owners and handover offers alone. It only does so if the
+// owners are still those of "expected", the event as it was read, so the
+// changes are based on the current owners. Returns ErrOwnerChanged if
+// someone signed up or left in the meantime.
+func (e *Event) SyncDetails(expected *Event) error {
+	if e.store == nil {
+		return errors.New("Event is not associated with an event store")
+	}
+
+	return e.store.SyncDetails(e, expected)
+}
+
+// SyncEdit writes the changes made to the event since it was read as
+// "before" back to the database, leaving the owners alone just like
+// SyncDetails. If the event was moved to a different time though, its
+// owners are dropped, since they signed up for the old time. Returns the
+// dropped owners so they can be told, or ErrOwnerChanged if the owners
+// changed since the event was read.
+func (e *Event) SyncEdit(before *Event) ([]string, error) {
+	var err error
+
+	err = e.SyncDetails(before)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Start.Equal(before.Start) && e.Duration == before.Duration {
+		return nil, nil
+	}
+
+	return e.ClearOwners()
+}
+
+// Delete the database representation of the event.
+func (e *Event) Delete() error {
+	if e.store == nil {
+		return errors.New("Event is not associated with an event store")
+	}
+
+	return e.store.DeleteEvent(e)
+}
+
+// SyncOwners writes the new owners and handover offers of the event back
+// to the database, but only if nobody has changed them from those of
+// "expected" in the meantime. Returns ErrOwnerChanged if someone else was
+// faster.
+func (e *Event) SyncOwners(expected *Event) error {
+	if e.store == nil {
+		return errors.New("Event is not associated with an event store")
 	}
-	col.Timestamp = &ts
-
-	mutation = cassandra.NewMutation()
-	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mutation.ColumnOrSupercolumn.Column = col
-	mutations = append(mutations, mutation)
-
-	col = cassandra.NewColumn()
-	col.Name = []byte("week")
-	col.Value = make([]byte, 8)
-	binary.BigEndian.PutUint64(
-		col.Value, uint64(getWeekFromTimestamp(e.Start)))
-	col.Timestamp = &ts
-
-	mutation = cassandra.NewMutation()
-	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mutation.ColumnOrSupercolumn.Column = col
-	mutations = append(mutations, mutation)
-
-	if e.Reference != nil {
-		col = cassandra.NewColumn()
-		col.Name = []byte("reference")
-		col.Value = []byte(e.Reference.String())
-		col.Timestamp = &ts
-
-		mutation = cassandra.NewMutation()
-		mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-		mutation.ColumnOrSupercolumn.Column = col
-		mutations = append(mutations, mutation)
+
+	return e.store.SyncOwners(e, expected)
+}
+
+// Number of attempts to change the owners of an event before giving up
+// because other people keep changing them at the same time.
+const maxOwnerChangeAttempts = 5
+
+// Apply "change" to the owners and handover offers of the event and write
+// them back. If someone else changes them at the same time, the event is
+// read again and "change" is applied to the new state instead. "change"
+// may return an error if the change is no longer possible.
+func (e *Event) changeOwners(change func(e *Event) error) error {
+	var attempt int
+	var err error
+
+	if e.store == nil {
+		return errors.New("Event is not associated with an event store")
 	}
 
-	if len(e.GeneratorID) > 0 {
-		col = cassandra.NewColumn()
-		col.Name = []byte("generatorID")
-		col.Value = e.GeneratorID
-		col.Timestamp = &ts
+	for attempt = 0; attempt < maxOwnerChangeAttempts; attempt++ {
+		var expected Event
 
-		mutation = cassandra.NewMutation()
-		mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-		mutation.ColumnOrSupercolumn.Column = col
-		mutations = append(mutations, mutation)
+		if attempt > 0 {
+			var current *Event
+
+			current, err = e.store.FetchEvent(e.ID, e.location, true)
+			if err != nil {
+				return err
+			}
+			*e = *current
+		}
+
+		// Work on copies so "expected" keeps the state from the database.
+		expected = *e
+		e.Owners = append([]string{}, expected.Owners...)
+		e.Handovers = append([]Handover{}, expected.Handovers...)
+		err = change(e)
+		if err != nil {
+			*e = expected
+			return err
+		}
+
+		err = e.store.SyncOwners(e, &expected)
+		if err != ErrOwnerChanged {
+			return err
+		}
 	}
 
-	mmap = make(map[string]map[string][]*cassandra.Mutation)
-	mmap[e.ID] = make(map[string][]*cassandra.Mutation)
-	mmap[e.ID][e.conf.GetEventsColumnFamily()] = mutations
+	return err
+}
+
+// Remove the handover offer of "user" from the event, if there is one.
+func (e *Event) dropHandover(user string) {
+	var rv []Handover
+	var h Handover
+
+	for _, h = range e.Handovers {
+		if h.From != user {
+			rv = append(rv, h)
+		}
+	}
+	e.Handovers = rv
+}
+
+// AddOwner signs "user" up as an additional owner of the event. Returns
+// ErrEventFull if the event has no room left, even after re-reading it
+// because someone else signed up at the same time.
+func (e *Event) AddOwner(user string) error {
+	var err error = checkOwnerName(user)
 
-	err = e.db.AtomicBatchMutate(mmap, cassandra.ConsistencyLevel_QUORUM)
 	if err != nil {
 		return err
 	}
 
-	// Update the update timestamp in case we want to delete the event again.
-	e.updateTS = ts
+	return e.changeOwners(func(e *Event) error {
+		if e.HasOwner(user) {
+			return nil
+		}
+		if e.IsFull() {
+			return ErrEventFull
+		}
+		e.Owners = append(e.Owners, user)
+		return nil
+	})
+}
 
-	return nil
+// RemoveOwner removes "user" from the owners of the event, leaving any
+// other owners in place. A pending handover offer of "user" is withdrawn.
+func (e *Event) RemoveOwner(user string) error {
+	return e.changeOwners(func(e *Event) error {
+		var rv []string
+		var owner string
+
+		for _, owner = range e.Owners {
+			if owner != user {
+				rv = append(rv, owner)
+			}
+		}
+		e.Owners = rv
+		e.dropHandover(user)
+		return nil
+	})
 }
 
-// Delete the database representation of the event.
-func (e *Event) Delete() error {
-	var sp *cassandra.SlicePredicate
-	var mmap map[string]map[string][]*cassandra.Mutation
-	var mutations []*cassandra.Mutation
-	var mutation *cassandra.Mutation
+// ClearOwners removes all owners and handover offers from the event, e.g.
+// because it was moved to a time they didn't sign up for. Returns the
+// owners which were removed, including anyone who signed up in the
+// meantime.
+func (e *Event) ClearOwners() ([]string, error) {
+	var dropped []string
 	var err error
 
-	if e.updateTS == 0 {
-		return errors.New("Object not synced to database yet")
+	err = e.changeOwners(func(e *Event) error {
+		dropped = e.Owners
+		e.Owners = nil
+		e.Handovers = nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	sp = cassandra.NewSlicePredicate()
-	sp.ColumnNames = eventAllColumns
+	return dropped, nil
+}
 
-	mutation = cassandra.NewMutation()
-	mutation.Deletion = cassandra.NewDeletion()
-	mutation.Deletion.Timestamp = &e.updateTS
-	mutation.Deletion.Predicate = sp
-	mutations = append(mutations, mutation)
+// OfferHandover offers the place of the owner "user" to the member "to",
+// or to anyone if "to" is empty. Any previous offer of "user" is replaced.
+// Returns ErrNotOwner if "user" is no longer an owner of the event.
+func (e *Event) OfferHandover(user, to string) error {
+	var err error = checkOwnerName(to)
 
-	mmap = make(map[string]map[string][]*cassandra.Mutation)
-	mmap[e.ID] = make(map[string][]*cassandra.Mutation)
-	mmap[e.ID][e.conf.GetEventsColumnFamily()] = mutations
+	if err != nil {
+		return err
+	}
+	if to == user {
+		return errors.New("Cannot hand over a shift to oneself")
+	}
+
+	return e.changeOwners(func(e *Event) error {
+		if !e.HasOwner(user) {
+			return ErrNotOwner
+		}
+		e.dropHandover(user)
+		e.Handovers = append(e.Handovers, Handover{From: user, To: to})
+		return nil
+	})
+}
+
+// WithdrawHandover withdraws the pending handover offer of "user", if any.
+func (e *Event) WithdrawHandover(user string) error {
+	return e.changeOwners(func(e *Event) error {
+		e.dropHandover(user)
+		return nil
+	})
+}
+
+// AcceptHandover makes "user" take over the place of "from", who must have
+// offered it to them or to anyone. Both happen in a single update, so the
+// place is never unowned. Returns ErrHandoverGone if the offer has been
+// withdrawn or accepted by someone else in the meantime.
+func (e *Event) AcceptHandover(from, user string) error {
+	var err error = checkOwnerName(user)
 
-	err = e.db.AtomicBatchMutate(mmap, cassandra.ConsistencyLevel_QUORUM)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return e.changeOwners(func(e *Event) error {
+		var h *Handover = e.HandoverFrom(from)
+		var i int
+
+		if h == nil || (len(h.To) > 0 && h.To != user) {
+			return ErrHandoverGone
+		}
+		if e.HasOwner(user) {
+			return ErrEventFull
+		}
+
+		for i = range e.Owners {
+			if e.Owners[i] == from {
+				e.Owners[i] = user
+			}
+		}
+		e.dropHandover(from)
+		return nil
+	})
 }
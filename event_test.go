@@ -0,0 +1,85 @@
+package dutycal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Edit of an event owned by alice and bob, and the owners dropped by it.
+type syncEditTest struct {
+	name    string
+	edit    func(e *Event)
+	dropped []string
+}
+
+func TestSyncEdit(t *testing.T) {
+	var start time.Time = time.Date(2027, 3, 2, 18, 0, 0, 0, time.UTC)
+	var test syncEditTest
+	var tests = []syncEditTest{
+		{
+			name: "title changed",
+			edit: func(e *Event) {
+				e.Title = "Renamed"
+			},
+		},
+		{
+			name: "moved",
+			edit: func(e *Event) {
+				e.Title = "Renamed"
+				e.Start = e.Start.Add(time.Hour)
+			},
+			dropped: []string{"alice", "bob"},
+		},
+		{
+			name: "shortened",
+			edit: func(e *Event) {
+				e.Title = "Renamed"
+				e.Duration = time.Hour
+			},
+			dropped: []string{"alice", "bob"},
+		},
+		{
+			name: "same time in another time zone",
+			edit: func(e *Event) {
+				e.Title = "Renamed"
+				e.Start = e.Start.In(time.FixedZone("UTC+1", 3600))
+			},
+		},
+	}
+
+	for _, test = range tests {
+		var store *MemoryEventStore = NewMemoryEventStore()
+		var e *Event = CreateEvent(store, "Event", "Test event", "alice",
+			start, 2*time.Hour, time.UTC, nil, true)
+		var before Event
+		var dropped []string
+		var err error
+
+		e.Owners = append(e.Owners, "bob")
+		e.MaxStaff = 2
+		err = e.Sync()
+		if err != nil {
+			t.Fatal("Error writing event: ", err)
+		}
+
+		before = *e
+		test.edit(e)
+		dropped, err = e.SyncEdit(&before)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if strings.Join(dropped, ",") != strings.Join(test.dropped, ",") {
+			t.Errorf("%s: dropped %v, want %v", test.name, dropped,
+				test.dropped)
+		}
+		if test.dropped == nil {
+			checkStoredEvent(t, test.name, store, e.ID, "Renamed",
+				"alice,bob")
+		} else {
+			checkStoredEvent(t, test.name, store, e.ID, "Renamed", "")
+		}
+	}
+}
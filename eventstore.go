@@ -0,0 +1,128 @@
+package dutycal
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrEventNotFound is returned by FetchEvent if there is no event with the
+// requested ID.
+var ErrEventNotFound = errors.New("Event not found")
+
+// ErrOwnerChanged is returned by SyncOwners and SyncDetails if the owners
+// of the event in the database are no longer the expected ones, i.e.
+// someone else was faster.
+var ErrOwnerChanged = errors.New("Owners of the event have changed")
+
+// ErrEventChanged is returned by DeleteEvent if the event has been changed
+// since it was read, so it isn't deleted without looking at it again.
+var ErrEventChanged = errors.New("Event has been changed in the meantime")
+
+// ErrEventFull is returned when trying to sign up for an event which
+// already has as many owners as it can take.
+var ErrEventFull = errors.New("Event is already fully staffed")
+
+// ErrNotOwner is returned when trying to offer a shift for handover which
+// the user doesn't own (any more).
+var ErrNotOwner = errors.New("User is not an owner of the event")
+
+// ErrHandoverGone is returned when trying to accept a handover offer which
+// has been withdrawn or accepted by someone else in the meantime.
+var ErrHandoverGone = errors.New("Handover offer is no longer available")
+
+// EventStore is the interface to the database backend keeping the calendar
+// events. Events fetched from an EventStore remember where they came from,
+// so calling Sync() or Delete() on them will write back to the same store.
+type EventStore interface {
+	// FetchEvent recreates the in-memory event object for the record "id".
+	// Times will be converted to the location "loc". If "quorum" is
+	// specified, a consistent read will be performed if the backend
+	// supports it.
+	FetchEvent(id string, loc *time.Location, quorum bool) (*Event, error)
+
+	// FetchEventRange retrieves a list of all events between the two
+	// specified dates. If a limit is given, only up to that many records
+	// will be returned. If "user" is not nil, the specified user must be
+	// one of the owners, or if it is an empty string, the event must
+	// still need more owners (i.e. it counts as unassigned).
+	FetchEventRange(from, to time.Time, limit int32, loc *time.Location,
+		user *string, quorum bool) ([]*Event, error)
+
+	// SyncEvent writes the event "e" to the database, replacing any
+	// previous version of it. The event ID must already be set.
+	SyncEvent(e *Event) error
+
+	// SyncDetails writes all fields of the event "e" to the database
+	// except for its owners and handover offers, provided that the stored
+	// ones are still those of "expected". Otherwise, nothing is written
+	// and ErrOwnerChanged is returned, so changes which depend on the
+	// owners, like lowering the maximum number of them, can't race with
+	// people signing up. The event ID must already be set.
+	SyncDetails(e *Event, expected *Event) error
+
+	// DeleteEvent removes the database representation of the event "e".
+	// Backends which can tell return ErrEventChanged if it was changed
+	// since it was read.
+	DeleteEvent(e *Event) error
+
+	// SyncOwners atomically sets the owners and handover offers of the
+	// event "e" in the database to those of "e", provided that the stored
+	// ones are still those of "expected". Otherwise, nothing is written
+	// and ErrOwnerChanged is returned.
+	SyncOwners(e *Event, expected *Event) error
+
+	// AppendHistory adds the entry "h" to the change history.
+	AppendHistory(h *HistoryEntry) error
+
+	// FetchHistory retrieves all history entries for the event "id",
+	// most recent first. Times will be converted to the location "loc".
+	FetchHistory(id string, loc *time.Location) ([]*HistoryEntry, error)
+
+	// FetchRecentHistory retrieves up to "limit" history entries for any
+	// event which were recorded after "since", most recent first.
+	FetchRecentHistory(since time.Time, limit int32, loc *time.Location) (
+		[]*HistoryEntry, error)
+}
+
+// OpenEventStore opens the event store selected in the configuration "conf".
+// If an SQL database is configured, it is used. Otherwise, if a local
+// database path is configured, events are kept in a journal file there.
+// If neither is set, the configured Cassandra servers are used, through the
+// native CQL protocol if configured or else through Thrift.
+func OpenEventStore(conf *DutyCalConfig) (EventStore, error) {
+	var ss *SQLEventStore
+	var fs *MemoryEventStore
+	var qs *CQLEventStore
+	var cs *CassandraEventStore
+	var err error
+
+	if conf.GetSqlDatabase() != nil {
+		ss, err = OpenSQLEventStore(conf.GetSqlDatabase())
+		if err != nil {
+			return nil, err
+		}
+		return ss, nil
+	}
+
+	if len(conf.GetLocalDatabasePath()) > 0 {
+		fs, err = OpenFileEventStore(conf.GetLocalDatabasePath())
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
+	}
+
+	if conf.GetCql() != nil {
+		qs, err = OpenCQLEventStore(conf)
+		if err != nil {
+			return nil, err
+		}
+		return qs, nil
+	}
+
+	cs, err = OpenCassandraEventStore(conf)
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
@@ -0,0 +1,246 @@
+package dutycal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Range query and the titles of the events it must return, in order.
+type eventRangeTest struct {
+	name     string
+	from, to time.Time
+	limit    int32
+	user     *string
+	want     []string
+}
+
+// Add the events used by TestFetchEventRange implementations to "store".
+func addRangeTestEvents(t *testing.T, store EventStore, loc *time.Location) {
+	var events = []struct {
+		title    string
+		start    time.Time
+		duration time.Duration
+		owners   []string
+		minStaff int32
+	}{
+		{"long", time.Date(2027, 2, 25, 12, 0, 0, 0, loc),
+			7 * 24 * time.Hour, nil, 1},
+		{"early", time.Date(2027, 3, 1, 10, 0, 0, 0, loc), 2 * time.Hour,
+			nil, 1},
+		{"alice", time.Date(2027, 3, 2, 18, 0, 0, 0, loc), 2 * time.Hour,
+			[]string{"alice"}, 1},
+		{"pair", time.Date(2027, 3, 3, 18, 0, 0, 0, loc), 2 * time.Hour,
+			[]string{"alice"}, 2},
+		{"bob", time.Date(2027, 3, 4, 18, 0, 0, 0, loc), 2 * time.Hour,
+			[]string{"bob"}, 1},
+		{"late", time.Date(2027, 4, 1, 10, 0, 0, 0, loc), time.Hour, nil, 1},
+	}
+	var i int
+
+	for i = range events {
+		var e *Event = CreateEvent(store, events[i].title, "Test event", "",
+			events[i].start, events[i].duration, loc, nil, true)
+		var err error
+
+		e.Owners = events[i].owners
+		e.MinStaff = events[i].minStaff
+		e.MaxStaff = events[i].minStaff
+		err = e.Sync()
+		if err != nil {
+			t.Fatal("Error writing event ", e.Title, ": ", err)
+		}
+	}
+}
+
+// Range queries on the events from addRangeTestEvents. They describe how
+// FetchEventRange behaves with the Cassandra backends, which all other
+// backends must match.
+func rangeTests(loc *time.Location) []eventRangeTest {
+	var open time.Time = time.Unix(0, 0)
+	var none string
+	var alice string = "alice"
+	var carol string = "carol"
+
+	return []eventRangeTest{
+		{
+			name: "everything",
+			from: open,
+			to:   open,
+			want: []string{"long", "early", "alice", "pair", "bob", "late"},
+		},
+		{
+			name: "overlapping events",
+			from: time.Date(2027, 3, 2, 0, 0, 0, 0, loc),
+			to:   time.Date(2027, 3, 3, 23, 59, 0, 0, loc),
+			want: []string{"long", "alice", "pair"},
+		},
+		{
+			name: "range ends at the start of an event",
+			from: time.Date(2027, 3, 1, 12, 0, 0, 0, loc),
+			to:   time.Date(2027, 3, 2, 18, 0, 0, 0, loc),
+			want: []string{"long", "early", "alice"},
+		},
+		{
+			name: "open end",
+			from: time.Date(2027, 3, 3, 19, 0, 0, 0, loc),
+			to:   open,
+			want: []string{"long", "pair", "bob", "late"},
+		},
+		{
+			name: "open start",
+			from: open,
+			to:   time.Date(2027, 3, 1, 11, 0, 0, 0, loc),
+			want: []string{"long", "early"},
+		},
+		{
+			name: "empty range",
+			from: time.Date(2027, 3, 10, 0, 0, 0, 0, loc),
+			to:   time.Date(2027, 3, 20, 0, 0, 0, 0, loc),
+			want: nil,
+		},
+		{
+			name: "owned by alice",
+			from: open,
+			to:   open,
+			user: &alice,
+			want: []string{"alice", "pair"},
+		},
+		{
+			name: "owned by nobody known",
+			from: open,
+			to:   open,
+			user: &carol,
+			want: nil,
+		},
+		{
+			name: "understaffed",
+			from: open,
+			to:   open,
+			user: &none,
+			want: []string{"long", "early", "pair", "late"},
+		},
+		{
+			name:  "limit",
+			from:  open,
+			to:    open,
+			limit: 2,
+			want:  []string{"long", "early"},
+		},
+		{
+			name:  "limit within the range",
+			from:  time.Date(2027, 3, 2, 0, 0, 0, 0, loc),
+			to:    open,
+			limit: 3,
+			want:  []string{"long", "alice", "pair"},
+		},
+		{
+			name:  "limit applied after the owner filter",
+			from:  time.Date(2027, 3, 2, 0, 0, 0, 0, loc),
+			to:    open,
+			limit: 2,
+			user:  &none,
+			want:  []string{"long", "pair"},
+		},
+		{
+			name:  "no limit",
+			from:  time.Date(2027, 3, 3, 0, 0, 0, 0, loc),
+			to:    open,
+			limit: -1,
+			want:  []string{"long", "pair", "bob", "late"},
+		},
+	}
+}
+
+// Get the titles of the events "evs".
+func eventTitles(evs []*Event) []string {
+	var rv []string
+	var e *Event
+
+	for _, e = range evs {
+		rv = append(rv, e.Title)
+	}
+
+	return rv
+}
+
+// Run the range tests against "store", which must contain the events from
+// addRangeTestEvents.
+func checkFetchEventRange(t *testing.T, store EventStore,
+	loc *time.Location) {
+	var test eventRangeTest
+
+	for _, test = range rangeTests(loc) {
+		var evs []*Event
+		var err error
+
+		evs, err = store.FetchEventRange(test.from, test.to, test.limit,
+			loc, test.user, true)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if strings.Join(eventTitles(evs), ",") !=
+			strings.Join(test.want, ",") {
+			t.Errorf("%s: got %v, want %v", test.name, eventTitles(evs),
+				test.want)
+		}
+	}
+}
+
+// Check that SyncDetails on "store" only writes changes based on the
+// current owners of an event.
+func checkSyncDetails(t *testing.T, store EventStore) {
+	var e *Event = CreateEvent(store, "Event", "Test event", "alice",
+		time.Date(2027, 3, 2, 18, 0, 0, 0, time.UTC), 2*time.Hour,
+		time.UTC, nil, true)
+	var read, other *Event
+	var before Event
+	var err error
+
+	e.MaxStaff = 2
+	err = e.Sync()
+	if err != nil {
+		t.Fatal("Error writing event: ", err)
+	}
+
+	before = *e
+	e.Title = "Renamed"
+	err = e.SyncDetails(&before)
+	if err != nil {
+		t.Error("Error writing details: ", err)
+	}
+	checkStoredEvent(t, "current owners", store, e.ID, "Renamed", "alice")
+
+	// Bob signs up while the maximum is lowered based on stale owners.
+	read, err = store.FetchEvent(e.ID, time.UTC, true)
+	if err == nil {
+		other, err = store.FetchEvent(e.ID, time.UTC, true)
+	}
+	if err == nil {
+		err = other.AddOwner("bob")
+	}
+	if err != nil {
+		t.Fatal("Error adding owner: ", err)
+	}
+
+	before = *read
+	read.Title = "Shrunk"
+	read.MaxStaff = 1
+	err = read.SyncDetails(&before)
+	if err != ErrOwnerChanged {
+		t.Errorf("stale owners: got %v, want %v", err, ErrOwnerChanged)
+	}
+	checkStoredEvent(t, "stale owners", store, e.ID, "Renamed", "alice,bob")
+
+	err = other.Delete()
+	if err != nil {
+		t.Fatal("Error deleting event: ", err)
+	}
+	before = *other
+	err = other.SyncDetails(&before)
+	if err != ErrEventNotFound {
+		t.Errorf("deleted event: got %v, want %v", err, ErrEventNotFound)
+	}
+}
@@ -0,0 +1,211 @@
+package dutycal
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the change history.
+const (
+	HistoryCreate   = "create"
+	HistoryTake     = "take"
+	HistoryDisclaim = "disclaim"
+	HistoryEdit     = "edit"
+	HistoryDelete   = "delete"
+	HistoryGenerate = "generate"
+	HistoryOffer    = "offer"
+	HistoryWithdraw = "withdraw"
+	HistoryHandover = "handover"
+)
+
+// HistoryChange describes the change of a single field of an event.
+type HistoryChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// HistoryEntry records who did what to an event at which time. History
+// entries are only ever appended, never changed or removed, so they stay
+// around even after the event itself has been deleted.
+type HistoryEntry struct {
+	EventID string
+	Time    time.Time
+	Actor   string
+	Action  string
+
+	// Title of the event at the time of the change, so that deleted
+	// events can still be recognized.
+	Title string
+
+	Changes []HistoryChange
+}
+
+// Serialized form of a history entry, as kept in the journal and in the
+// wide rows of the Cassandra history column family.
+type historyRecord struct {
+	EventID string          `json:"event_id"`
+	Time    int64           `json:"time"`
+	Actor   string          `json:"actor"`
+	Action  string          `json:"action"`
+	Title   string          `json:"title"`
+	Changes []HistoryChange `json:"changes,omitempty"`
+}
+
+// Convert the history entry into its serialized form. Times are in
+// microseconds, just like event update timestamps.
+func newHistoryRecord(h *HistoryEntry) *historyRecord {
+	return &historyRecord{
+		EventID: h.EventID,
+		Time:    h.Time.UnixNano() / 1000,
+		Actor:   h.Actor,
+		Action:  h.Action,
+		Title:   h.Title,
+		Changes: h.Changes,
+	}
+}
+
+// Convert the serialized history record back into a history entry.
+func (r *historyRecord) toEntry(loc *time.Location) *HistoryEntry {
+	return &HistoryEntry{
+		EventID: r.EventID,
+		Time:    time.Unix(r.Time/1000000, (r.Time%1000000)*1000).In(loc),
+		Actor:   r.Actor,
+		Action:  r.Action,
+		Title:   r.Title,
+		Changes: r.Changes,
+	}
+}
+
+// Upper limit for the number of history entries read from a single row
+// in the wide row layout.
+const maxHistoryRowEntries = 1000
+
+// Row keys for history entries in the wide row layout used with Cassandra.
+// Every entry is written both to the row of its event and to the row of
+// the day it happened on, for the list of recent changes.
+func historyEventKey(id string) string {
+	return "event:" + id
+}
+
+func historyDayKey(day int64) string {
+	return "day:" + strconv.FormatInt(day, 10)
+}
+
+// Determine the number of the (UTC) day of "t" since the epoch.
+func historyDay(t time.Time) int64 {
+	return t.Unix() / (24 * 60 * 60)
+}
+
+// Generate a column name for the history entry "r" which sorts by time.
+// The random suffix keeps entries made at the same time apart.
+func historyColumnName(r *historyRecord) []byte {
+	var name []byte = make([]byte, 16)
+
+	binary.BigEndian.PutUint64(name, uint64(r.Time))
+	rand.Read(name[8:])
+
+	return name
+}
+
+// Get the values of the fields of "e" tracked in the history, in the
+// order they should be displayed.
+func historyFields(e *Event) [][2]string {
+	var reference string
+	var handovers []string
+	var h Handover
+
+	if e.Reference != nil {
+		reference = e.Reference.String()
+	}
+	for _, h = range e.Handovers {
+		if len(h.To) == 0 {
+			handovers = append(handovers, h.From+" to anyone")
+		} else {
+			handovers = append(handovers, h.From+" to "+h.To)
+		}
+	}
+
+	return [][2]string{
+		{"title", e.Title},
+		{"description", e.Description},
+		{"start", e.Start.Format(time.RFC3339)},
+		{"duration", e.Duration.String()},
+		{"owners", strings.Join(e.Owners, ", ")},
+		{"handovers", strings.Join(handovers, ", ")},
+		{"min_staff", strconv.FormatInt(int64(e.MinStaff), 10)},
+		{"max_staff", strconv.FormatInt(int64(e.MaxStaff), 10)},
+		{"reference", reference},
+		{"required", strconv.FormatBool(e.Required)},
+	}
+}
+
+// NewHistoryEntry creates a history entry for the action "action" which
+// "actor" performed, changing the event from "before" to "after". For
+// newly created events "before" is nil, and for deleted ones "after" is
+// nil. Only the fields which actually changed are recorded.
+func NewHistoryEntry(action, actor string,
+	before, after *Event) *HistoryEntry {
+	var h *HistoryEntry = &HistoryEntry{
+		Time:   time.Now(),
+		Actor:  actor,
+		Action: action,
+	}
+	var beforeFields, afterFields [][2]string
+	var i int
+
+	if before != nil {
+		h.EventID = before.ID
+		h.Title = before.Title
+		beforeFields = historyFields(before)
+	}
+	if after != nil {
+		h.EventID = after.ID
+		h.Title = after.Title
+		afterFields = historyFields(after)
+	}
+
+	for i = 0; i < len(beforeFields) || i < len(afterFields); i++ {
+		var change HistoryChange
+
+		if before != nil {
+			change.Field = beforeFields[i][0]
+			change.Old = beforeFields[i][1]
+		}
+		if after != nil {
+			change.Field = afterFields[i][0]
+			change.New = afterFields[i][1]
+		}
+
+		if before != nil && after != nil && change.Old == change.New {
+			continue
+		}
+		if len(change.Old) == 0 && len(change.New) == 0 {
+			continue
+		}
+
+		h.Changes = append(h.Changes, change)
+	}
+
+	return h
+}
+
+// RecordHistory appends an entry for the action "action" which "actor"
+// performed on an event to the history in "store". See NewHistoryEntry for
+// the meaning of "before" and "after". Since the change itself has already
+// happened at this point, errors are only logged.
+func RecordHistory(store EventStore, action, actor string,
+	before, after *Event) {
+	var h *HistoryEntry = NewHistoryEntry(action, actor, before, after)
+	var err error
+
+	err = store.AppendHistory(h)
+	if err != nil {
+		log.Print("Error recording ", action, " of event ", h.EventID,
+			" by ", actor, " in history: ", err)
+	}
+}
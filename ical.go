@@ -0,0 +1,130 @@
+package dutycal
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Timestamp format for UTC date-time values in iCalendar.
+const icalTimeFormat = "20060102T150405Z"
+
+// Escape special characters in iCalendar TEXT values (RFC 5545 3.3.11).
+var icalTextEscaper = strings.NewReplacer(
+	"\\", "\\\\", ";", "\\;", ",", "\\,", "\r\n", "\\n", "\n", "\\n",
+	"\r", "\\n")
+
+// Writer for iCalendar content lines, taking care of line folding.
+type icalWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// Write a single content line, folding it into multiple lines of at most
+// 75 octets as required by RFC 5545 3.1. Multi-byte characters are never
+// split.
+func (iw *icalWriter) line(name, value string) {
+	var line string = name + ":" + value
+	var limit int = 75
+
+	if iw.err != nil {
+		return
+	}
+
+	for len(line) > limit {
+		var cut int = limit
+
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+
+		_, iw.err = iw.w.WriteString(line[:cut] + "\r\n ")
+		if iw.err != nil {
+			return
+		}
+		line = line[cut:]
+
+		// Continuation lines start with a space, which counts.
+		limit = 74
+	}
+
+	_, iw.err = iw.w.WriteString(line + "\r\n")
+}
+
+// Write a TEXT property, escaping the value.
+func (iw *icalWriter) text(name, value string) {
+	iw.line(name, icalTextEscaper.Replace(value))
+}
+
+// Write a DATE-TIME property in UTC.
+func (iw *icalWriter) datetime(name string, value time.Time) {
+	iw.line(name, value.UTC().Format(icalTimeFormat))
+}
+
+// WriteICalendar writes "events" to "w" as an iCalendar (RFC 5545) object.
+// "name" is displayed by calendar clients as the name of the calendar.
+// "method" is the iTIP method, e.g. "PUBLISH" for feeds or "REQUEST" for
+// invitations.
+func WriteICalendar(w io.Writer, name, method string, events []*Event) error {
+	return writeICalendar(w, name, method, "", "", "", events)
+}
+
+// WriteICalendarRequest writes the event "ev" to "w" as an iTIP (RFC 5546)
+// REQUEST, i.e. an invitation which calendar clients can import directly.
+// The invitation comes from the mail address "organizer" and is addressed
+// to the mail address "attendee", whose common name is "cn". It shows the
+// attendee as having accepted already, since they signed up themselves.
+func WriteICalendarRequest(w io.Writer, name, organizer, attendee,
+	cn string, ev *Event) error {
+	return writeICalendar(w, name, "REQUEST", organizer, attendee, cn,
+		[]*Event{ev})
+}
+
+// Write "events" to "w" as an iCalendar object. If "organizer" is set, the
+// events get an organizer and the attendee "attendee" with the common
+// name "cn", as required for scheduling methods such as REQUEST.
+func writeICalendar(w io.Writer, name, method, organizer, attendee,
+	cn string, events []*Event) error {
+	var iw *icalWriter = &icalWriter{w: bufio.NewWriter(w)}
+	var now time.Time = time.Now()
+	var ev *Event
+
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//Starship Factory//dutycal//EN")
+	iw.line("CALSCALE", "GREGORIAN")
+	iw.line("METHOD", method)
+	iw.text("X-WR-CALNAME", name)
+
+	for _, ev = range events {
+		iw.line("BEGIN", "VEVENT")
+		iw.text("UID", ev.ID)
+		iw.datetime("DTSTAMP", now)
+		iw.datetime("DTSTART", ev.Start)
+		iw.datetime("DTEND", ev.Start.Add(ev.Duration))
+		iw.text("SUMMARY", ev.Title)
+		if len(ev.Description) > 0 {
+			iw.text("DESCRIPTION", ev.Description)
+		}
+		if ev.Reference != nil {
+			iw.line("URL", ev.Reference.String())
+		}
+		if len(organizer) > 0 {
+			iw.line("SEQUENCE", "0")
+			iw.line("STATUS", "CONFIRMED")
+			iw.line("ORGANIZER", "mailto:"+organizer)
+			iw.line("ATTENDEE;CN=\""+strings.Replace(cn, "\"", "'", -1)+
+				"\";ROLE=REQ-PARTICIPANT;PARTSTAT=ACCEPTED", "mailto:"+attendee)
+		}
+		iw.line("END", "VEVENT")
+	}
+
+	iw.line("END", "VCALENDAR")
+
+	if iw.err != nil {
+		return iw.err
+	}
+	return iw.w.Flush()
+}
@@ -0,0 +1,125 @@
+package dutycal
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Purpose string for personal calendar feed tokens.
+const icalFeedTokenPurpose = "ical-feed"
+
+// ICalHandler serves the calendar as iCalendar feeds, so people can
+// subscribe to it from their calendar applications:
+//
+//	/ical/all.ics                      all events
+//	/ical/unassigned.ics               required events nobody signed up for
+//	/ical/user/{user}/{token}.ics      events owned by {user}
+//
+// Since calendar clients cannot log in through AncientAuth, personal feeds
+// are authenticated with a secret token derived from the user name instead.
+type ICalHandler struct {
+	store    EventStore
+	config   *DutyCalConfig
+	location *time.Location
+}
+
+// NewICalHandler creates a new handler for iCalendar feeds of the events
+// in "store". Times are converted to "loc".
+func NewICalHandler(store EventStore, loc *time.Location,
+	conf *DutyCalConfig) *ICalHandler {
+	if store == nil {
+		log.Panic("store is nil")
+	}
+	if conf == nil {
+		log.Panic("conf is nil")
+	}
+	if loc == nil {
+		log.Panic("loc is nil")
+	}
+	return &ICalHandler{
+		store:    store,
+		config:   conf,
+		location: loc,
+	}
+}
+
+// PersonalFeedPath determines the path of the personal calendar feed of
+// "user". Returns an empty string if personal feeds are not available
+// because no secret key has been configured.
+func PersonalFeedPath(conf *DutyCalConfig, user string) string {
+	var token string = genToken(conf, icalFeedTokenPurpose, user)
+
+	if len(token) == 0 {
+		return ""
+	}
+
+	return "/ical/user/" + url.PathEscape(user) + "/" + token + ".ics"
+}
+
+func (h *ICalHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// User names are escaped, so split before unescaping them.
+	var urlparts []string = strings.Split(
+		strings.TrimPrefix(req.URL.EscapedPath(), "/ical/"), "/")
+	var from time.Time = time.Now().AddDate(
+		0, 0, -int(h.config.GetIcalPastDays()))
+	var to time.Time = time.Now().AddDate(
+		0, 0, int(h.config.GetRecurringEventsScheduleAhead()))
+	var name string = h.config.GetAuth().GetAppName()
+	var events, rv []*Event
+	var user *string
+	var unassignedOnly bool
+	var ev *Event
+	var err error
+
+	if len(urlparts) == 1 && urlparts[0] == "all.ics" {
+		// Nothing to filter.
+	} else if len(urlparts) == 1 && urlparts[0] == "unassigned.ics" {
+		var nobody string
+
+		user = &nobody
+		unassignedOnly = true
+		name += ": unassigned"
+	} else if len(urlparts) == 3 && urlparts[0] == "user" {
+		var owner string
+		var token string = strings.TrimSuffix(urlparts[2], ".ics")
+
+		owner, err = url.PathUnescape(urlparts[1])
+		if err != nil || len(owner) == 0 ||
+			!checkToken(h.config, token, icalFeedTokenPurpose, owner) {
+			http.NotFound(rw, req)
+			return
+		}
+
+		user = &owner
+		name += ": " + owner
+	} else {
+		http.NotFound(rw, req)
+		return
+	}
+
+	events, err = FetchEventRange(h.store, from, to, -1, h.location, user,
+		false)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(rw, "Error fetching events: "+err.Error()+"\r\n")
+		log.Print("Error fetching events for ", req.URL.Path, ": ", err)
+		return
+	}
+
+	for _, ev = range events {
+		if unassignedOnly && !ev.Required {
+			continue
+		}
+		rv = append(rv, ev)
+	}
+
+	rw.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	err = WriteICalendar(rw, name, "PUBLISH", rv)
+	if err != nil {
+		log.Print("Error writing calendar feed ", req.URL.Path, ": ", err)
+	}
+}
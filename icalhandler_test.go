@@ -0,0 +1,96 @@
+package dutycal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Request for a personal calendar feed and whether it must succeed.
+type personalFeedTest struct {
+	name  string
+	path  string
+	found bool
+}
+
+func TestPersonalFeed(t *testing.T) {
+	var conf *DutyCalConfig = &DutyCalConfig{
+		SecretKey: proto.String("0123456789abcdef0123456789abcdef"),
+	}
+	var store *MemoryEventStore = NewMemoryEventStore()
+	var h *ICalHandler = NewICalHandler(store, time.UTC, conf)
+	var token string = genToken(conf, icalFeedTokenPurpose, "a/b%c")
+	var e *Event
+	var test personalFeedTest
+	var tests = []personalFeedTest{
+		{
+			name:  "feed path",
+			path:  PersonalFeedPath(conf, "a/b%c"),
+			found: true,
+		},
+		{
+			name:  "unescaped slash",
+			path:  "/ical/user/a/b%25c/" + token + ".ics",
+			found: false,
+		},
+		{
+			name:  "escaped twice",
+			path:  "/ical/user/a%252Fb%2525c/" + token + ".ics",
+			found: false,
+		},
+		{
+			name:  "user without events",
+			path:  PersonalFeedPath(conf, "alice"),
+			found: true,
+		},
+		{
+			name:  "wrong token",
+			path:  "/ical/user/alice/" + token + ".ics",
+			found: false,
+		},
+	}
+
+	e = CreateEvent(store, "Open Factory", "Come in", "a/b%c",
+		time.Now().Add(24*time.Hour), 2*time.Hour, time.UTC, nil, true)
+	if e.Sync() != nil {
+		t.Fatal("Error writing event")
+	}
+
+	for _, test = range tests {
+		var rec *httptest.ResponseRecorder = httptest.NewRecorder()
+		var req *http.Request = httptest.NewRequest(http.MethodGet,
+			test.path, nil)
+
+		h.ServeHTTP(rec, req)
+		if (rec.Code == http.StatusOK) != test.found {
+			t.Errorf("%s: GET %s: got status %d, want found: %v",
+				test.name, test.path, rec.Code, test.found)
+		}
+	}
+
+	// Only the owner's feed contains the event.
+	if !strings.Contains(feedBody(t, h, PersonalFeedPath(conf, "a/b%c")),
+		"Open Factory") {
+		t.Error("Event missing from the feed of its owner")
+	}
+	if strings.Contains(feedBody(t, h, PersonalFeedPath(conf, "alice")),
+		"Open Factory") {
+		t.Error("Event in the feed of somebody else")
+	}
+}
+
+// Fetch the feed at "path" from "h".
+func feedBody(t *testing.T, h *ICalHandler, path string) string {
+	var rec *httptest.ResponseRecorder = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET %s: got status %d", path, rec.Code)
+	}
+
+	return rec.Body.String()
+}
@@ -0,0 +1,597 @@
+package dutycal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MailMessage is a mail to be sent through SendMessage. Addresses may
+// contain display names, e.g. "Jane Doe <jane@example.org>".
+type MailMessage struct {
+	From    string
+	To      []string
+	Cc      []string
+	Subject string
+
+	// Recipients which are not listed in the mail.
+	Bcc []string
+
+	// Plain text version of the mail.
+	Text string
+
+	// Optional HTML version of the mail. If it is set, the mail is sent
+	// as multipart/alternative with Text as the fallback.
+	HTML string
+
+	// Files to attach to the mail.
+	Attachments []*MailAttachment
+}
+
+// MailAttachment is a file attached to a MailMessage.
+type MailAttachment struct {
+	Filename string
+
+	// MIME type of the file, including any parameters, e.g.
+	// "text/calendar; method=REQUEST; charset=utf-8".
+	ContentType string
+
+	Data []byte
+}
+
+// MemberAddress determines the mail address of the member "user", either
+// from the member directory or from the address pattern in the mail
+// configuration. Returns an empty string if there is no way to tell.
+func MemberAddress(config *DutyCalConfig, user string) string {
+	var mc *DutyCalMailConfig = config.GetMailConfig()
+	var entry *MemberDirectoryEntry
+
+	if len(user) == 0 {
+		return ""
+	}
+
+	for _, entry = range mc.GetMemberDirectory() {
+		if entry.GetUser() == user {
+			return entry.GetAddress()
+		}
+	}
+
+	if len(mc.GetMemberAddressPattern()) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(mc.GetMemberAddressPattern(), user)
+}
+
+// Generate a unique Message-Id for a mail sent from the address "from",
+// in the "<unique@domain>" form required by RFC 5322.
+func genMessageID(from string) string {
+	var rnd [8]byte
+	var domain string = "localhost"
+	var pos int = strings.LastIndex(from, "@")
+
+	if pos >= 0 {
+		domain = from[pos+1:]
+	}
+	rand.Read(rnd[:])
+
+	return "<" + time.Now().Format("20060102150405") + "." +
+		hex.EncodeToString(rnd[:]) + "@" + domain + ">"
+}
+
+// Write "text" to "w" in quoted-printable encoding, with CRLF line ends.
+func writeQuotedPrintable(w io.Writer, text string) error {
+	var qp *quotedprintable.Writer = quotedprintable.NewWriter(w)
+	var err error
+
+	_, err = io.WriteString(qp, strings.Replace(text, "\n", "\r\n", -1))
+	if err != nil {
+		return err
+	}
+
+	return qp.Close()
+}
+
+// Write "text" to "w" as a quoted-printable body part with the content
+// type "contentType".
+func writeTextPart(w *multipart.Writer, contentType, text string) error {
+	var h textproto.MIMEHeader = make(textproto.MIMEHeader)
+	var part io.Writer
+	var err error
+
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	part, err = w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+
+	return writeQuotedPrintable(part, text)
+}
+
+// Envelope determines the bare addresses of the sender and the recipients
+// of the mail for the SMTP envelope.
+func (m *MailMessage) Envelope() (string, []string, error) {
+	var sender *mail.Address
+	var to []string
+	var all []string
+	var addr string
+	var err error
+
+	sender, err = mail.ParseAddress(m.From)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error parsing sender address %s: %s",
+			m.From, err)
+	}
+
+	all = append(all, m.To...)
+	all = append(all, m.Cc...)
+	all = append(all, m.Bcc...)
+	for _, addr = range all {
+		var recipient *mail.Address
+
+		recipient, err = mail.ParseAddress(addr)
+		if err != nil {
+			return "", nil, fmt.Errorf(
+				"Error parsing recipient address %s: %s", addr, err)
+		}
+		to = append(to, recipient.Address)
+	}
+
+	if len(to) == 0 {
+		return "", nil, errors.New("Mail has no recipients")
+	}
+
+	return sender.Address, to, nil
+}
+
+// Format the address "addr" for a header field, encoding the display name
+// according to RFC 2047 if required.
+func formatAddress(addr string) string {
+	var a *mail.Address
+	var err error
+
+	a, err = mail.ParseAddress(addr)
+	if err != nil {
+		return addr
+	}
+
+	return a.String()
+}
+
+// Format the list of addresses "addrs" for a header field.
+func formatAddressList(addrs []string) string {
+	var rv []string
+	var addr string
+
+	for _, addr = range addrs {
+		rv = append(rv, formatAddress(addr))
+	}
+
+	return strings.Join(rv, ", ")
+}
+
+// Render the text and, if present, HTML version of the mail into a single
+// body part. Returns the header and the content of the part.
+func (m *MailMessage) content() (textproto.MIMEHeader, []byte, error) {
+	var h textproto.MIMEHeader = make(textproto.MIMEHeader)
+	var sb bytes.Buffer
+	var mw *multipart.Writer
+	var err error
+
+	if len(m.HTML) == 0 {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		err = writeQuotedPrintable(&sb, m.Text)
+		return h, sb.Bytes(), err
+	}
+
+	mw = multipart.NewWriter(&sb)
+	h.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+
+	// Clients display the last alternative they understand, so the
+	// plain text has to come first.
+	err = writeTextPart(mw, "text/plain", m.Text)
+	if err == nil {
+		err = writeTextPart(mw, "text/html", m.HTML)
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+
+	return h, sb.Bytes(), err
+}
+
+// Write the attachment "a" to "w" as a base64 encoded body part.
+func writeAttachment(w *multipart.Writer, a *MailAttachment) error {
+	var h textproto.MIMEHeader = make(textproto.MIMEHeader)
+	var encoded string = base64.StdEncoding.EncodeToString(a.Data)
+	var part io.Writer
+	var err error
+
+	h.Set("Content-Type", a.ContentType)
+	h.Set("Content-Transfer-Encoding", "base64")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": a.Filename}))
+
+	part, err = w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+
+	// Lines in mails must not be longer than 76 characters.
+	for len(encoded) > 76 {
+		_, err = io.WriteString(part, encoded[:76]+"\r\n")
+		if err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(part, encoded+"\r\n")
+	return err
+}
+
+// Write the header fields "h" to "w", sorted by name.
+func writeHeader(w io.Writer, h textproto.MIMEHeader) {
+	var names []string
+	var name, value string
+
+	for name = range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name = range names {
+		for _, value = range h[name] {
+			io.WriteString(w, name+": "+value+"\r\n")
+		}
+	}
+}
+
+// Bytes renders the mail into its wire format, including the headers.
+// Header fields are encoded according to RFC 2047 where required.
+func (m *MailMessage) Bytes() ([]byte, error) {
+	var sb bytes.Buffer
+	var mw *multipart.Writer
+	var part io.Writer
+	var h textproto.MIMEHeader
+	var body []byte
+	var a *MailAttachment
+	var from string
+	var err error
+
+	from, _, err = m.Envelope()
+	if err != nil {
+		return nil, err
+	}
+
+	h, body, err = m.content()
+	if err != nil {
+		return nil, err
+	}
+
+	io.WriteString(&sb, "Message-Id: "+genMessageID(from)+"\r\n")
+	io.WriteString(&sb, "MIME-Version: 1.0\r\n")
+	io.WriteString(&sb, "From: "+formatAddress(m.From)+"\r\n")
+	if len(m.To) > 0 {
+		io.WriteString(&sb, "To: "+formatAddressList(m.To)+"\r\n")
+	} else {
+		// RFC 5322 wants at least an empty group if all recipients are
+		// hidden.
+		io.WriteString(&sb, "To: undisclosed-recipients:;\r\n")
+	}
+	if len(m.Cc) > 0 {
+		io.WriteString(&sb, "Cc: "+formatAddressList(m.Cc)+"\r\n")
+	}
+	io.WriteString(&sb, "Subject: "+
+		mime.QEncoding.Encode("utf-8", m.Subject)+"\r\n")
+	io.WriteString(&sb, "Date: "+time.Now().Format(time.RFC1123Z)+"\r\n")
+
+	if len(m.Attachments) == 0 {
+		writeHeader(&sb, h)
+		io.WriteString(&sb, "\r\n")
+		sb.Write(body)
+		return sb.Bytes(), nil
+	}
+
+	mw = multipart.NewWriter(&sb)
+	io.WriteString(&sb, "Content-Type: multipart/mixed; boundary="+
+		mw.Boundary()+"\r\n\r\n")
+
+	part, err = mw.CreatePart(h)
+	if err == nil {
+		_, err = part.Write(body)
+	}
+	for _, a = range m.Attachments {
+		if err == nil {
+			err = writeAttachment(mw, a)
+		}
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return sb.Bytes(), nil
+}
+
+// Timeout for connecting to the SMTP server.
+const mailDialTimeout = 30 * time.Second
+
+// MailClient sends mails through a single connection to the SMTP server
+// from the mail configuration, so that sending many mails doesn't require
+// connecting and authenticating for every one of them.
+type MailClient struct {
+	client *smtp.Client
+}
+
+// Create the TLS configuration for talking to the SMTP server "host".
+func mailTLSConfig(mc *DutyCalMailConfig, host string) (*tls.Config, error) {
+	var rv *tls.Config = &tls.Config{ServerName: host}
+	var pem []byte
+	var err error
+
+	if len(mc.GetTlsCaCertificate()) > 0 {
+		pem, err = ioutil.ReadFile(mc.GetTlsCaCertificate())
+		if err != nil {
+			return nil, err
+		}
+
+		rv.RootCAs = x509.NewCertPool()
+		if !rv.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s",
+				mc.GetTlsCaCertificate())
+		}
+	}
+
+	return rv, nil
+}
+
+// DialMail connects and authenticates to the SMTP server from the mail
+// configuration, using TLS as configured.
+func DialMail(config *DutyCalConfig) (*MailClient, error) {
+	var mc *DutyCalMailConfig = config.GetMailConfig()
+	var tlsConfig *tls.Config
+	var conn net.Conn
+	var client *smtp.Client
+	var auth smtp.Auth
+	var smtpHost string
+	var ok bool
+	var err error
+
+	smtpHost, _, err = net.SplitHostPort(mc.GetSmtpServerAddress())
+	if err != nil {
+		return nil, fmt.Errorf("Error splitting host:port in SMTP server "+
+			"address: %s", err)
+	}
+
+	tlsConfig, err = mailTLSConfig(mc, smtpHost)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading SMTP CA certificate: %s", err)
+	}
+
+	if mc.GetTlsMode() == DutyCalMailConfig_IMPLICIT_TLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: mailDialTimeout},
+			"tcp", mc.GetSmtpServerAddress(), tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", mc.GetSmtpServerAddress(),
+			mailDialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err = smtp.NewClient(conn, smtpHost)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if mc.GetTlsMode() == DutyCalMailConfig_STARTTLS_OPTIONAL ||
+		mc.GetTlsMode() == DutyCalMailConfig_STARTTLS_REQUIRED {
+		ok, _ = client.Extension("STARTTLS")
+		if ok {
+			err = client.StartTLS(tlsConfig)
+		} else if mc.GetTlsMode() == DutyCalMailConfig_STARTTLS_REQUIRED {
+			err = errors.New("SMTP server doesn't support STARTTLS")
+		}
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	switch mc.GetAuthMechanism() {
+	case DutyCalMailConfig_PLAIN:
+		if len(mc.GetUsername()) > 0 {
+			auth = smtp.PlainAuth(mc.GetIdentity(), mc.GetUsername(),
+				mc.GetPassword(), smtpHost)
+		}
+	case DutyCalMailConfig_CRAM_MD5:
+		auth = smtp.CRAMMD5Auth(mc.GetUsername(), mc.GetPassword())
+	}
+
+	if auth != nil {
+		ok, _ = client.Extension("AUTH")
+		if !ok {
+			err = errors.New("SMTP server doesn't support authentication")
+		} else {
+			err = client.Auth(auth)
+		}
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return &MailClient{client: client}, nil
+}
+
+// Send sends the mail "m" through the connection. If it fails, the
+// connection can still be used for other mails unless it broke down.
+func (c *MailClient) Send(m *MailMessage) error {
+	var from string
+	var to []string
+	var rcpt string
+	var data []byte
+	var w io.WriteCloser
+	var err error
+
+	from, to, err = m.Envelope()
+	if err != nil {
+		return err
+	}
+
+	data, err = m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	err = c.client.Mail(from)
+	for _, rcpt = range to {
+		if err == nil {
+			err = c.client.Rcpt(rcpt)
+		}
+	}
+	if err == nil {
+		w, err = c.client.Data()
+	}
+	if err == nil {
+		_, err = w.Write(data)
+		if err == nil {
+			err = w.Close()
+		} else {
+			w.Close()
+		}
+	}
+	if err != nil {
+		// Abort the transaction so the next mail starts afresh.
+		c.client.Reset()
+	}
+
+	return err
+}
+
+// Close says goodbye to the SMTP server and closes the connection.
+func (c *MailClient) Close() error {
+	var err error = c.client.Quit()
+
+	if err != nil {
+		c.client.Close()
+	}
+
+	return err
+}
+
+// SendMessage sends the mail "m" through a new connection to the SMTP
+// server from the mail configuration.
+func SendMessage(config *DutyCalConfig, m *MailMessage) error {
+	var c *MailClient
+	var err error
+
+	c, err = DialMail(config)
+	if err != nil {
+		return err
+	}
+
+	err = c.Send(m)
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	return c.Close()
+}
+
+// SendMail sends a plain text mail from "from" to the addresses "to", with
+// the subject "subject" and the text "body", through the SMTP server from
+// the mail configuration.
+func SendMail(config *DutyCalConfig, from string, to []string,
+	subject, body string) error {
+	return SendMessage(config, &MailMessage{
+		From:    from,
+		To:      to,
+		Subject: subject,
+		Text:    body,
+	})
+}
+
+// SendMemberMail sends a plain text mail with the subject "subject" and
+// the text "body" to the members "users". Members whose address isn't
+// known are left out. Nothing is sent if no sender for mails to individual
+// members has been configured.
+func SendMemberMail(config *DutyCalConfig, users []string,
+	subject, body string) error {
+	var recipients []string
+	var user string
+	var addr string
+
+	if len(config.GetMailConfig().GetSender()) == 0 {
+		return nil
+	}
+
+	for _, user = range users {
+		addr = MemberAddress(config, user)
+		if len(addr) > 0 {
+			recipients = append(recipients, addr)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	return SendMail(config, config.GetMailConfig().GetSender(), recipients,
+		subject, body)
+}
+
+// SendEventMail notifies the members "users" about a change to the event
+// "ev" by mail. The mail starts with "intro", followed by the details of
+// the event in the time zone "loc" and, if the base URL of the calendar is
+// known, "linkText" with a link to the event.
+func SendEventMail(config *DutyCalConfig, loc *time.Location, ev *Event,
+	users []string, subject, intro, linkText string) error {
+	var body string
+
+	body = intro + "\n\n   " + ev.Title + "\n   on " +
+		ev.Start.In(loc).Format("Mon 2 Jan 2006 15:04") + " for " +
+		ev.Duration.String() + "\n\n"
+	if len(config.GetBaseUrl()) > 0 {
+		body += linkText + "\n" + config.GetBaseUrl() + "/event/" +
+			url.PathEscape(ev.ID) + "/view\n\n"
+	}
+	body += "Thanks a lot,\nyour faithful duty calendar\n"
+
+	return SendMemberMail(config, users, subject, body)
+}
+
+// NotifyDroppedOwners tells the members "dropped" by mail that they are no
+// longer signed up for the event "ev" because it was moved to a different
+// time, as returned by Event.SyncEdit.
+func NotifyDroppedOwners(config *DutyCalConfig, loc *time.Location,
+	ev *Event, dropped []string) error {
+	return SendEventMail(config, loc, ev, dropped, "Shift moved: "+ev.Title,
+		"The following shift you had signed up for has been moved to a "+
+			"different time, so you are no longer signed up for it:",
+		"If you can still make it, please sign up again on")
+}
@@ -0,0 +1,612 @@
+package dutycal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Name of the journal file inside the local database directory.
+const memoryStoreJournal = "events.jsonl"
+
+// Every journal entry starts with this, and since quotes inside of strings
+// are escaped, it can't appear anywhere else.
+var journalEntryStart []byte = []byte(`{"op":`)
+
+// Serialized form of an event, as kept in memory and in the journal. The
+// owners are joined into a single string, just like in the databases.
+type eventRecord struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Owner       string `json:"owner"`
+	MinStaff    int32  `json:"min_staff,omitempty"`
+	MaxStaff    int32  `json:"max_staff,omitempty"`
+	Start       int64  `json:"start"`
+	End         int64  `json:"end"`
+	Required    bool   `json:"required"`
+	Reference   string `json:"reference,omitempty"`
+	GeneratorID []byte `json:"generator_id,omitempty"`
+	UpdateTS    int64  `json:"update_ts"`
+}
+
+// Individual line of the journal file.
+type journalEntry struct {
+	Op    string       `json:"op"`
+	ID    string       `json:"id,omitempty"`
+	Event *eventRecord `json:"event,omitempty"`
+
+	// Change history entry, for "history" entries.
+	History *historyRecord `json:"history,omitempty"`
+
+	// For conditional writes, the owner the event must have for the entry
+	// to be applied. Since every process replays the journal in the same
+	// order, they all agree on which of two competing writes won.
+	ExpectOwner *string `json:"expect_owner,omitempty"`
+}
+
+// MemoryEventStore is an EventStore keeping all events in memory. If it was
+// opened with OpenFileEventStore, all changes are also appended to a journal
+// file which is replayed when the store is opened again. Other processes
+// using the same directory (e.g. dutygen next to dutycal) will see the
+// changes, as the journal is checked for new entries on every access.
+type MemoryEventStore struct {
+	mtx     sync.Mutex
+	events  map[string]*eventRecord
+	history []*historyRecord
+	path    string
+	offset  int64
+	line    int
+	lastTS  int64
+}
+
+// NewMemoryEventStore creates a new empty event store which only lives in
+// memory. All events will be lost once the process exits.
+func NewMemoryEventStore() *MemoryEventStore {
+	return &MemoryEventStore{
+		events: make(map[string]*eventRecord),
+	}
+}
+
+// OpenFileEventStore opens the event journal in the directory "dir",
+// creating both of them if necessary.
+func OpenFileEventStore(dir string) (*MemoryEventStore, error) {
+	var s *MemoryEventStore = NewMemoryEventStore()
+	var f *os.File
+	var err error
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	s.path = filepath.Join(dir, memoryStoreJournal)
+	f, err = os.OpenFile(s.path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	err = s.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Read any journal entries which were appended since we last looked.
+// Must be called with the mutex held.
+func (s *MemoryEventStore) refresh() error {
+	var f *os.File
+	var fi os.FileInfo
+	var rd *bufio.Reader
+	var err error
+
+	if len(s.path) == 0 {
+		return nil
+	}
+
+	f, err = os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err = f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() == s.offset {
+		return nil
+	} else if fi.Size() < s.offset {
+		// The journal was replaced; start from scratch.
+		s.events = make(map[string]*eventRecord)
+		s.history = nil
+		s.offset = 0
+		s.line = 0
+	}
+
+	_, err = f.Seek(s.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	rd = bufio.NewReader(f)
+	for {
+		var line []byte
+		var entry journalEntry
+
+		line, err = rd.ReadBytes('\n')
+		if err == io.EOF {
+			// Incomplete lines are still being written by someone else,
+			// and we'll pick them up next time. If the writer crashed,
+			// the line is completed by the next entry appended to it.
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = parseJournalLine(bytes.TrimSpace(line), &entry)
+		if err != nil {
+			return fmt.Errorf("%s:%d: Corrupt journal entry: %s", s.path,
+				s.line+1, err)
+		}
+		s.offset += int64(len(line))
+		s.line++
+
+		if len(entry.Op) > 0 {
+			s.apply(&entry)
+		}
+	}
+}
+
+// Parse the journal line "line" into "entry". If a writer crashed halfway
+// through an entry, the next entry is appended right after it, so the
+// torn entry is dropped and the one after it is used. Empty lines leave
+// "entry" alone.
+func parseJournalLine(line []byte, entry *journalEntry) error {
+	var start int
+	var err error
+
+	if len(line) == 0 {
+		return nil
+	}
+
+	err = json.Unmarshal(line, entry)
+	if err == nil {
+		return nil
+	}
+
+	start = bytes.LastIndex(line, journalEntryStart)
+	if start <= 0 {
+		return err
+	}
+
+	*entry = journalEntry{}
+	if json.Unmarshal(line[start:], entry) != nil {
+		return err
+	}
+
+	log.Printf("Dropping incomplete journal entry %q", line[:start])
+	return nil
+}
+
+// Apply the journal entry to the in-memory state.
+func (s *MemoryEventStore) apply(entry *journalEntry) {
+	if entry.ExpectOwner != nil && entry.Event != nil {
+		var current *eventRecord = s.events[entry.Event.ID]
+
+		if current == nil || current.Owner != *entry.ExpectOwner {
+			return
+		}
+	}
+
+	if entry.Op == "details" && entry.Event != nil {
+		var current *eventRecord = s.events[entry.Event.ID]
+
+		// Details of events deleted in the meantime are dropped.
+		if current == nil {
+			return
+		}
+		entry.Event.Owner = current.Owner
+	}
+
+	if (entry.Op == "sync" || entry.Op == "details") && entry.Event != nil {
+		s.events[entry.Event.ID] = entry.Event
+		if entry.Event.UpdateTS > s.lastTS {
+			s.lastTS = entry.Event.UpdateTS
+		}
+	} else if entry.Op == "delete" {
+		delete(s.events, entry.ID)
+	} else if entry.Op == "history" && entry.History != nil {
+		s.history = append(s.history, entry.History)
+	}
+}
+
+// Write the journal entry to disk (if required) and apply it to the
+// in-memory state. Must be called with the mutex held.
+func (s *MemoryEventStore) commit(entry *journalEntry) error {
+	var f *os.File
+	var data []byte
+	var err error
+
+	if len(s.path) > 0 {
+		data, err = json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+
+		f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Write(data)
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+
+		// Read back our own entry along with anything else which has been
+		// added in the meantime.
+		return s.refresh()
+	}
+
+	s.apply(entry)
+	return nil
+}
+
+// Convert the stored record into an event object.
+func (s *MemoryEventStore) toEvent(r *eventRecord, loc *time.Location) *Event {
+	var e *Event = &Event{
+		store:       s,
+		ID:          r.ID,
+		Title:       r.Title,
+		Description: r.Description,
+		MinStaff:    r.MinStaff,
+		MaxStaff:    r.MaxStaff,
+		Start:       time.Unix(r.Start/1000, (r.Start%1000)*1000000).In(loc),
+		Duration:    time.Duration(r.End-r.Start) * time.Millisecond,
+		Required:    r.Required,
+		location:    loc,
+		updateTS:    r.UpdateTS,
+	}
+
+	e.setOwnerColumn(r.Owner)
+	if len(r.Reference) > 0 {
+		e.Reference, _ = url.Parse(r.Reference)
+	}
+	if len(r.GeneratorID) > 0 {
+		e.GeneratorID = append([]byte{}, r.GeneratorID...)
+	}
+	e.normalizeStaff()
+
+	return e
+}
+
+// FetchEvent recreates the in-memory event object for the record "id".
+// The "quorum" flag has no effect since there is only one copy.
+func (s *MemoryEventStore) FetchEvent(id string, loc *time.Location,
+	quorum bool) (*Event, error) {
+	var r *eventRecord
+	var ok bool
+	var err error
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err = s.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	r, ok = s.events[id]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+
+	return s.toEvent(r, loc), nil
+}
+
+// FetchEventRange retrieves a list of all events between the two specified
+// dates, sorted by start time. If a limit is given, only up to that many
+// records will be returned. If "user" is not nil, the specified user must be
+// one of the owners, or if it is empty, the event must need more owners.
+func (s *MemoryEventStore) FetchEventRange(from, to time.Time, limit int32,
+	loc *time.Location, user *string, quorum bool) ([]*Event, error) {
+	var rv []*Event
+	var r *eventRecord
+	var e *Event
+	var err error
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err = s.refresh()
+	if err != nil {
+		return []*Event{}, err
+	}
+
+	for _, r = range s.events {
+		if to.Unix() != 0 && r.Start > to.Unix()*1000 {
+			continue
+		}
+		if from.Unix() != 0 && r.End < from.Unix()*1000 {
+			continue
+		}
+		e = s.toEvent(r, loc)
+		if !e.matchesUser(user) {
+			continue
+		}
+
+		rv = append(rv, e)
+	}
+
+	sort.Sort(eventsByStart(rv))
+	if limit > 0 && int32(len(rv)) > limit {
+		rv = rv[:limit]
+	}
+
+	return rv, nil
+}
+
+// Generate a new update timestamp. Timestamps are in microseconds, just
+// like in Cassandra, and never go backwards.
+func (s *MemoryEventStore) newTimestamp() int64 {
+	var ts int64 = time.Now().UnixNano() / 1000
+
+	if ts <= s.lastTS {
+		ts = s.lastTS + 1
+	}
+
+	return ts
+}
+
+// SyncEvent writes the event to memory and appends it to the journal.
+func (s *MemoryEventStore) SyncEvent(e *Event) error {
+	return s.writeEvent(e, nil)
+}
+
+// SyncDetails writes the event to memory and appends it to the journal,
+// but keeps the owners of the stored event, provided they are still those
+// of "expected". Since the owners are checked again when the entry is
+// replayed, owner changes which other processes append to the journal in
+// the meantime win.
+func (s *MemoryEventStore) SyncDetails(e *Event, expected *Event) error {
+	return s.writeEvent(e, expected)
+}
+
+// Write the event "e". If "expected" is nil, the whole event is written
+// with the journal operation "sync". Otherwise, only its details are
+// written with the operation "details", if the stored owners are still
+// those of "expected".
+func (s *MemoryEventStore) writeEvent(e *Event, expected *Event) error {
+	var entry *journalEntry = &journalEntry{Op: "sync"}
+	var current, r *eventRecord
+	var ok bool
+	var ts int64
+	var err error
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err = s.refresh()
+	if err != nil {
+		return err
+	}
+
+	if expected != nil {
+		var expectedOwner string = expected.ownerColumn()
+
+		current, ok = s.events[e.ID]
+		if !ok {
+			return ErrEventNotFound
+		}
+		if current.Owner != expectedOwner {
+			return ErrOwnerChanged
+		}
+
+		entry.Op = "details"
+		entry.ExpectOwner = &expectedOwner
+	}
+
+	ts = s.newTimestamp()
+	r = &eventRecord{
+		ID:          e.ID,
+		Title:       e.Title,
+		Description: e.Description,
+		Owner:       e.ownerColumn(),
+		MinStaff:    e.MinStaff,
+		MaxStaff:    e.MaxStaff,
+		Start:       e.Start.Unix() * 1000,
+		End:         e.Start.Add(e.Duration).Unix() * 1000,
+		Required:    e.Required,
+		GeneratorID: e.GeneratorID,
+		UpdateTS:    ts,
+	}
+	if e.Reference != nil {
+		r.Reference = e.Reference.String()
+	}
+	entry.Event = r
+
+	err = s.commit(entry)
+	if err != nil {
+		return err
+	}
+
+	// Another process may have changed the owners or deleted the event
+	// just before our entry, in which case it was not applied.
+	if expected != nil {
+		current, ok = s.events[e.ID]
+		if !ok {
+			return ErrEventNotFound
+		} else if current.UpdateTS != ts {
+			return ErrOwnerChanged
+		}
+	}
+
+	e.updateTS = ts
+	return nil
+}
+
+// DeleteEvent removes the event from memory and records the deletion in
+// the journal.
+func (s *MemoryEventStore) DeleteEvent(e *Event) error {
+	var err error
+
+	if e.updateTS == 0 {
+		return errors.New("Object not synced to database yet")
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err = s.refresh()
+	if err != nil {
+		return err
+	}
+
+	return s.commit(&journalEntry{Op: "delete", ID: e.ID})
+}
+
+// SyncOwners changes the owners and handover offers of the stored event to
+// those of "e" if they are still those of "expected".
+func (s *MemoryEventStore) SyncOwners(e *Event, expected *Event) error {
+	var expectedOwner string = expected.ownerColumn()
+	var current, r *eventRecord
+	var ok bool
+	var ts int64
+	var err error
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err = s.refresh()
+	if err != nil {
+		return err
+	}
+
+	current, ok = s.events[e.ID]
+	if !ok {
+		return ErrEventNotFound
+	}
+	if current.Owner != expectedOwner {
+		return ErrOwnerChanged
+	}
+
+	ts = s.newTimestamp()
+	r = new(eventRecord)
+	*r = *current
+	r.Owner = e.ownerColumn()
+	r.UpdateTS = ts
+
+	err = s.commit(&journalEntry{Op: "sync", Event: r,
+		ExpectOwner: &expectedOwner})
+	if err != nil {
+		return err
+	}
+
+	// Another process may have appended a competing entry just before
+	// ours, in which case ours was not applied.
+	current, ok = s.events[e.ID]
+	if !ok || current.UpdateTS != ts {
+		return ErrOwnerChanged
+	}
+
+	e.updateTS = ts
+	return nil
+}
+
+// AppendHistory adds the entry "h" to the change history in memory and
+// appends it to the journal.
+func (s *MemoryEventStore) AppendHistory(h *HistoryEntry) error {
+	var err error
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err = s.refresh()
+	if err != nil {
+		return err
+	}
+
+	return s.commit(&journalEntry{Op: "history",
+		History: newHistoryRecord(h)})
+}
+
+// FetchHistory retrieves all history entries for the event "id", most
+// recent first.
+func (s *MemoryEventStore) FetchHistory(id string, loc *time.Location) (
+	[]*HistoryEntry, error) {
+	var rv []*HistoryEntry
+	var i int
+	var err error
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err = s.refresh()
+	if err != nil {
+		return rv, err
+	}
+
+	for i = len(s.history) - 1; i >= 0; i-- {
+		if s.history[i].EventID == id {
+			rv = append(rv, s.history[i].toEntry(loc))
+		}
+	}
+
+	return rv, nil
+}
+
+// FetchRecentHistory retrieves up to "limit" history entries recorded
+// after "since", most recent first.
+func (s *MemoryEventStore) FetchRecentHistory(since time.Time, limit int32,
+	loc *time.Location) ([]*HistoryEntry, error) {
+	var rv []*HistoryEntry
+	var i int
+	var err error
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err = s.refresh()
+	if err != nil {
+		return rv, err
+	}
+
+	// Entries are appended in the order they were made, so we can stop
+	// at the first one which is too old.
+	for i = len(s.history) - 1; i >= 0; i-- {
+		if s.history[i].Time < since.UnixNano()/1000 {
+			break
+		}
+		if limit > 0 && int32(len(rv)) >= limit {
+			break
+		}
+
+		rv = append(rv, s.history[i].toEntry(loc))
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,314 @@
+package dutycal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a temporary directory for a journal. The caller has to remove
+// it once the test is done.
+func journalDir(t *testing.T) string {
+	var dir string
+	var err error
+
+	dir, err = ioutil.TempDir("", "dutycal")
+	if err != nil {
+		t.Fatal("Error creating temporary directory: ", err)
+	}
+
+	return dir
+}
+
+// Write "lines" to the journal file in "dir".
+func writeJournal(t *testing.T, dir string, lines ...string) {
+	var err error
+
+	err = ioutil.WriteFile(filepath.Join(dir, memoryStoreJournal),
+		[]byte(strings.Join(lines, "")), 0600)
+	if err != nil {
+		t.Fatal("Error writing journal: ", err)
+	}
+}
+
+// Open the journal in "dir", failing the test if that doesn't work.
+func openJournal(t *testing.T, dir string) *MemoryEventStore {
+	var s *MemoryEventStore
+	var err error
+
+	s, err = OpenFileEventStore(dir)
+	if err != nil {
+		t.Fatal("Error opening journal: ", err)
+	}
+
+	return s
+}
+
+// Check that the event "id" in "store" has the title "title" and the
+// owners "owners", separated by commas.
+func checkStoredEvent(t *testing.T, name string, store EventStore,
+	id, title, owners string) {
+	var e *Event
+	var err error
+
+	e, err = store.FetchEvent(id, time.UTC, true)
+	if err != nil {
+		t.Errorf("%s: error fetching %s: %s", name, id, err)
+		return
+	}
+	if e.Title != title || e.ownerColumn() != owners {
+		t.Errorf("%s: got %q owned by %q, want %q owned by %q", name,
+			e.Title, e.ownerColumn(), title, owners)
+	}
+}
+
+func TestMemoryFetchEventRange(t *testing.T) {
+	var loc *time.Location = zurich(t)
+	var store *MemoryEventStore = NewMemoryEventStore()
+
+	addRangeTestEvents(t, store, loc)
+	checkFetchEventRange(t, store, loc)
+}
+
+func TestMemorySyncDetails(t *testing.T) {
+	checkSyncDetails(t, NewMemoryEventStore())
+}
+
+func TestFileSyncDetails(t *testing.T) {
+	var dir string = journalDir(t)
+
+	defer os.RemoveAll(dir)
+
+	checkSyncDetails(t, openJournal(t, dir))
+}
+
+func TestFileFetchEventRangeAfterReplay(t *testing.T) {
+	var loc *time.Location = zurich(t)
+	var dir string = journalDir(t)
+
+	defer os.RemoveAll(dir)
+
+	addRangeTestEvents(t, openJournal(t, dir), loc)
+	checkFetchEventRange(t, openJournal(t, dir), loc)
+}
+
+func TestJournalReplay(t *testing.T) {
+	var dir string = journalDir(t)
+	var s *MemoryEventStore = openJournal(t, dir)
+	var start time.Time = time.Date(2027, 3, 2, 18, 0, 0, 0, time.UTC)
+	var kept, gone *Event
+	var history []*HistoryEntry
+	var err error
+
+	defer os.RemoveAll(dir)
+
+	kept = CreateEvent(s, "Kept", "Test event", "", start, time.Hour,
+		time.UTC, nil, true)
+	kept.MaxStaff = 2
+	gone = CreateEvent(s, "Gone", "Test event", "", start.Add(time.Hour),
+		time.Hour, time.UTC, nil, true)
+	if kept.Sync() != nil || gone.Sync() != nil {
+		t.Fatal("Error writing events")
+	}
+
+	err = kept.AddOwner("alice")
+	if err == nil {
+		err = kept.AddOwner("bob")
+	}
+	if err == nil {
+		err = kept.RemoveOwner("alice")
+	}
+	if err == nil {
+		var read Event = *kept
+
+		kept.Title = "Renamed"
+		err = kept.SyncDetails(&read)
+	}
+	if err == nil {
+		err = gone.Delete()
+	}
+	if err == nil {
+		err = s.AppendHistory(&HistoryEntry{EventID: kept.ID,
+			Time: time.Now(), Actor: "alice", Action: HistoryTake})
+	}
+	if err != nil {
+		t.Fatal("Error changing events: ", err)
+	}
+
+	s = openJournal(t, dir)
+	checkStoredEvent(t, "replayed", s, kept.ID, "Renamed", "bob")
+
+	_, err = s.FetchEvent(gone.ID, time.UTC, true)
+	if err != ErrEventNotFound {
+		t.Errorf("deleted event: got %v, want %v", err, ErrEventNotFound)
+	}
+
+	history, err = s.FetchHistory(kept.ID, time.UTC)
+	if err != nil || len(history) != 1 || history[0].Actor != "alice" {
+		t.Errorf("history: got %v (%v), want one entry by alice", history,
+			err)
+	}
+}
+
+// Journal entries written by competing processes and how the event ends
+// up once they have been replayed.
+type journalReplayTest struct {
+	name   string
+	lines  []string
+	title  string
+	owners string
+}
+
+func TestJournalReplayConditionalEntries(t *testing.T) {
+	var event string = `{"op":"sync","event":{"id":"e","title":"Event",` +
+		`"description":"","owner":"","start":0,"end":3600000,` +
+		`"required":true,"update_ts":1}}` + "\n"
+	var test journalReplayTest
+	var tests = []journalReplayTest{
+		{
+			name: "first conditional write wins",
+			lines: []string{
+				event,
+				`{"op":"sync","event":{"id":"e","title":"Event",` +
+					`"owner":"alice","update_ts":2},` +
+					`"expect_owner":""}` + "\n",
+				`{"op":"sync","event":{"id":"e","title":"Event",` +
+					`"owner":"bob","update_ts":3},` +
+					`"expect_owner":""}` + "\n",
+			},
+			title:  "Event",
+			owners: "alice",
+		},
+		{
+			name: "conditional write based on the winner",
+			lines: []string{
+				event,
+				`{"op":"sync","event":{"id":"e","title":"Event",` +
+					`"owner":"alice","update_ts":2},` +
+					`"expect_owner":""}` + "\n",
+				`{"op":"sync","event":{"id":"e","title":"Event",` +
+					`"owner":"alice,bob","update_ts":3},` +
+					`"expect_owner":"alice"}` + "\n",
+			},
+			title:  "Event",
+			owners: "alice,bob",
+		},
+		{
+			name: "details keep the owners",
+			lines: []string{
+				event,
+				`{"op":"sync","event":{"id":"e","title":"Event",` +
+					`"owner":"alice","update_ts":2},` +
+					`"expect_owner":""}` + "\n",
+				`{"op":"details","event":{"id":"e","title":"Renamed",` +
+					`"owner":"","update_ts":3}}` + "\n",
+			},
+			title:  "Renamed",
+			owners: "alice",
+		},
+		{
+			name: "details based on changed owners",
+			lines: []string{
+				event,
+				`{"op":"sync","event":{"id":"e","title":"Event",` +
+					`"owner":"alice","update_ts":2},` +
+					`"expect_owner":""}` + "\n",
+				`{"op":"details","event":{"id":"e","title":"Renamed",` +
+					`"owner":"","update_ts":3},"expect_owner":""}` + "\n",
+			},
+			title:  "Event",
+			owners: "alice",
+		},
+		{
+			name: "entry torn by a crash",
+			lines: []string{
+				event,
+				`{"op":"sync","event":{"id":"e","title":"Torn",`,
+				`{"op":"sync","event":{"id":"e","title":"Event",` +
+					`"owner":"alice","update_ts":2}}` + "\n",
+			},
+			title:  "Event",
+			owners: "alice",
+		},
+	}
+
+	for _, test = range tests {
+		var dir string = journalDir(t)
+
+		defer os.RemoveAll(dir)
+
+		writeJournal(t, dir, test.lines...)
+		checkStoredEvent(t, test.name, openJournal(t, dir), "e",
+			test.title, test.owners)
+	}
+}
+
+func TestJournalDetailsOfDeletedEvent(t *testing.T) {
+	var dir string = journalDir(t)
+	var s *MemoryEventStore
+
+	defer os.RemoveAll(dir)
+
+	writeJournal(t, dir,
+		`{"op":"sync","event":{"id":"e","title":"Event","update_ts":1}}`+
+			"\n",
+		`{"op":"delete","id":"e"}`+"\n",
+		`{"op":"details","event":{"id":"e","title":"Renamed",`+
+			`"update_ts":2}}`+"\n")
+
+	s = openJournal(t, dir)
+	if len(s.events) != 0 {
+		t.Errorf("got %d events, want none", len(s.events))
+	}
+}
+
+func TestJournalTornLastLine(t *testing.T) {
+	var dir string = journalDir(t)
+	var s *MemoryEventStore
+	var e *Event
+	var err error
+
+	defer os.RemoveAll(dir)
+
+	writeJournal(t, dir,
+		`{"op":"sync","event":{"id":"e","title":"Event","update_ts":1}}`+
+			"\n",
+		`{"op":"sync","event":{"id":"e","title":"To`)
+
+	s = openJournal(t, dir)
+	checkStoredEvent(t, "before writing", s, "e", "Event", "")
+
+	e = CreateEvent(s, "New", "Test event", "",
+		time.Date(2027, 3, 2, 18, 0, 0, 0, time.UTC), time.Hour, time.UTC,
+		nil, true)
+	err = e.Sync()
+	if err != nil {
+		t.Fatal("Error writing after a torn entry: ", err)
+	}
+
+	s = openJournal(t, dir)
+	checkStoredEvent(t, "after writing", s, "e", "Event", "")
+	checkStoredEvent(t, "after writing", s, e.ID, "New", "")
+}
+
+func TestJournalCorruptLine(t *testing.T) {
+	var dir string = journalDir(t)
+	var err error
+
+	defer os.RemoveAll(dir)
+
+	writeJournal(t, dir,
+		`{"op":"sync","event":{"id":"e","title":"Event","update_ts":1}}`+
+			"\n",
+		"\n",
+		"garbage\n",
+		`{"op":"delete","id":"e"}`+"\n")
+
+	_, err = OpenFileEventStore(dir)
+	if err == nil || !strings.Contains(err.Error(), ":3:") {
+		t.Errorf("got %v, want an error about line 3", err)
+	}
+}
@@ -1,7 +1,6 @@
 package dutycal
 
 import (
-	"database/cassandra"
 	"html/template"
 	"io"
 	"log"
@@ -16,7 +15,7 @@ import (
 type NewEventHandler struct {
 	auth      *ancientauth.Authenticator
 	am        *authManager
-	db        *cassandra.RetryCassandraClient
+	store     EventStore
 	templates *template.Template
 	config    *DutyCalConfig
 	location  *time.Location
@@ -24,6 +23,7 @@ type NewEventHandler struct {
 
 type NewEventHandlerData struct {
 	Auth        AuthDetails
+	Action      string
 	Ev          *Event
 	StartHour   int
 	StartMinute int
@@ -32,19 +32,20 @@ type NewEventHandlerData struct {
 
 	DateFormatted string
 	Error         string
+	CSRFToken     string
 
 	Data     url.Values
 	PostData url.Values
 }
 
 func NewNewEventHandler(
-	db *cassandra.RetryCassandraClient,
+	store EventStore,
 	auth *ancientauth.Authenticator,
 	loc *time.Location,
 	tmpl *template.Template,
 	conf *DutyCalConfig) *NewEventHandler {
-	if db == nil {
-		log.Panic("db is nil")
+	if store == nil {
+		log.Panic("store is nil")
 	}
 	if conf == nil {
 		log.Panic("conf is nil")
@@ -58,44 +59,26 @@ func NewNewEventHandler(
 	return &NewEventHandler{
 		auth:      auth,
 		am:        NewAuthManager(auth),
-		db:        db,
+		store:     store,
 		templates: tmpl,
 		config:    conf,
 		location:  loc,
 	}
 }
 
-func (h *NewEventHandler) ServeHTTP(
-	rw http.ResponseWriter, req *http.Request) {
-	var user string
-	var ed NewEventHandlerData
+// Read the event details submitted through the event form in "req" into
+// ed.Ev, converting times to the location "loc". Any problems are recorded
+// in ed.Error. Returns true if the submitted event is complete and valid.
+func readEventForm(req *http.Request, loc *time.Location,
+	ed *NewEventHandlerData) bool {
 	var on_date time.Time
 	var start, end time.Time
 	var title, description string
 	var offset_hour, offset_minute int
+	var min_staff, max_staff int64
 	var reference *url.URL
 	var err error
 
-	user = h.auth.GetAuthenticatedUser(req)
-	if len(user) == 0 {
-		h.auth.RequestAuthorization(rw, req)
-		return
-	}
-
-	if !h.auth.IsAuthenticatedScope(req, h.config.GetEditScope()) {
-		rw.WriteHeader(http.StatusForbidden)
-		io.WriteString(rw, "No permission to create events: "+
-			user+" is not in "+h.config.GetEditScope()+"\r\n")
-	}
-
-	err = req.ParseForm()
-	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		io.WriteString(rw, "Error parsing newevent form: "+
-			err.Error()+"\r\n")
-		log.Print("Error parsing newevent form: ", err)
-	}
-
 	title = req.PostFormValue("title")
 	description = req.PostFormValue("description")
 
@@ -103,8 +86,7 @@ func (h *NewEventHandler) ServeHTTP(
 		on_date = time.Now().Truncate(24 * time.Hour)
 	} else {
 		on_date, err = time.ParseInLocation(
-			"02.01.2006", req.PostFormValue("date"),
-			h.location)
+			"02.01.2006", req.PostFormValue("date"), loc)
 		if err != nil {
 			ed.Error = err.Error()
 		}
@@ -117,7 +99,7 @@ func (h *NewEventHandler) ServeHTTP(
 			ed.Error += " " + err.Error()
 		}
 	}
-	if len(req.PostFormValue("start-hour")) > 0 {
+	if len(req.PostFormValue("start-minute")) > 0 {
 		offset_minute, err = strconv.Atoi(req.PostFormValue("start-minute"))
 		if err != nil {
 			ed.Error += " " + err.Error()
@@ -152,6 +134,31 @@ func (h *NewEventHandler) ServeHTTP(
 		}
 	}
 
+	min_staff = int64(ed.Ev.MinStaff)
+	if len(req.PostFormValue("min-staff")) > 0 {
+		min_staff, err = strconv.ParseInt(
+			req.PostFormValue("min-staff"), 10, 32)
+		if err != nil {
+			ed.Error += " " + err.Error()
+		}
+	}
+	max_staff = int64(ed.Ev.MaxStaff)
+	if len(req.PostFormValue("max-staff")) > 0 {
+		max_staff, err = strconv.ParseInt(
+			req.PostFormValue("max-staff"), 10, 32)
+		if err != nil {
+			ed.Error += " " + err.Error()
+		}
+	}
+	if min_staff < 1 || max_staff < min_staff {
+		ed.Error += " At least one person must be needed, and no " +
+			"more than can take part."
+	}
+	if max_staff < int64(len(ed.Ev.Owners)) {
+		ed.Error += " More people have already signed up than can " +
+			"take part."
+	}
+
 	end = on_date.Add(
 		time.Duration(offset_hour) * time.Hour).Add(
 		time.Duration(offset_minute) * time.Minute)
@@ -166,21 +173,69 @@ func (h *NewEventHandler) ServeHTTP(
 		ed.Error += " Event starts after it ends."
 	}
 
-	ed.Ev = CreateEvent(h.db, h.config, title, description, user, start,
-		end.Sub(start), h.location, reference, false)
+	ed.Ev.Title = title
+	ed.Ev.Description = description
+	ed.Ev.Start = start.In(loc)
+	ed.Ev.Duration = end.Sub(start)
+	ed.Ev.Reference = reference
+	ed.Ev.MinStaff = int32(min_staff)
+	ed.Ev.MaxStaff = int32(max_staff)
 
-	if len(ed.Error) == 0 && ed.StartHour >= 0 && ed.StartHour < 24 &&
+	return len(ed.Error) == 0 && ed.StartHour >= 0 && ed.StartHour < 24 &&
 		ed.EndHour >= 0 && ed.EndHour < 24 && ed.StartMinute >= 0 &&
 		ed.StartMinute < 60 && ed.EndHour >= 0 && ed.EndHour < 24 &&
 		ed.EndMinute >= 0 && ed.EndMinute < 60 && ed.Ev.Duration > 0 &&
-		len(title) > 0 && len(description) > 0 {
+		len(title) > 0 && len(description) > 0
+}
+
+func (h *NewEventHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	var user, session string
+	var ed NewEventHandlerData
+	var err error
+
+	user = h.auth.GetAuthenticatedUser(req)
+	if len(user) == 0 {
+		h.auth.RequestAuthorization(rw, req)
+		return
+	}
+
+	if !h.auth.IsAuthenticatedScope(req, h.config.GetEditScope()) {
+		rw.WriteHeader(http.StatusForbidden)
+		io.WriteString(rw, "No permission to create events: "+
+			user+" is not in "+h.config.GetEditScope()+"\r\n")
+		return
+	}
+
+	session = sessionID(rw, req)
+
+	err = req.ParseForm()
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(rw, "Error parsing newevent form: "+
+			err.Error()+"\r\n")
+		log.Print("Error parsing newevent form: ", err)
+	}
+
+	ed.Action = "/newevent"
+	ed.CSRFToken = genCSRFToken(h.config, user, session)
+	ed.Ev = CreateEvent(h.store, "", "", user, time.Now(), 0, h.location,
+		nil, false)
+
+	if req.Method == http.MethodPost && !checkCSRFToken(h.config, user,
+		session, req.PostFormValue("csrf_token")) {
+		readEventForm(req, h.location, &ed)
+		ed.Error = "Invalid or expired form token, please submit again."
+	} else if readEventForm(req, h.location, &ed) &&
+		req.Method == http.MethodPost {
 		err = ed.Ev.Sync()
 
 		if err == nil {
+			RecordHistory(h.store, HistoryCreate, user, nil, ed.Ev)
 			rw.Header().Set("Location",
 				"/?week="+strconv.FormatInt(
 					getWeekFromTimestamp(ed.Ev.Start), 10))
-			rw.WriteHeader(http.StatusTemporaryRedirect)
+			rw.WriteHeader(http.StatusSeeOther)
 			return
 		}
 
@@ -0,0 +1,59 @@
+package dutycal
+
+// EventPermissions describes which operations a user may perform on an
+// individual event. All handlers, whether HTML or JSON, should use these
+// rules so they cannot drift apart.
+type EventPermissions struct {
+	// The user may sign up as one of the owners of the event.
+	CanTake bool
+
+	// The user may remove themselves from the owners of the event.
+	CanDisclaim bool
+
+	// The user may remove the event from the calendar.
+	CanDelete bool
+
+	// The user may change the details of the event.
+	CanEdit bool
+
+	// The user may offer their place to someone else.
+	CanHandover bool
+
+	// The user may withdraw their pending handover offer.
+	CanWithdraw bool
+
+	// The user may take over the place of another owner who offered it.
+	CanAccept bool
+}
+
+// GetEventPermissions determines what "user" may do with the event "ev".
+// "inScope" specifies whether the user is authenticated to the edit scope.
+func GetEventPermissions(ev *Event, user string,
+	inScope bool) EventPermissions {
+	var rv EventPermissions
+	var soleOwner bool
+
+	if len(user) == 0 {
+		return rv
+	}
+
+	rv.CanTake = inScope && !ev.HasOwner(user) && !ev.IsFull()
+	rv.CanDisclaim = ev.HasOwner(user)
+
+	// Handovers happen between members, so accepting one is subject to
+	// the same rules as taking a shift.
+	rv.CanHandover = ev.HasOwner(user) && ev.HandoverFrom(user) == nil
+	rv.CanWithdraw = ev.HandoverFrom(user) != nil
+	rv.CanAccept = inScope && len(ev.HandoversFor(user)) > 0
+
+	// Events shared with other people must not disappear under them.
+	soleOwner = len(ev.Owners) == 1 && ev.Owners[0] == user
+	rv.CanDelete = !ev.Required && soleOwner
+
+	// Required and generated events belong to everyone, so only members
+	// of the edit scope may change them.
+	rv.CanEdit = inScope || (soleOwner && !ev.Required &&
+		len(ev.GeneratorID) == 0)
+
+	return rv
+}
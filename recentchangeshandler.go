@@ -0,0 +1,106 @@
+package dutycal
+
+import (
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"ancient-solutions.com/ancientauth"
+)
+
+// Maximum number of entries displayed on the recent changes page.
+const recentChangesLimit = 200
+
+// RecentChangesHandler displays the most recent changes to any event in
+// the calendar. Since the history contains personal details, it is only
+// available to users in the edit scope.
+type RecentChangesHandler struct {
+	auth      *ancientauth.Authenticator
+	am        *authManager
+	store     EventStore
+	templates *template.Template
+	config    *DutyCalConfig
+	location  *time.Location
+}
+
+// RecentChangesData holds all the data to be presented to the user from
+// the template of the recent changes handler.
+type RecentChangesData struct {
+	Auth AuthDetails
+
+	Since   time.Time
+	Changes []*HistoryEntry
+}
+
+// NewRecentChangesHandler creates a new handler for displaying the recent
+// changes to the events in "store". Times are converted to "loc".
+func NewRecentChangesHandler(
+	store EventStore,
+	auth *ancientauth.Authenticator,
+	loc *time.Location,
+	tmpl *template.Template,
+	conf *DutyCalConfig) *RecentChangesHandler {
+	if store == nil {
+		log.Panic("store is nil")
+	}
+	if conf == nil {
+		log.Panic("conf is nil")
+	}
+	if tmpl == nil {
+		log.Panic("tmpl is nil")
+	}
+	if loc == nil {
+		log.Panic("loc is nil")
+	}
+	return &RecentChangesHandler{
+		auth:      auth,
+		am:        NewAuthManager(auth),
+		store:     store,
+		templates: tmpl,
+		config:    conf,
+		location:  loc,
+	}
+}
+
+func (h *RecentChangesHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	var user string
+	var rd RecentChangesData
+	var err error
+
+	user = h.auth.GetAuthenticatedUser(req)
+	if len(user) == 0 {
+		h.auth.RequestAuthorization(rw, req)
+		return
+	}
+
+	if !h.auth.IsAuthenticatedScope(req, h.config.GetEditScope()) {
+		rw.WriteHeader(http.StatusForbidden)
+		io.WriteString(rw, "No permission to view the change history: "+
+			user+" is not in "+h.config.GetEditScope()+"\r\n")
+		return
+	}
+
+	rd.Since = time.Now().In(h.location).AddDate(
+		0, 0, -int(h.config.GetHistoryRecentDays()))
+	rd.Changes, err = h.store.FetchRecentHistory(rd.Since,
+		recentChangesLimit, h.location)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(rw, "Error fetching recent changes: "+
+			err.Error()+"\r\n")
+		log.Print("Error fetching recent changes: ", err)
+		return
+	}
+
+	h.am.GenAuthDetails(req, &rd.Auth)
+	err = h.templates.ExecuteTemplate(rw, "changes.html", &rd)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(rw, "Error executing recent changes template: "+
+			err.Error()+"\r\n")
+		log.Print("Error executing recent changes template: ", err)
+	}
+}
@@ -0,0 +1,580 @@
+package dutycal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema migrations for the SQL event store. They are applied in order, and
+// the number of the last applied migration is recorded in the
+// schema_migrations table. Never change existing entries; only append.
+// "%[1]s" is replaced with the dialect specific binary column type.
+var sqlMigrations []string = []string{
+	`CREATE TABLE events (
+		id VARCHAR(255) PRIMARY KEY,
+		title TEXT NOT NULL,
+		description TEXT NOT NULL,
+		owner VARCHAR(255) NOT NULL DEFAULT '',
+		start_ts BIGINT NOT NULL,
+		end_ts BIGINT NOT NULL,
+		required BOOLEAN NOT NULL DEFAULT FALSE,
+		reference TEXT NOT NULL DEFAULT '',
+		generator_id %[1]s,
+		update_ts BIGINT NOT NULL
+	)`,
+	`CREATE INDEX events_range_idx ON events (start_ts, end_ts)`,
+	`CREATE INDEX events_owner_idx ON events (owner, start_ts)`,
+	`CREATE TABLE event_history (
+		event_id VARCHAR(255) NOT NULL,
+		ts BIGINT NOT NULL,
+		actor VARCHAR(255) NOT NULL DEFAULT '',
+		action VARCHAR(32) NOT NULL,
+		title TEXT NOT NULL DEFAULT '',
+		changes TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX event_history_event_idx ON event_history (event_id, ts)`,
+	`CREATE INDEX event_history_ts_idx ON event_history (ts)`,
+	`ALTER TABLE events ADD COLUMN min_staff INTEGER NOT NULL DEFAULT 1`,
+	`ALTER TABLE events ADD COLUMN max_staff INTEGER NOT NULL DEFAULT 1`,
+	// The owner column holds the whole list of owners and handover
+	// offers, which doesn't fit into 255 characters, and owners are
+	// filtered after reading the events, so the index isn't used. SQLite
+	// can't change the type of a column, and older versions can't drop
+	// or rename them either, so the table is rebuilt as recommended in
+	// https://www.sqlite.org/lang_altertable.html.
+	`DROP INDEX events_owner_idx`,
+	`CREATE TABLE events_new (
+		id VARCHAR(255) PRIMARY KEY,
+		title TEXT NOT NULL,
+		description TEXT NOT NULL,
+		owner TEXT NOT NULL DEFAULT '',
+		start_ts BIGINT NOT NULL,
+		end_ts BIGINT NOT NULL,
+		required BOOLEAN NOT NULL DEFAULT FALSE,
+		reference TEXT NOT NULL DEFAULT '',
+		generator_id %[1]s,
+		update_ts BIGINT NOT NULL,
+		min_staff INTEGER NOT NULL DEFAULT 1,
+		max_staff INTEGER NOT NULL DEFAULT 1
+	)`,
+	`INSERT INTO events_new (id, title, description, owner, start_ts,
+			end_ts, required, reference, generator_id, update_ts,
+			min_staff, max_staff)
+		SELECT id, title, description, owner, start_ts, end_ts, required,
+			reference, generator_id, update_ts, min_staff, max_staff
+		FROM events`,
+	`DROP TABLE events`,
+	`ALTER TABLE events_new RENAME TO events`,
+	`CREATE INDEX events_range_idx ON events (start_ts, end_ts)`,
+}
+
+// Columns to read for reconstructing events, in the order expected by
+// scanEvent. The owner column contains the list of owners, separated by
+// commas.
+const sqlEventColumns = "id, title, description, owner, start_ts, end_ts, " +
+	"required, reference, generator_id, update_ts, min_staff, max_staff"
+
+// Columns to read for reconstructing history entries, in the order expected
+// by scanHistory.
+const sqlHistoryColumns = "event_id, ts, actor, action, title, changes"
+
+// SQLEventStore is an EventStore keeping events in a relational database
+// accessed through database/sql. SQLite and PostgreSQL are supported. The
+// database drivers aren't imported here, so programs using the store must
+// import the ones they want to support.
+type SQLEventStore struct {
+	db *sql.DB
+
+	// Whether the database wants numbered ($1) rather than question mark
+	// placeholders.
+	numberedPlaceholders bool
+	blobType             string
+}
+
+// NewSQLEventStore creates a new event store on the database "db", which
+// was opened with the database/sql driver "driver". The database schema is
+// created or updated as required.
+func NewSQLEventStore(db *sql.DB, driver string) (*SQLEventStore, error) {
+	var s *SQLEventStore = &SQLEventStore{
+		db:       db,
+		blobType: "BLOB",
+	}
+	var err error
+
+	if driver == "postgres" || driver == "pgx" {
+		s.numberedPlaceholders = true
+		s.blobType = "BYTEA"
+	}
+
+	err = s.migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// OpenSQLEventStore connects to the SQL database specified in "conf".
+func OpenSQLEventStore(conf *SQLDatabaseConfig) (*SQLEventStore, error) {
+	var db *sql.DB
+	var s *SQLEventStore
+	var err error
+
+	db, err = sql.Open(conf.GetDriver(), conf.GetDsn())
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %s database: %s",
+			conf.GetDriver(), err)
+	}
+
+	s, err = NewSQLEventStore(db, conf.GetDriver())
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error setting up %s database: %s",
+			conf.GetDriver(), err)
+	}
+
+	return s, nil
+}
+
+// Rewrite question mark placeholders into the form the database expects.
+func (s *SQLEventStore) rebind(query string) string {
+	var rv []byte
+	var n int
+	var i int
+
+	if !s.numberedPlaceholders {
+		return query
+	}
+
+	for i = 0; i < len(query); i++ {
+		if query[i] == '?' {
+			n++
+			rv = append(rv, '$')
+			rv = strconv.AppendInt(rv, int64(n), 10)
+		} else {
+			rv = append(rv, query[i])
+		}
+	}
+
+	return string(rv)
+}
+
+// Bring the database schema up to date.
+func (s *SQLEventStore) migrate() error {
+	var version int
+	var err error
+
+	_, err = s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY
+	)`)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.QueryRow(
+		"SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(
+		&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(sqlMigrations); version++ {
+		var tx *sql.Tx
+
+		tx, err = s.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(strings.Replace(sqlMigrations[version], "%[1]s",
+			s.blobType, -1))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Error applying migration %d: %s",
+				version+1, err)
+		}
+
+		_, err = tx.Exec(s.rebind(
+			"INSERT INTO schema_migrations (version) VALUES (?)"),
+			version+1)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Interface shared by sql.Row and sql.Rows.
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Reconstruct an event from a row containing sqlEventColumns.
+func (s *SQLEventStore) scanEvent(row sqlScanner, loc *time.Location) (
+	*Event, error) {
+	var e *Event = &Event{
+		store:    s,
+		location: loc,
+	}
+	var start, end int64
+	var owner, reference string
+	var err error
+
+	err = row.Scan(&e.ID, &e.Title, &e.Description, &owner, &start, &end,
+		&e.Required, &reference, &e.GeneratorID, &e.updateTS, &e.MinStaff,
+		&e.MaxStaff)
+	if err != nil {
+		return nil, err
+	}
+
+	e.setOwnerColumn(owner)
+	e.normalizeStaff()
+	e.Start = time.Unix(start/1000, (start%1000)*1000000).In(loc)
+	e.Duration = time.Duration(end-start) * time.Millisecond
+	if len(reference) > 0 {
+		e.Reference, _ = url.Parse(reference)
+	}
+
+	return e, nil
+}
+
+// FetchEvent recreates the in-memory event object for the record "id".
+// The "quorum" flag has no effect; the database is always consistent.
+func (s *SQLEventStore) FetchEvent(id string, loc *time.Location,
+	quorum bool) (*Event, error) {
+	var e *Event
+	var err error
+
+	e, err = s.scanEvent(s.db.QueryRow(s.rebind(
+		"SELECT "+sqlEventColumns+" FROM events WHERE id = ?"), id), loc)
+	if err == sql.ErrNoRows {
+		return nil, ErrEventNotFound
+	}
+
+	return e, err
+}
+
+// FetchEventRange retrieves a list of all events between the two specified
+// dates, sorted by start time. If a limit is given, only up to that many
+// records will be returned. If "user" is not nil, the specified user must be
+// one of the owners, or if it is empty, the event must need more owners.
+// Since owners are stored as a list, this is checked after reading the
+// events rather than by the database.
+func (s *SQLEventStore) FetchEventRange(from, to time.Time, limit int32,
+	loc *time.Location, user *string, quorum bool) ([]*Event, error) {
+	var conditions []string
+	var args []interface{}
+	var query string
+	var rows *sql.Rows
+	var rv []*Event
+	var err error
+
+	if to.Unix() != 0 {
+		conditions = append(conditions, "start_ts <= ?")
+		args = append(args, to.Unix()*1000)
+	}
+	if from.Unix() != 0 {
+		conditions = append(conditions, "end_ts >= ?")
+		args = append(args, from.Unix()*1000)
+	}
+
+	query = "SELECT " + sqlEventColumns + " FROM events"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY start_ts, id"
+	if limit > 0 && user == nil {
+		query += " LIMIT " + strconv.FormatInt(int64(limit), 10)
+	}
+
+	rows, err = s.db.Query(s.rebind(query), args...)
+	if err != nil {
+		return []*Event{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e *Event
+
+		e, err = s.scanEvent(rows, loc)
+		if err != nil {
+			return rv, err
+		}
+
+		if !e.matchesUser(user) {
+			continue
+		}
+
+		rv = append(rv, e)
+		if limit > 0 && int32(len(rv)) >= limit {
+			break
+		}
+	}
+
+	return rv, rows.Err()
+}
+
+// SyncEvent writes the event to the database, replacing any previous
+// version with the same ID.
+func (s *SQLEventStore) SyncEvent(e *Event) error {
+	var reference string
+	var ts int64
+	var err error
+
+	// Timestamps are in microseconds, just like in Cassandra.
+	ts = time.Now().UnixNano() / 1000
+
+	if e.Reference != nil {
+		reference = e.Reference.String()
+	}
+
+	_, err = s.db.Exec(s.rebind(`INSERT INTO events (`+sqlEventColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			title = excluded.title,
+			description = excluded.description,
+			owner = excluded.owner,
+			start_ts = excluded.start_ts,
+			end_ts = excluded.end_ts,
+			required = excluded.required,
+			reference = excluded.reference,
+			generator_id = excluded.generator_id,
+			update_ts = excluded.update_ts,
+			min_staff = excluded.min_staff,
+			max_staff = excluded.max_staff`),
+		e.ID, e.Title, e.Description, e.ownerColumn(),
+		e.Start.Unix()*1000, e.Start.Add(e.Duration).Unix()*1000, e.Required,
+		reference, e.GeneratorID, ts, e.MinStaff, e.MaxStaff)
+	if err != nil {
+		return err
+	}
+
+	e.updateTS = ts
+	return nil
+}
+
+// SyncDetails writes all fields of the event except for its owners to the
+// database, if the owners are still those of "expected". Returns
+// ErrEventNotFound if the event doesn't exist (anymore).
+func (s *SQLEventStore) SyncDetails(e *Event, expected *Event) error {
+	var res sql.Result
+	var reference string
+	var affected int64
+	var ts int64
+	var err error
+
+	ts = time.Now().UnixNano() / 1000
+
+	if e.Reference != nil {
+		reference = e.Reference.String()
+	}
+
+	res, err = s.db.Exec(s.rebind(`UPDATE events SET
+			title = ?,
+			description = ?,
+			start_ts = ?,
+			end_ts = ?,
+			required = ?,
+			reference = ?,
+			generator_id = ?,
+			update_ts = ?,
+			min_staff = ?,
+			max_staff = ?
+		WHERE id = ? AND owner = ?`),
+		e.Title, e.Description, e.Start.Unix()*1000,
+		e.Start.Add(e.Duration).Unix()*1000, e.Required, reference,
+		e.GeneratorID, ts, e.MinStaff, e.MaxStaff, e.ID,
+		expected.ownerColumn())
+	if err != nil {
+		return err
+	}
+
+	affected, err = res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return s.conflict(e.ID, ErrOwnerChanged)
+	}
+
+	e.updateTS = ts
+	return nil
+}
+
+// DeleteEvent removes the event from the database, unless it has been
+// modified since it was read, in which case ErrEventChanged is returned.
+func (s *SQLEventStore) DeleteEvent(e *Event) error {
+	var res sql.Result
+	var affected int64
+	var err error
+
+	if e.updateTS == 0 {
+		return errors.New("Object not synced to database yet")
+	}
+
+	res, err = s.db.Exec(s.rebind(
+		"DELETE FROM events WHERE id = ? AND update_ts <= ?"),
+		e.ID, e.updateTS)
+	if err != nil {
+		return err
+	}
+
+	affected, err = res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return s.conflict(e.ID, ErrEventChanged)
+	}
+
+	return nil
+}
+
+// Determine why a conditional write to the event "id" didn't change
+// anything: either the event is gone, or it was changed by someone else,
+// in which case "changed" is returned.
+func (s *SQLEventStore) conflict(id string, changed error) error {
+	var count int
+	var err error
+
+	err = s.db.QueryRow(s.rebind(
+		"SELECT COUNT(*) FROM events WHERE id = ?"), id).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrEventNotFound
+	}
+
+	return changed
+}
+
+// SyncOwners changes the owners and handover offers of the stored event to
+// those of "e" if they are still those of "expected".
+func (s *SQLEventStore) SyncOwners(e *Event, expected *Event) error {
+	var res sql.Result
+	var affected int64
+	var ts int64
+	var err error
+
+	ts = time.Now().UnixNano() / 1000
+
+	res, err = s.db.Exec(s.rebind(
+		"UPDATE events SET owner = ?, update_ts = ? "+
+			"WHERE id = ? AND owner = ?"),
+		e.ownerColumn(), ts, e.ID, expected.ownerColumn())
+	if err != nil {
+		return err
+	}
+
+	affected, err = res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrOwnerChanged
+	}
+
+	e.updateTS = ts
+	return nil
+}
+
+// AppendHistory adds the entry "h" to the event_history table. The changed
+// fields are stored as JSON.
+func (s *SQLEventStore) AppendHistory(h *HistoryEntry) error {
+	var r *historyRecord = newHistoryRecord(h)
+	var changes []byte
+	var err error
+
+	changes, err = json.Marshal(r.Changes)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(s.rebind("INSERT INTO event_history ("+
+		sqlHistoryColumns+") VALUES (?, ?, ?, ?, ?, ?)"),
+		r.EventID, r.Time, r.Actor, r.Action, r.Title, string(changes))
+	return err
+}
+
+// Read all history entries from "rows", which must contain
+// sqlHistoryColumns.
+func (s *SQLEventStore) scanHistory(rows *sql.Rows, loc *time.Location) (
+	[]*HistoryEntry, error) {
+	var rv []*HistoryEntry
+	var err error
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var r historyRecord
+		var changes string
+
+		err = rows.Scan(&r.EventID, &r.Time, &r.Actor, &r.Action, &r.Title,
+			&changes)
+		if err != nil {
+			return rv, err
+		}
+
+		if len(changes) > 0 {
+			err = json.Unmarshal([]byte(changes), &r.Changes)
+			if err != nil {
+				return rv, err
+			}
+		}
+
+		rv = append(rv, r.toEntry(loc))
+	}
+
+	return rv, rows.Err()
+}
+
+// FetchHistory retrieves all history entries for the event "id", most
+// recent first.
+func (s *SQLEventStore) FetchHistory(id string, loc *time.Location) (
+	[]*HistoryEntry, error) {
+	var rows *sql.Rows
+	var err error
+
+	rows, err = s.db.Query(s.rebind("SELECT "+sqlHistoryColumns+
+		" FROM event_history WHERE event_id = ? ORDER BY ts DESC"), id)
+	if err != nil {
+		return []*HistoryEntry{}, err
+	}
+
+	return s.scanHistory(rows, loc)
+}
+
+// FetchRecentHistory retrieves up to "limit" history entries recorded
+// after "since", most recent first.
+func (s *SQLEventStore) FetchRecentHistory(since time.Time, limit int32,
+	loc *time.Location) ([]*HistoryEntry, error) {
+	var query string = "SELECT " + sqlHistoryColumns +
+		" FROM event_history WHERE ts >= ? ORDER BY ts DESC"
+	var rows *sql.Rows
+	var err error
+
+	if limit > 0 {
+		query += " LIMIT " + strconv.FormatInt(int64(limit), 10)
+	}
+
+	rows, err = s.db.Query(s.rebind(query), since.UnixNano()/1000)
+	if err != nil {
+		return []*HistoryEntry{}, err
+	}
+
+	return s.scanHistory(rows, loc)
+}
@@ -0,0 +1,264 @@
+//go:build cgo
+// +build cgo
+
+package dutycal
+
+import (
+	"bytes"
+	"database/sql"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Open a new in-memory SQLite database.
+func openSQLite(t *testing.T) *sql.DB {
+	var db *sql.DB
+	var err error
+
+	db, err = sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("Error opening SQLite database: ", err)
+	}
+
+	// Every connection would get a database of its own.
+	db.SetMaxOpenConns(1)
+
+	return db
+}
+
+// Create an event store on a new in-memory SQLite database.
+func newSQLiteStore(t *testing.T) *SQLEventStore {
+	var s *SQLEventStore
+	var err error
+
+	s, err = NewSQLEventStore(openSQLite(t), "sqlite3")
+	if err != nil {
+		t.Fatal("Error creating event store: ", err)
+	}
+
+	return s
+}
+
+// Create and write an event starting at "start" to "store".
+func addSQLTestEvent(t *testing.T, store EventStore, title string,
+	start time.Time, owners ...string) *Event {
+	var e *Event = CreateEvent(store, title, "Test event", "", start,
+		2*time.Hour, time.UTC, nil, true)
+	var err error
+
+	e.Owners = owners
+	e.MaxStaff = 3
+	err = e.Sync()
+	if err != nil {
+		t.Fatal("Error writing event ", title, ": ", err)
+	}
+
+	return e
+}
+
+func TestSQLFetchEvent(t *testing.T) {
+	var s *SQLEventStore = newSQLiteStore(t)
+	var start time.Time = time.Date(2027, 3, 2, 18, 0, 0, 0, time.UTC)
+	var e, got *Event
+	var err error
+
+	e = CreateEvent(s, "Open Factory", "Come in", "alice", start,
+		2*time.Hour, time.UTC, nil, true)
+	e.Reference, _ = url.Parse("https://www.example.org/open-factory")
+	e.GeneratorID = []byte{1, 2, 3}
+	e.Owners = append(e.Owners, "bob")
+	e.Handovers = []Handover{{From: "bob", To: "carol"}}
+	e.MinStaff = 2
+	e.MaxStaff = 3
+	err = e.Sync()
+	if err != nil {
+		t.Fatal("Error writing event: ", err)
+	}
+
+	got, err = s.FetchEvent(e.ID, time.UTC, true)
+	if err != nil {
+		t.Fatal("Error fetching event: ", err)
+	}
+	if got.Title != e.Title || got.Description != e.Description ||
+		!got.Start.Equal(e.Start) || got.Duration != e.Duration ||
+		got.ownerColumn() != "alice,bob>carol" || !got.Required ||
+		got.Reference.String() != e.Reference.String() ||
+		!bytes.Equal(got.GeneratorID, e.GeneratorID) ||
+		got.MinStaff != 2 || got.MaxStaff != 3 {
+		t.Errorf("got %+v, want %+v", got, e)
+	}
+
+	_, err = s.FetchEvent("nonexistent", time.UTC, true)
+	if err != ErrEventNotFound {
+		t.Errorf("nonexistent event: got %v, want %v", err,
+			ErrEventNotFound)
+	}
+}
+
+func TestSQLFetchEventRange(t *testing.T) {
+	var loc *time.Location = zurich(t)
+	var s *SQLEventStore = newSQLiteStore(t)
+
+	addRangeTestEvents(t, s, loc)
+	checkFetchEventRange(t, s, loc)
+}
+
+func TestSQLSyncOwners(t *testing.T) {
+	var s *SQLEventStore = newSQLiteStore(t)
+	var e *Event = addSQLTestEvent(t, s, "Event",
+		time.Date(2027, 3, 2, 18, 0, 0, 0, time.UTC))
+	var stale, update Event
+	var err error
+
+	stale = *e
+	update = *e
+	update.Owners = []string{"alice"}
+	err = s.SyncOwners(&update, e)
+	if err != nil {
+		t.Fatal("Error taking event: ", err)
+	}
+
+	// Someone still looking at the event without owners.
+	update = stale
+	update.Owners = []string{"bob"}
+	err = s.SyncOwners(&update, &stale)
+	if err != ErrOwnerChanged {
+		t.Errorf("conflicting change: got %v, want %v", err,
+			ErrOwnerChanged)
+	}
+
+	err = e.AddOwner("bob")
+	if err != nil {
+		t.Fatal("Error adding owner after re-reading: ", err)
+	}
+	checkStoredEvent(t, "after conflict", s, e.ID, "Event", "alice,bob")
+}
+
+func TestSQLSyncDetails(t *testing.T) {
+	checkSyncDetails(t, newSQLiteStore(t))
+}
+
+func TestSQLDeleteEvent(t *testing.T) {
+	var s *SQLEventStore = newSQLiteStore(t)
+	var start time.Time = time.Date(2027, 3, 2, 18, 0, 0, 0, time.UTC)
+	var e *Event = addSQLTestEvent(t, s, "Event", start)
+	var changed *Event = addSQLTestEvent(t, s, "Changed", start)
+	var stale Event = *changed
+	var err error
+
+	err = e.Delete()
+	if err != nil {
+		t.Fatal("Error deleting event: ", err)
+	}
+	_, err = s.FetchEvent(e.ID, time.UTC, true)
+	if err != ErrEventNotFound {
+		t.Errorf("deleted event: got %v, want %v", err, ErrEventNotFound)
+	}
+
+	err = e.Delete()
+	if err != ErrEventNotFound {
+		t.Errorf("deleting twice: got %v, want %v", err, ErrEventNotFound)
+	}
+
+	err = changed.AddOwner("alice")
+	if err != nil {
+		t.Fatal("Error adding owner: ", err)
+	}
+	// Timestamps only have microsecond precision.
+	stale.updateTS = changed.updateTS - 1
+
+	err = stale.Delete()
+	if err != ErrEventChanged {
+		t.Errorf("deleting a changed event: got %v, want %v", err,
+			ErrEventChanged)
+	}
+	checkStoredEvent(t, "after failed delete", s, changed.ID, "Changed",
+		"alice")
+}
+
+func TestSQLMigrations(t *testing.T) {
+	var db *sql.DB = openSQLite(t)
+	var migrations []string = sqlMigrations
+	var owners []string
+	var s *SQLEventStore
+	var e *Event
+	var indexes []string
+	var version int
+	var rows *sql.Rows
+	var err error
+
+	// Create the schema from before the owner lists with an event in it.
+	sqlMigrations = migrations[:8]
+	_, err = NewSQLEventStore(db, "sqlite3")
+	sqlMigrations = migrations
+	if err != nil {
+		t.Fatal("Error creating old schema: ", err)
+	}
+	_, err = db.Exec(`INSERT INTO events (id, title, description, owner,
+		start_ts, end_ts, required, reference, generator_id, update_ts,
+		min_staff, max_staff) VALUES ('old', 'Old', 'Old event', 'alice',
+		1000, 3601000, 1, '', NULL, 1, 1, 1)`)
+	if err != nil {
+		t.Fatal("Error writing old event: ", err)
+	}
+
+	s, err = NewSQLEventStore(db, "sqlite3")
+	if err != nil {
+		t.Fatal("Error migrating: ", err)
+	}
+	checkStoredEvent(t, "migrated", s, "old", "Old", "alice")
+
+	err = db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(
+		&version)
+	if err != nil || version != len(sqlMigrations) {
+		t.Errorf("schema version: got %d (%v), want %d", version, err,
+			len(sqlMigrations))
+	}
+
+	rows, err = db.Query("SELECT name FROM sqlite_master WHERE " +
+		"type = 'index' AND tbl_name = 'events' AND sql IS NOT NULL " +
+		"ORDER BY name")
+	if err != nil {
+		t.Fatal("Error listing indexes: ", err)
+	}
+	for rows.Next() {
+		var name string
+
+		err = rows.Scan(&name)
+		if err != nil {
+			t.Fatal("Error listing indexes: ", err)
+		}
+		indexes = append(indexes, name)
+	}
+	rows.Close()
+	if strings.Join(indexes, ",") != "events_range_idx" {
+		t.Errorf("indexes: got %v, want events_range_idx", indexes)
+	}
+
+	// Owner lists no longer fit into 255 characters.
+	e, err = s.FetchEvent("old", time.UTC, true)
+	if err != nil {
+		t.Fatal("Error fetching event: ", err)
+	}
+	for len(strings.Join(owners, ",")) < 300 {
+		owners = append(owners, "member-with-a-long-name")
+	}
+	e.Owners = owners
+	e.MaxStaff = int32(len(owners))
+	err = e.Sync()
+	if err != nil {
+		t.Fatal("Error writing long owner list: ", err)
+	}
+	checkStoredEvent(t, "long owner list", s, "old", "Old",
+		strings.Join(owners, ","))
+
+	// Opening the store again has nothing left to do.
+	_, err = NewSQLEventStore(db, "sqlite3")
+	if err != nil {
+		t.Error("Error opening migrated store: ", err)
+	}
+}
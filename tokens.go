@@ -0,0 +1,121 @@
+package dutycal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Purpose string for tokens protecting forms against cross-site requests.
+const csrfTokenPurpose = "csrf"
+
+// How long forms can be submitted after they have been generated.
+const csrfTokenLifetime = 24 * time.Hour
+
+// Name of the cookie identifying the browser session form tokens are bound
+// to.
+const sessionCookieName = "dutycal_session"
+
+// Derive a token from the configured secret key. "purpose" separates tokens
+// used for different things, so that e.g. a calendar feed token cannot be
+// used to authenticate anything else. Returns an empty string if no secret
+// key has been configured.
+func genToken(conf *DutyCalConfig, purpose string, data ...string) string {
+	var d string
+	var h hash.Hash = hmac.New(sha256.New, []byte(conf.GetSecretKey()))
+
+	if len(conf.GetSecretKey()) == 0 {
+		return ""
+	}
+
+	h.Write([]byte(purpose))
+	for _, d = range data {
+		h.Write([]byte{0})
+		h.Write([]byte(d))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Check whether "token" was derived from the secret key for the given
+// purpose and data.
+func checkToken(conf *DutyCalConfig, token, purpose string,
+	data ...string) bool {
+	var expected string = genToken(conf, purpose, data...)
+
+	if len(expected) == 0 {
+		return false
+	}
+
+	return hmac.Equal([]byte(token), []byte(expected))
+}
+
+// Determine the identifier of the browser session of "req". If it doesn't
+// have one yet, a new one is set as a cookie on "rw", so this has to be
+// called before anything is written. Returns an empty string if no
+// identifier could be generated.
+func sessionID(rw http.ResponseWriter, req *http.Request) string {
+	var cookie *http.Cookie
+	var rnd [16]byte
+	var err error
+
+	cookie, err = req.Cookie(sessionCookieName)
+	if err == nil && len(cookie.Value) > 0 {
+		return cookie.Value
+	}
+
+	_, err = rand.Read(rnd[:])
+	if err != nil {
+		log.Print("Error generating session identifier: ", err)
+		return ""
+	}
+
+	cookie = &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    hex.EncodeToString(rnd[:]),
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(rw, cookie)
+
+	return cookie.Value
+}
+
+// Generate a token to embed in forms submitted by "user" in the browser
+// session "session", which proves that the form was generated by us for the
+// currently logged in user. A token leaking from another session, e.g.
+// through a cached page, can't be used.
+func genCSRFToken(conf *DutyCalConfig, user, session string) string {
+	var ts string = strconv.FormatInt(time.Now().Unix(), 10)
+
+	return ts + "." + genToken(conf, csrfTokenPurpose, user, session, ts)
+}
+
+// Verify that "token" was generated by genCSRFToken for "user" in the
+// browser session "session" and has not expired yet.
+func checkCSRFToken(conf *DutyCalConfig, user, session, token string) bool {
+	var parts []string = strings.SplitN(token, ".", 2)
+	var ts int64
+	var err error
+
+	if len(user) == 0 || len(session) == 0 || len(parts) != 2 {
+		return false
+	}
+
+	ts, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Since(time.Unix(ts, 0)) > csrfTokenLifetime {
+		return false
+	}
+
+	return checkToken(conf, parts[1], csrfTokenPurpose, user, session,
+		parts[0])
+}
@@ -0,0 +1,119 @@
+package dutycal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Form token submitted by a user in a browser session, and whether it must
+// be accepted.
+type csrfTokenTest struct {
+	name    string
+	user    string
+	session string
+	token   string
+	valid   bool
+}
+
+func TestCheckCSRFToken(t *testing.T) {
+	var conf *DutyCalConfig = &DutyCalConfig{
+		SecretKey: proto.String("0123456789abcdef0123456789abcdef"),
+	}
+	var token string = genCSRFToken(conf, "alice", "session1")
+	var expired string = strconv.FormatInt(
+		time.Now().Add(-csrfTokenLifetime-time.Minute).Unix(), 10)
+	var test csrfTokenTest
+	var tests = []csrfTokenTest{
+		{
+			name:    "same user and session",
+			user:    "alice",
+			session: "session1",
+			token:   token,
+			valid:   true,
+		},
+		{
+			name:    "other session",
+			user:    "alice",
+			session: "session2",
+			token:   token,
+		},
+		{
+			name:  "no session",
+			user:  "alice",
+			token: token,
+		},
+		{
+			name:    "other user",
+			user:    "bob",
+			session: "session1",
+			token:   token,
+		},
+		{
+			name:    "not logged in",
+			session: "session1",
+			token:   token,
+		},
+		{
+			name:    "expired",
+			user:    "alice",
+			session: "session1",
+			token: expired + "." + genToken(conf, csrfTokenPurpose,
+				"alice", "session1", expired),
+		},
+		{
+			name:    "garbage",
+			user:    "alice",
+			session: "session1",
+			token:   "garbage",
+		},
+	}
+
+	for _, test = range tests {
+		if checkCSRFToken(conf, test.user, test.session, test.token) !=
+			test.valid {
+			t.Errorf("%s: got %v, want %v", test.name, !test.valid,
+				test.valid)
+		}
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	var rec *httptest.ResponseRecorder = httptest.NewRecorder()
+	var req *http.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	var cookies []*http.Cookie
+	var session string
+
+	session = sessionID(rec, req)
+	cookies = rec.Result().Cookies()
+	if len(session) == 0 || len(cookies) != 1 ||
+		cookies[0].Name != sessionCookieName ||
+		cookies[0].Value != session || !cookies[0].HttpOnly ||
+		!cookies[0].Secure {
+		t.Fatalf("got session %q and cookies %v, want a secure cookie",
+			session, cookies)
+	}
+
+	// The session is kept as long as the browser sends the cookie.
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	if sessionID(rec, req) != session {
+		t.Error("Session not kept")
+	}
+	if len(rec.Result().Cookies()) != 0 {
+		t.Errorf("got cookies %v for a known session",
+			rec.Result().Cookies())
+	}
+
+	// Other browsers get sessions of their own.
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	if sessionID(rec, req) == session {
+		t.Error("New session has the same identifier")
+	}
+}
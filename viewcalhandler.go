@@ -1,7 +1,6 @@
 package dutycal
 
 import (
-	"database/cassandra"
 	"html/template"
 	"io"
 	"log"
@@ -16,7 +15,7 @@ import (
 // calendar. Mostly used as an HTTP handler.
 type ViewCalHandler struct {
 	am        *authManager
-	db        *cassandra.RetryCassandraClient
+	store     EventStore
 	templates *template.Template
 	config    *DutyCalConfig
 	location  *time.Location
@@ -35,16 +34,19 @@ type calendarViewData struct {
 	Events     [][]*Event
 	Unassigned []*Event
 	Mine       []*Event
+
+	PersonalFeed string
+	ShowChanges  bool
 }
 
 // NewViewCalHandler creates a new HTTP handler for viewing calendar entries.
 // All flags will just be placed into the ViewCalHandler as they are.
 func NewViewCalHandler(
-	db *cassandra.RetryCassandraClient, auth *ancientauth.Authenticator,
+	store EventStore, auth *ancientauth.Authenticator,
 	loc *time.Location, tmpl *template.Template,
 	conf *DutyCalConfig) *ViewCalHandler {
-	if db == nil {
-		log.Panic("db is nil")
+	if store == nil {
+		log.Panic("store is nil")
 	}
 	if conf == nil {
 		log.Panic("conf is nil")
@@ -57,7 +59,7 @@ func NewViewCalHandler(
 	}
 	return &ViewCalHandler{
 		am:        NewAuthManager(auth),
-		db:        db,
+		store:     store,
 		templates: tmpl,
 		config:    conf,
 		location:  loc,
@@ -118,7 +120,7 @@ func (v *ViewCalHandler) ServeHTTP(
 		_, offset = ts.Zone()
 		dayend = dayend.Add(time.Duration(-offset) * time.Second)
 
-		events, err = FetchEventRange(v.db, v.config,
+		events, err = FetchEventRange(v.store,
 			ts, dayend, -1, v.location, nil, false)
 		if err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
@@ -133,7 +135,7 @@ func (v *ViewCalHandler) ServeHTTP(
 		ts = dayend
 	}
 
-	md.Unassigned, err = FetchEventRange(v.db, v.config, time.Now(),
+	md.Unassigned, err = FetchEventRange(v.store, time.Now(),
 		time.Unix(0, 0), v.config.GetUpcomingEventsLookahead(), v.location,
 		&user, false)
 	if err != nil {
@@ -143,7 +145,10 @@ func (v *ViewCalHandler) ServeHTTP(
 	v.am.GenAuthDetails(req, &md.Auth)
 	user = md.Auth.User
 	if len(user) > 0 {
-		md.Mine, err = FetchEventRange(v.db, v.config, time.Now(),
+		md.PersonalFeed = PersonalFeedPath(v.config, user)
+		md.ShowChanges = v.am.auth.IsAuthenticatedScope(req,
+			v.config.GetEditScope())
+		md.Mine, err = FetchEventRange(v.store, time.Now(),
 			time.Unix(0, 0), v.config.GetUserEventsLookahead(), v.location,
 			&user, false)
 		if err != nil {
@@ -1,11 +1,12 @@
 package dutycal
 
 import (
-	"database/cassandra"
+	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -18,7 +19,7 @@ import (
 type ViewEventHandler struct {
 	auth      *ancientauth.Authenticator
 	am        *authManager
-	db        *cassandra.RetryCassandraClient
+	store     EventStore
 	templates *template.Template
 	config    *DutyCalConfig
 	location  *time.Location
@@ -29,29 +30,48 @@ type ViewEventHandler struct {
 type ViewEventData struct {
 	Auth AuthDetails
 
-	Op   string
-	Ev   *Event
-	End  time.Time
-	Week int64
+	Op        string
+	Confirm   string
+	Error     string
+	CSRFToken string
+	Ev        *Event
+	End       time.Time
+	Week      int64
 
+	// Personal details are only shown to users authenticated to a scope
+	// which can see them.
+	ShowOwners bool
+
+	CanTake     bool
 	CanDisclaim bool
 	CanDelete   bool
+	CanEdit     bool
+	CanHandover bool
+	CanWithdraw bool
+	CanAccept   bool
+
+	// Handover offers the user could accept, and the owner whose offer
+	// should be confirmed.
+	Offers       []Handover
+	HandoverFrom string
+
+	History []*HistoryEntry
 }
 
 // NewViewEventHandler creates a new ViewEventHandler object using the specified
-// database connection "db", the authentication client parameters "auth", the
+// event store "store", the authentication client parameters "auth", the
 // timestamp locale "loc", the HTML template "tmpl" and just in general the
 // configuration protobuf "conf".
 //
 // This method cannot fail (except for running out of memory or something).
 func NewViewEventHandler(
-	db *cassandra.RetryCassandraClient,
+	store EventStore,
 	auth *ancientauth.Authenticator,
 	loc *time.Location,
 	tmpl *template.Template,
 	conf *DutyCalConfig) *ViewEventHandler {
-	if db == nil {
-		log.Panic("db is nil")
+	if store == nil {
+		log.Panic("store is nil")
 	}
 	if conf == nil {
 		log.Panic("conf is nil")
@@ -65,7 +85,7 @@ func NewViewEventHandler(
 	return &ViewEventHandler{
 		auth:      auth,
 		am:        NewAuthManager(auth),
-		db:        db,
+		store:     store,
 		templates: tmpl,
 		config:    conf,
 		location:  loc,
@@ -74,14 +94,17 @@ func NewViewEventHandler(
 
 func (v *ViewEventHandler) ServeHTTP(
 	rw http.ResponseWriter, req *http.Request) {
-	var user string
+	var user, session string
 	var ed *ViewEventData
 	var canEdit bool
-	var canDelete bool
-	var canDisclaim bool
+	var perms EventPermissions
 	var urlparts []string = strings.Split(req.URL.Path, "/")
 	var op string
+	var confirm string
+	var errmsg string
+	var status int = http.StatusOK
 	var ev *Event
+	var before Event
 	var err error
 
 	user = v.auth.GetAuthenticatedUser(req)
@@ -96,8 +119,11 @@ func (v *ViewEventHandler) ServeHTTP(
 	}
 
 	canEdit = v.auth.IsAuthenticatedScope(req, v.config.GetEditScope())
+	if len(user) > 0 {
+		session = sessionID(rw, req)
+	}
 
-	ev, err = FetchEvent(v.db, v.config, urlparts[2], v.location, false)
+	ev, err = FetchEvent(v.store, urlparts[2], v.location, false)
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		io.WriteString(rw, "Error fetching event "+urlparts[2]+": "+
@@ -106,82 +132,251 @@ func (v *ViewEventHandler) ServeHTTP(
 		return
 	}
 
-	canDelete = !ev.Required && ev.Owner == user
-	canDisclaim = ev.Owner == user
+	perms = GetEventPermissions(ev, user, canEdit)
+	before = *ev
 
-	if op == "take" {
+	if op == "take" || op == "disclaim" || op == "delete" ||
+		op == "handover" || op == "withdraw" || op == "accept" {
 		if len(user) == 0 {
 			v.auth.RequestAuthorization(rw, req)
 			return
 		}
 
-		if canEdit {
-			ev.Owner = user
-			err = ev.Sync()
-			if err != nil {
-				log.Print("Error syncing new owner ", user,
-					" for event ", ev.ID, ": ", err)
-				ev.Owner = err.Error()
+		// State is only ever changed by POST requests carrying a valid
+		// form token, so links and prefetchers can't do it by accident.
+		// Anything else just gets to confirm the operation.
+		if req.Method != http.MethodPost {
+			confirm = op
+			op = "view"
+		} else if !checkCSRFToken(v.config, user, session,
+			req.PostFormValue("csrf_token")) {
+			rw.WriteHeader(http.StatusForbidden)
+			io.WriteString(rw, "Invalid or expired form token for "+op+
+				" on event "+ev.ID+", please try again.\r\n")
+			return
+		}
+	}
+
+	if op == "take" {
+		if perms.CanDisclaim {
+			// Nothing to do, probably submitted twice.
+			rw.Header().Set("Location", "/event/"+ev.ID+"/view")
+			rw.WriteHeader(http.StatusSeeOther)
+			return
+		} else if canEdit {
+			// Only sign up if there is still room, re-reading the event
+			// if other people sign up at the same time.
+			err = ev.AddOwner(user)
+			if err == nil {
+				RecordHistory(v.store, HistoryTake, user, &before, ev)
+				rw.Header().Set("Location",
+					"/event/"+ev.ID+"/view")
+				rw.WriteHeader(http.StatusSeeOther)
+				return
+			} else if err == ErrEventFull || err == ErrOwnerChanged {
+				errmsg = "Someone else just took this slot."
+				status = http.StatusConflict
+			} else {
+				log.Print("Error adding owner ", user,
+					" to event ", ev.ID, ": ", err)
+				errmsg = err.Error()
+				status = http.StatusInternalServerError
 			}
 		}
 	} else if op == "disclaim" {
-		if len(user) == 0 {
-			v.auth.RequestAuthorization(rw, req)
-			return
+		if perms.CanDisclaim {
+			err = ev.RemoveOwner(user)
+			if err == nil {
+				RecordHistory(v.store, HistoryDisclaim, user, &before, ev)
+				rw.Header().Set("Location",
+					"/event/"+ev.ID+"/view")
+				rw.WriteHeader(http.StatusSeeOther)
+				return
+			} else if err == ErrOwnerChanged {
+				errmsg = "The slot was changed by someone else " +
+					"in the meantime."
+				status = http.StatusConflict
+			} else {
+				log.Print("Error removing owner ", user,
+					" from event ", ev.ID, ": ", err)
+				errmsg = err.Error()
+				status = http.StatusInternalServerError
+			}
 		}
+	} else if op == "handover" {
+		var to string = strings.TrimSpace(req.PostFormValue("to"))
 
-		if canDisclaim {
-			ev.Owner = ""
-			err = ev.Sync()
+		if perms.CanHandover && (to == user || checkOwnerName(to) != nil) {
+			errmsg = "Cannot hand over the slot to " + to + "."
+			status = http.StatusBadRequest
+		} else if perms.CanHandover {
+			err = ev.OfferHandover(user, to)
 			if err == nil {
+				RecordHistory(v.store, HistoryOffer, user, &before, ev)
+				if len(to) > 0 {
+					go v.sendHandoverMail(ev, []string{to},
+						"Shift handover offered: "+ev.Title,
+						fmt.Sprintf("%s would like to hand over the "+
+							"following shift to you:", user),
+						"If you can take it, please accept the handover on")
+				}
 				rw.Header().Set("Location",
 					"/event/"+ev.ID+"/view")
-				rw.WriteHeader(http.StatusTemporaryRedirect)
+				rw.WriteHeader(http.StatusSeeOther)
 				return
+			} else if err == ErrNotOwner || err == ErrOwnerChanged {
+				errmsg = "The slot was changed by someone else " +
+					"in the meantime."
+				status = http.StatusConflict
+			} else {
+				log.Print("Error offering handover of event ", ev.ID,
+					" by ", user, ": ", err)
+				errmsg = err.Error()
+				status = http.StatusInternalServerError
 			}
+		}
+	} else if op == "withdraw" {
+		if perms.CanWithdraw {
+			err = ev.WithdrawHandover(user)
+			if err == nil {
+				RecordHistory(v.store, HistoryWithdraw, user, &before, ev)
+				rw.Header().Set("Location",
+					"/event/"+ev.ID+"/view")
+				rw.WriteHeader(http.StatusSeeOther)
+				return
+			} else if err == ErrOwnerChanged {
+				errmsg = "The slot was changed by someone else " +
+					"in the meantime."
+				status = http.StatusConflict
+			} else {
+				log.Print("Error withdrawing handover of event ", ev.ID,
+					" by ", user, ": ", err)
+				errmsg = err.Error()
+				status = http.StatusInternalServerError
+			}
+		}
+	} else if op == "accept" {
+		var from string = req.PostFormValue("from")
 
-			log.Print("Error syncing new owner ", user,
-				" for event ", ev.ID, ": ", err)
-			ev.Owner = err.Error()
+		if perms.CanDisclaim {
+			// Nothing to do, probably submitted twice.
+			rw.Header().Set("Location", "/event/"+ev.ID+"/view")
+			rw.WriteHeader(http.StatusSeeOther)
+			return
+		} else if perms.CanAccept {
+			// Swap the owners in a single update, re-reading the event
+			// if other people change it at the same time.
+			err = ev.AcceptHandover(from, user)
+			if err == nil {
+				RecordHistory(v.store, HistoryHandover, user, &before, ev)
+				go v.sendHandoverMail(ev, []string{from, user},
+					"Shift handed over: "+ev.Title,
+					fmt.Sprintf("%s has taken over the following shift "+
+						"from %s:", user, from),
+					"The details of the shift can be found on")
+				rw.Header().Set("Location",
+					"/event/"+ev.ID+"/view")
+				rw.WriteHeader(http.StatusSeeOther)
+				return
+			} else if err == ErrHandoverGone || err == ErrEventFull ||
+				err == ErrOwnerChanged {
+				errmsg = "This handover offer is no longer available."
+				status = http.StatusConflict
+			} else {
+				log.Print("Error handing over event ", ev.ID, " from ",
+					from, " to ", user, ": ", err)
+				errmsg = err.Error()
+				status = http.StatusInternalServerError
+			}
 		}
-	} else if op == "delete" {
+	} else if op == "edit" {
 		if len(user) == 0 {
 			v.auth.RequestAuthorization(rw, req)
 			return
 		}
 
-		if canDelete {
+		if !perms.CanEdit {
+			rw.WriteHeader(http.StatusForbidden)
+			io.WriteString(rw, "No permission to edit event "+ev.ID+
+				": "+user+" is neither the owner nor in "+
+				v.config.GetEditScope()+"\r\n")
+			return
+		}
+
+		v.serveEditForm(rw, req, ev, user, session)
+		return
+	} else if op == "delete" {
+		if perms.CanDelete {
 			err = ev.Delete()
 			if err == nil {
+				RecordHistory(v.store, HistoryDelete, user, &before, nil)
 				rw.Header().Set("Location",
 					"/?week="+strconv.FormatInt(
 						getWeekFromTimestamp(ev.Start), 10))
-				rw.WriteHeader(http.StatusTemporaryRedirect)
+				rw.WriteHeader(http.StatusSeeOther)
 				return
+			} else if err == ErrEventChanged {
+				errmsg = "The event was changed by someone else " +
+					"in the meantime."
+				status = http.StatusConflict
+			} else {
+				log.Print("Error deleting event ", ev.ID, ": ", err)
+				errmsg = err.Error()
+				status = http.StatusInternalServerError
 			}
-			log.Print("Error deleting event ", ev.ID, ": ", err)
 		}
 	}
 
-	// Things may have changed above, let's recompute.
-	canDelete = !ev.Required && ev.Owner == user
-	canDisclaim = ev.Owner == user
-
-	// Hide personal details unless the user is authenticated to a scope
-	// which can see them.
-	if !canEdit && len(ev.Owner) > 0 {
-		ev.Owner = "Assigned"
+	if len(errmsg) > 0 {
+		// Show the event as it is now, not as we wanted it to be.
+		ev, err = FetchEvent(v.store, urlparts[2], v.location, true)
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(rw, "Error fetching event "+urlparts[2]+": "+
+				err.Error()+"\r\n")
+			log.Print("Error fetching event ", urlparts[2], ": ", err)
+			return
+		}
 	}
 
+	// Things may have changed above, let's recompute.
+	perms = GetEventPermissions(ev, user, canEdit)
+
 	ed = &ViewEventData{
 		Ev:          ev,
 		Op:          op,
 		End:         ev.Start.Add(ev.Duration).In(v.location),
 		Week:        getWeekFromTimestamp(ev.Start),
-		CanDelete:   canDelete,
-		CanDisclaim: canDisclaim,
+		ShowOwners:  canEdit,
+		CanTake:     perms.CanTake,
+		CanDelete:   perms.CanDelete,
+		CanDisclaim: perms.CanDisclaim,
+		CanEdit:     perms.CanEdit,
+		CanHandover: perms.CanHandover,
+		CanWithdraw: perms.CanWithdraw,
+		CanAccept:   perms.CanAccept,
+		Confirm:     confirm,
+		Error:       errmsg,
+	}
+	if perms.CanAccept {
+		ed.Offers = ev.HandoversFor(user)
+	}
+	if confirm == "accept" {
+		ed.HandoverFrom = req.FormValue("from")
+	}
+	if len(user) > 0 {
+		ed.CSRFToken = genCSRFToken(v.config, user, session)
+	}
+	if canEdit {
+		ed.History, err = v.store.FetchHistory(ev.ID, v.location)
+		if err != nil {
+			log.Print("Error fetching history of event ", ev.ID, ": ", err)
+		}
 	}
 	v.am.GenAuthDetails(req, &ed.Auth)
+	if status != http.StatusOK {
+		rw.WriteHeader(status)
+	}
 	err = v.templates.ExecuteTemplate(rw, "viewevent.html", ed)
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
@@ -190,3 +385,105 @@ func (v *ViewEventHandler) ServeHTTP(
 		log.Print("Error executing template for ", urlparts[2], ": ", err)
 	}
 }
+
+// Display the form for editing the event "ev" to "user" in the browser
+// session "session", and write the changes back once it was submitted. The
+// event keeps its ID even if the title or time change, so existing links to
+// it remain valid. The owners aren't part of the form and are left as they
+// are stored, so nobody who signed up while the form was shown is dropped,
+// unless the event is moved to a different time. Dropped owners are told
+// by mail.
+func (v *ViewEventHandler) serveEditForm(
+	rw http.ResponseWriter, req *http.Request, ev *Event,
+	user, session string) {
+	var ed NewEventHandlerData
+	var end time.Time = ev.Start.Add(ev.Duration).In(v.location)
+	var before Event = *ev
+	var dropped []string
+	var err error
+
+	ed.Action = "/event/" + url.PathEscape(ev.ID) + "/edit"
+	ed.Ev = ev
+	ed.DateFormatted = ev.Start.In(v.location).Format("02.01.2006")
+	ed.StartHour = ev.Start.In(v.location).Hour()
+	ed.StartMinute = ev.Start.In(v.location).Minute()
+	ed.EndHour = end.Hour()
+	ed.EndMinute = end.Minute()
+
+	ed.CSRFToken = genCSRFToken(v.config, user, session)
+
+	if req.Method == http.MethodPost {
+		err = req.ParseForm()
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			io.WriteString(rw, "Error parsing edit form: "+
+				err.Error()+"\r\n")
+			log.Print("Error parsing edit form: ", err)
+			return
+		}
+
+		if !checkCSRFToken(v.config, user, session,
+			req.PostFormValue("csrf_token")) {
+			ed.Error = "Invalid or expired form token, please submit again."
+		} else if readEventForm(req, v.location, &ed) {
+			dropped, err = ev.SyncEdit(&before)
+			if err == nil {
+				RecordHistory(v.store, HistoryEdit, user, &before, ev)
+				if len(dropped) > 0 {
+					go notifyDroppedOwners(v.config, v.location, ev,
+						dropped)
+				}
+				rw.Header().Set("Location", "/event/"+ev.ID+"/view")
+				rw.WriteHeader(http.StatusSeeOther)
+				return
+			}
+
+			if err == ErrOwnerChanged {
+				ed.Error = "Someone signed up for or left the event in " +
+					"the meantime, please check and submit again."
+			} else {
+				ed.Error = err.Error()
+				log.Print("Error writing changes to event ", ev.ID, ": ",
+					err)
+			}
+		}
+	}
+
+	v.am.GenAuthDetails(req, &ed.Auth)
+	err = v.templates.ExecuteTemplate(rw, "newevent.html", &ed)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(rw, "Error executing edit template for "+ev.ID+
+			": "+err.Error()+"\r\n")
+		log.Print("Error executing edit template for ", ev.ID, ": ", err)
+	}
+}
+
+// Notify the members "users" about a handover of the event "ev" by mail,
+// see SendEventMail. Meant to run in the background, so errors are only
+// logged.
+func (v *ViewEventHandler) sendHandoverMail(ev *Event, users []string,
+	subject, intro, linkText string) {
+	var err error
+
+	err = SendEventMail(v.config, v.location, ev, users, subject, intro,
+		linkText)
+	if err != nil {
+		log.Print("Error sending handover mail for event ", ev.ID, " to ",
+			users, ": ", err)
+	}
+}
+
+// Tell the members "dropped" that they are no longer signed up for the
+// event "ev" since it was moved. Meant to run in the background, so errors
+// are only logged.
+func notifyDroppedOwners(config *DutyCalConfig, loc *time.Location,
+	ev *Event, dropped []string) {
+	var err error
+
+	err = NotifyDroppedOwners(config, loc, ev, dropped)
+	if err != nil {
+		log.Print("Error telling the dropped owners of event ", ev.ID,
+			": ", err)
+	}
+}